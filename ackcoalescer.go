@@ -0,0 +1,147 @@
+package sequin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// AckCoalescingOptions configures ProcessorOptions.AckCoalescing.
+type AckCoalescingOptions struct {
+	// FlushInterval is the longest an ack waits to be sent. Defaults to 100ms.
+	FlushInterval time.Duration
+
+	// MaxBatch is the most ack IDs sent in one Ack call; reaching it
+	// flushes immediately. Defaults to 1000.
+	MaxBatch int
+}
+
+func (o *AckCoalescingOptions) validate() error {
+	if o.FlushInterval < 0 {
+		return fmt.Errorf("FlushInterval must be >= 0, got %v", o.FlushInterval)
+	}
+	if o.FlushInterval == 0 {
+		o.FlushInterval = 100 * time.Millisecond
+	}
+	if o.MaxBatch < 0 {
+		return fmt.Errorf("MaxBatch must be >= 0, got %d", o.MaxBatch)
+	}
+	if o.MaxBatch == 0 {
+		o.MaxBatch = 1000
+	}
+	return nil
+}
+
+// ackCoalescer collects the ack IDs of processed batches and acknowledges
+// them in the background, in as few Ack calls as possible.
+type ackCoalescer struct {
+	p    *Processor
+	opts AckCoalescingOptions
+
+	mu      sync.Mutex
+	pending map[string][]string // ack IDs by consumer group
+	count   int
+	stopped bool
+
+	full     chan struct{} // signalled when count reaches MaxBatch
+	stopping chan struct{}
+	done     chan struct{}
+}
+
+func newAckCoalescer(p *Processor, opts AckCoalescingOptions) *ackCoalescer {
+	return &ackCoalescer{
+		p:        p,
+		opts:     opts,
+		pending:  make(map[string][]string),
+		full:     make(chan struct{}, 1),
+		stopping: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// add queues ackIDs of consumerGroup to be acknowledged. It returns false
+// without queuing them once stop has been called, for the caller to
+// acknowledge them itself.
+func (a *ackCoalescer) add(consumerGroup string, ackIDs []string) bool {
+	a.mu.Lock()
+	if a.stopped {
+		a.mu.Unlock()
+		return false
+	}
+	a.pending[consumerGroup] = append(a.pending[consumerGroup], ackIDs...)
+	a.count += len(ackIDs)
+	full := a.count >= a.opts.MaxBatch
+	a.mu.Unlock()
+
+	if full {
+		select {
+		case a.full <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// run flushes queued acks every FlushInterval, or sooner when MaxBatch are
+// queued, until stop is called. Acks are sent with a detached ctx so they
+// complete during shutdown.
+func (a *ackCoalescer) run(ctx context.Context) {
+	defer close(a.done)
+	ctx = detach(ctx)
+
+	ticker := time.NewTicker(a.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stopping:
+			a.flush(ctx)
+			return
+		case <-ticker.C:
+		case <-a.full:
+		}
+		a.flush(ctx)
+	}
+}
+
+// stop sends the remaining acks and waits for run to return.
+func (a *ackCoalescer) stop() {
+	a.mu.Lock()
+	a.stopped = true
+	a.mu.Unlock()
+	close(a.stopping)
+	<-a.done
+}
+
+// flush acknowledges everything queued, MaxBatch ack IDs per call.
+func (a *ackCoalescer) flush(ctx context.Context) {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = make(map[string][]string)
+	a.count = 0
+	a.mu.Unlock()
+
+	for consumerGroup, ackIDs := range pending {
+		for len(ackIDs) > 0 {
+			n := len(ackIDs)
+			if n > a.opts.MaxBatch {
+				n = a.opts.MaxBatch
+			}
+			a.send(ctx, consumerGroup, ackIDs[:n])
+			ackIDs = ackIDs[n:]
+		}
+	}
+}
+
+func (a *ackCoalescer) send(ctx context.Context, consumerGroup string, ackIDs []string) {
+	failed, err := a.p.ack(ctx, consumerGroup, ackIDs)
+	if err == nil {
+		return
+	}
+	if a.p.opts.AckErrorHandler != nil {
+		a.p.stats.recordError(err)
+		a.p.opts.AckErrorHandler(ctx, failed, err)
+		return
+	}
+	a.p.reportError(ctx, consumerGroup, nil, err)
+}
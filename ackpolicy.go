@@ -0,0 +1,100 @@
+package sequin
+
+import (
+	"context"
+	"fmt"
+)
+
+// AckPolicy determines how a Processor acknowledges the batches it hands
+// to its handler.
+type AckPolicy int
+
+const (
+	// AckOnSuccess acknowledges a batch when its handler returns nil, and
+	// leaves it to be redelivered otherwise. This is the default.
+	AckOnSuccess AckPolicy = iota
+	// AlwaysAck acknowledges every batch, even when its handler fails, for
+	// consumers that prefer dropping a message to processing it twice.
+	AlwaysAck
+	// Manual leaves acknowledgement to the handler, which gets an Acker
+	// from AckerFromContext. Messages it neither acks nor nacks are
+	// redelivered once their visibility timeout expires.
+	Manual
+)
+
+func (p AckPolicy) String() string {
+	switch p {
+	case AckOnSuccess:
+		return "ack-on-success"
+	case AlwaysAck:
+		return "always-ack"
+	case Manual:
+		return "manual"
+	default:
+		return "unknown"
+	}
+}
+
+// Acker acknowledges messages on behalf of a handler run with the Manual
+// AckPolicy, e.g. only once its work has been committed downstream.
+type Acker interface {
+	// Ack acknowledges msgs, so they are not redelivered. With
+	// AckCoalescing, it only queues msgs to be acknowledged in the
+	// background, and failures are reported to the AckErrorHandler or
+	// ErrorHandler; once Run has returned, it acknowledges them directly.
+	Ack(ctx context.Context, msgs ...Message) error
+
+	// Nack releases msgs for immediate redelivery.
+	Nack(ctx context.Context, msgs ...Message) error
+}
+
+type ackerContextKey struct{}
+
+// AckerFromContext returns the Acker for the batch being handled under
+// ctx. It returns nil unless the Processor's AckPolicy is Manual.
+func AckerFromContext(ctx context.Context) Acker {
+	acker, _ := ctx.Value(ackerContextKey{}).(Acker)
+	return acker
+}
+
+// batchAcker is the Acker given to handlers of one consumer group's batch.
+type batchAcker struct {
+	p             *Processor
+	consumerGroup string
+}
+
+func (a *batchAcker) Ack(ctx context.Context, msgs ...Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	ackIDs := ackIDsOf(msgs)
+	if a.p.acks != nil && a.p.acks.add(a.consumerGroup, ackIDs) {
+		return nil
+	}
+	if _, err := a.p.ack(ctx, a.consumerGroup, ackIDs); err != nil {
+		return fmt.Errorf("acknowledging messages: %w", err)
+	}
+	return nil
+}
+
+func (a *batchAcker) Nack(ctx context.Context, msgs ...Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	err := a.p.client.Nack(ctx, a.consumerGroup, ackIDsOf(msgs))
+	a.p.stats.nack(len(msgs), err)
+	a.p.notFound.observe(a.consumerGroup, err)
+	if err != nil {
+		return fmt.Errorf("nacking messages: %w", err)
+	}
+	return nil
+}
+
+// ackIDsOf returns the ack IDs of msgs.
+func ackIDsOf(msgs []Message) []string {
+	ackIDs := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ackIDs[i] = msg.AckID
+	}
+	return ackIDs
+}
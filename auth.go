@@ -0,0 +1,156 @@
+package sequin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenProvider supplies the bearer token sent with each request.
+// Implementations must be safe for concurrent use.
+type TokenProvider interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticToken is a TokenProvider that always returns the same token.
+type StaticToken string
+
+// Token implements TokenProvider.
+func (t StaticToken) Token(context.Context) (string, error) {
+	return string(t), nil
+}
+
+// TokenFunc adapts a function, e.g. one reading a secret manager, to a
+// TokenProvider. It is called before every request, so it should cache
+// its token and return the current one cheaply.
+type TokenFunc func(ctx context.Context) (string, error)
+
+// Token implements TokenProvider.
+func (f TokenFunc) Token(ctx context.Context) (string, error) {
+	return f(ctx)
+}
+
+// TokenInvalidator is implemented by TokenProviders that cache tokens.
+// When the server rejects a token with 401 Unauthorized, e.g. because it
+// was rotated, the client calls InvalidateToken with it and retries the
+// request once with a fresh token from Token.
+type TokenInvalidator interface {
+	InvalidateToken(token string)
+}
+
+type tokenContextKey struct{}
+
+// ContextWithToken returns a copy of ctx under which requests are
+// authorized with token instead of the client's Token or TokenProvider, so
+// one Client and its connection pool can serve several Sequin accounts.
+// A Processor run with such a context uses token for all of its calls.
+func ContextWithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenContextKey{}, token)
+}
+
+// tokenFromContext returns the token set by ContextWithToken, if any.
+func tokenFromContext(ctx context.Context) (string, bool) {
+	token, ok := ctx.Value(tokenContextKey{}).(string)
+	return token, ok
+}
+
+// tokenExpiryDelta is how long before expiry a cached OAuth2 token is refreshed.
+const tokenExpiryDelta = 10 * time.Second
+
+// OAuth2ClientCredentials is a TokenProvider that obtains tokens with the
+// OAuth2 client-credentials grant and refreshes them before they expire.
+type OAuth2ClientCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	// HTTPClient is used to call TokenURL. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time // zero if the token does not expire
+}
+
+// Token implements TokenProvider.
+func (o *OAuth2ClientCredentials) Token(ctx context.Context) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.token != "" && (o.expires.IsZero() || time.Now().Add(tokenExpiryDelta).Before(o.expires)) {
+		return o.token, nil
+	}
+
+	token, expiresIn, err := o.fetch(ctx)
+	if err != nil {
+		return "", fmt.Errorf("fetching OAuth2 token: %w", err)
+	}
+	o.token = token
+	o.expires = time.Time{}
+	if expiresIn > 0 {
+		o.expires = time.Now().Add(expiresIn)
+	}
+	return o.token, nil
+}
+
+// InvalidateToken implements TokenInvalidator, so a token revoked before
+// its expiry is replaced on the next request.
+func (o *OAuth2ClientCredentials) InvalidateToken(token string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.token == token {
+		o.token = ""
+	}
+}
+
+func (o *OAuth2ClientCredentials) fetch(ctx context.Context) (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(o.Scopes) > 0 {
+		form.Set("scope", strings.Join(o.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", o.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+
+	httpClient := o.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		// Rejected client credentials (RFC 6749 section 5.2)
+		return "", 0, fmt.Errorf("%w: token endpoint returned status code %d", ErrUnauthorized, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"` // seconds
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", 0, fmt.Errorf("decoding response: %w", err)
+	}
+	if body.AccessToken == "" {
+		return "", 0, errors.New("response has no access_token")
+	}
+
+	return body.AccessToken, time.Duration(body.ExpiresIn) * time.Second, nil
+}
@@ -0,0 +1,188 @@
+package sequin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// AutoscaleOptions configures ProcessorOptions.Autoscale, which adjusts the
+// number of concurrent batches between MinConcurrent and MaxConcurrent.
+//
+// Every Interval, concurrency grows by one while there is a backlog (most
+// receives return full batches) and every concurrent slot was in use, as
+// long as handler latency holds up. It shrinks by one when average handler
+// latency rises more than LatencyTolerance times above the best seen, e.g.
+// because a downstream database is overloaded, or when slots sit idle.
+type AutoscaleOptions struct {
+	// MinConcurrent is the lowest concurrency, and the one the processor
+	// starts at. Defaults to 1.
+	MinConcurrent int
+
+	// Interval is how often concurrency is adjusted. Defaults to 5s.
+	Interval time.Duration
+
+	// LatencyTolerance is the factor by which average handler latency may
+	// exceed the best average seen before concurrency is reduced.
+	// Defaults to 1.5.
+	LatencyTolerance float64
+}
+
+func (o *AutoscaleOptions) validate(maxConcurrent int) error {
+	if o.MinConcurrent < 0 {
+		return fmt.Errorf("MinConcurrent must be >= 0, got %d", o.MinConcurrent)
+	}
+	if o.MinConcurrent == 0 {
+		o.MinConcurrent = 1
+	}
+	if o.MinConcurrent > maxConcurrent {
+		return fmt.Errorf("MinConcurrent must be <= MaxConcurrent (%d), got %d", maxConcurrent, o.MinConcurrent)
+	}
+	if o.Interval < 0 {
+		return fmt.Errorf("Interval must be >= 0, got %v", o.Interval)
+	}
+	if o.Interval == 0 {
+		o.Interval = 5 * time.Second
+	}
+	if o.LatencyTolerance == 0 {
+		o.LatencyTolerance = 1.5
+	}
+	if o.LatencyTolerance < 1 {
+		return fmt.Errorf("LatencyTolerance must be >= 1, got %v", o.LatencyTolerance)
+	}
+	return nil
+}
+
+// autoscaler adjusts the concurrency of a processing loop by resizing the
+// loop's semaphore.
+type autoscaler struct {
+	opts   AutoscaleOptions
+	max    int
+	logger Logger
+
+	mu      sync.Mutex
+	stats   autoscaleStats
+	latency latencyTracker
+	busy    int // batches running now
+	limit   int
+}
+
+// autoscaleStats are the observations of one interval.
+type autoscaleStats struct {
+	loadStats
+	peakBusy int
+}
+
+func newAutoscaler(opts AutoscaleOptions, maxConcurrent int, logger Logger) *autoscaler {
+	return &autoscaler{
+		opts:    opts,
+		max:     maxConcurrent,
+		logger:  logger,
+		latency: latencyTracker{tolerance: opts.LatencyTolerance},
+	}
+}
+
+// start limits sem to MinConcurrent and adjusts the limit until the
+// returned stop function is called.
+func (a *autoscaler) start(ctx context.Context, sem *resizableSemaphore) (stop func()) {
+	a.mu.Lock()
+	a.stats = autoscaleStats{}
+	a.latency = latencyTracker{tolerance: a.opts.LatencyTolerance}
+	a.limit = a.max
+	a.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	a.resize(ctx, sem, a.opts.MinConcurrent)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(a.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				a.mu.Lock()
+				stats := a.stats
+				a.stats = autoscaleStats{peakBusy: a.busy}
+				next := a.next(stats)
+				a.mu.Unlock()
+				a.resize(ctx, sem, next)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// resize resizes sem to limit.
+func (a *autoscaler) resize(ctx context.Context, sem *resizableSemaphore, limit int) {
+	from, err := sem.resize(ctx, limit)
+	if err != nil || from == limit {
+		return
+	}
+
+	a.mu.Lock()
+	a.limit = limit
+	a.mu.Unlock()
+	a.logger.Debug("Adjusted concurrency", "from", from, "to", limit)
+}
+
+// next returns the concurrency limit for the next interval given the
+// stats of the last one. The caller must hold a.mu.
+func (a *autoscaler) next(s autoscaleStats) int {
+	degraded := a.latency.degraded(s.loadStats)
+	backlogged := s.backlogged()
+	saturated := s.peakBusy >= a.limit
+
+	switch {
+	case degraded && a.limit > a.opts.MinConcurrent:
+		return a.limit - 1
+	case backlogged && saturated && !degraded && a.limit < a.max:
+		return a.limit + 1
+	case !backlogged && !saturated && a.limit > a.opts.MinConcurrent:
+		return a.limit - 1
+	}
+	return a.limit
+}
+
+// observeReceive records whether a receive returned a full batch.
+func (a *autoscaler) observeReceive(full bool) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stats.observeReceive(full)
+}
+
+// batchStarted records that a batch started, returning its start time for
+// batchDone.
+func (a *autoscaler) batchStarted() time.Time {
+	if a == nil {
+		return time.Time{}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.busy++
+	if a.busy > a.stats.peakBusy {
+		a.stats.peakBusy = a.busy
+	}
+	return time.Now()
+}
+
+// batchDone records that a batch started at start finished.
+func (a *autoscaler) batchDone(start time.Time) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.busy--
+	a.stats.observeBatch(start)
+}
@@ -0,0 +1,163 @@
+package sequin
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CircuitBreakerOptions configures the client's circuit breaker, which
+// stops sending requests to an API that keeps failing.
+type CircuitBreakerOptions struct {
+	// FailureThreshold is how many consecutive requests must fail, with a
+	// connection error or a 5xx response, before the circuit opens.
+	// Defaults to 5.
+	FailureThreshold int
+
+	// OpenTimeout is how long the circuit stays open, rejecting requests
+	// with a *CircuitOpenError, before a single trial request is let
+	// through. Its success closes the circuit again. Defaults to 30s.
+	OpenTimeout time.Duration
+
+	// OnStateChange is called whenever the circuit changes state, e.g. to
+	// alert operators. Optional.
+	OnStateChange func(from, to CircuitState)
+}
+
+func (o *CircuitBreakerOptions) validate() error {
+	if o.FailureThreshold < 0 {
+		return fmt.Errorf("FailureThreshold must be >= 0, got %d", o.FailureThreshold)
+	}
+	if o.FailureThreshold == 0 {
+		o.FailureThreshold = 5
+	}
+	if o.OpenTimeout < 0 {
+		return fmt.Errorf("OpenTimeout must be >= 0, got %v", o.OpenTimeout)
+	}
+	if o.OpenTimeout == 0 {
+		o.OpenTimeout = 30 * time.Second
+	}
+	return nil
+}
+
+// CircuitState is the state of the client's circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed means requests are sent normally.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen means requests are rejected without being sent.
+	CircuitOpen
+	// CircuitHalfOpen means a trial request is in flight, and others are
+	// rejected until it completes.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// halfOpenWait is how long requests rejected during a trial request are
+// told to wait.
+const halfOpenWait = time.Second
+
+// breaker implements the circuit breaker from request outcomes.
+type breaker struct {
+	opts CircuitBreakerOptions
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int       // consecutive failures while closed
+	openedAt time.Time // when the circuit last opened
+	probing  bool      // whether the trial request is in flight
+}
+
+// current returns the current state.
+func (b *breaker) current() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// allow reports whether a request may be sent now, moving an open circuit
+// to half-open once OpenTimeout has passed.
+func (b *breaker) allow(now time.Time) error {
+	b.mu.Lock()
+	from := b.state
+	defer b.notify(from)
+
+	switch b.state {
+	case CircuitOpen:
+		if wait := b.openedAt.Add(b.opts.OpenTimeout).Sub(now); wait > 0 {
+			return &CircuitOpenError{RetryAfter: wait}
+		}
+		b.state = CircuitHalfOpen
+		b.probing = true
+	case CircuitHalfOpen:
+		if b.probing {
+			wait := halfOpenWait
+			if b.opts.OpenTimeout < wait {
+				wait = b.opts.OpenTimeout
+			}
+			return &CircuitOpenError{RetryAfter: wait}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// record updates the state after a request allowed by allow. Requests
+// abandoned by their caller say nothing about the API; if one was the
+// trial request, the next request becomes the trial instead.
+func (b *breaker) record(req *http.Request, resp *http.Response, err error, now time.Time) {
+	b.mu.Lock()
+	from := b.state
+	defer b.notify(from)
+
+	if req.Context().Err() != nil {
+		b.probing = false
+		return
+	}
+
+	if err == nil && resp.StatusCode < 500 {
+		b.failures = 0
+		b.probing = false
+		b.state = CircuitClosed
+		return
+	}
+
+	switch b.state {
+	case CircuitClosed:
+		b.failures++
+		if b.failures < b.opts.FailureThreshold {
+			return
+		}
+	case CircuitOpen:
+		// A request sent before the circuit opened
+		return
+	}
+	b.failures = 0
+	b.probing = false
+	b.openedAt = now
+	b.state = CircuitOpen
+}
+
+// notify unlocks b.mu and calls OnStateChange if the state is no longer
+// from.
+func (b *breaker) notify(from CircuitState) {
+	to := b.state
+	b.mu.Unlock()
+	if from != to && b.opts.OnStateChange != nil {
+		b.opts.OnStateChange(from, to)
+	}
+}
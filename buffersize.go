@@ -0,0 +1,199 @@
+package sequin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BufferAutoSizeOptions configures PrefetchingOptions.AutoSize, which
+// adjusts the size of the prefetch buffer between MinBufferSize and
+// BufferSize.
+//
+// Every Interval, the buffer doubles when handlers had to wait for
+// messages while there was a backlog (most receives returned full
+// batches), as long as handler latency holds up, and halves when average
+// handler latency rises more than LatencyTolerance times above the best
+// seen, so less work is queued up behind a struggling handler.
+type BufferAutoSizeOptions struct {
+	// MinBufferSize is the smallest buffer size per consumer group, and the
+	// one the processor starts at. Defaults to a tenth of BufferSize, and at
+	// least 1.
+	MinBufferSize int
+
+	// Interval is how often the buffer is resized. Defaults to 5s.
+	Interval time.Duration
+
+	// LatencyTolerance is the factor by which average handler latency may
+	// exceed the best average seen before the buffer shrinks.
+	// Defaults to 1.5.
+	LatencyTolerance float64
+}
+
+func (o *BufferAutoSizeOptions) validate(bufferSize int) error {
+	if o.MinBufferSize < 0 {
+		return fmt.Errorf("MinBufferSize must be >= 0, got %d", o.MinBufferSize)
+	}
+	if o.MinBufferSize == 0 {
+		o.MinBufferSize = bufferSize / 10
+		if o.MinBufferSize == 0 {
+			o.MinBufferSize = 1
+		}
+	}
+	if o.MinBufferSize > bufferSize {
+		return fmt.Errorf("MinBufferSize must be <= BufferSize (%d), got %d", bufferSize, o.MinBufferSize)
+	}
+	if o.Interval < 0 {
+		return fmt.Errorf("Interval must be >= 0, got %v", o.Interval)
+	}
+	if o.Interval == 0 {
+		o.Interval = 5 * time.Second
+	}
+	if o.LatencyTolerance == 0 {
+		o.LatencyTolerance = 1.5
+	}
+	if o.LatencyTolerance < 1 {
+		return fmt.Errorf("LatencyTolerance must be >= 1, got %v", o.LatencyTolerance)
+	}
+	return nil
+}
+
+// bufferSizer bounds the prefetch buffers with a resizable semaphore of
+// slots, one per buffered message.
+type bufferSizer struct {
+	opts  BufferAutoSizeOptions
+	min   int // total slots at MinBufferSize
+	max   int // total slots at BufferSize
+	slots *resizableSemaphore
+
+	logger Logger
+
+	mu      sync.Mutex
+	stats   bufferSizeStats
+	latency latencyTracker
+	size    int // total slots available
+}
+
+// bufferSizeStats are the observations of one interval.
+type bufferSizeStats struct {
+	loadStats
+	starved int // times the processor found the buffers empty
+}
+
+func newBufferSizer(opts BufferAutoSizeOptions, bufferSize, lanes int, logger Logger) *bufferSizer {
+	min := opts.MinBufferSize * lanes
+	max := bufferSize * lanes
+	return &bufferSizer{
+		opts:    opts,
+		min:     min,
+		max:     max,
+		slots:   newResizableSemaphore(max, min),
+		logger:  logger,
+		latency: latencyTracker{tolerance: opts.LatencyTolerance},
+		size:    min,
+	}
+}
+
+// acquire waits for a slot for a message entering the buffers.
+func (s *bufferSizer) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	return s.slots.Acquire(ctx, 1)
+}
+
+// tryAcquire takes a slot if one is free.
+func (s *bufferSizer) tryAcquire() bool {
+	return s == nil || s.slots.TryAcquire(1)
+}
+
+// release frees the slot of a message leaving the buffers.
+func (s *bufferSizer) release() {
+	if s != nil {
+		s.slots.Release(1)
+	}
+}
+
+// run resizes the buffers every Interval until ctx is done.
+func (s *bufferSizer) run(ctx context.Context) {
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			stats := s.stats
+			s.stats = bufferSizeStats{}
+			next := s.next(stats)
+			s.mu.Unlock()
+			s.resize(ctx, next)
+		}
+	}
+}
+
+// resize resizes the buffers to size slots.
+func (s *bufferSizer) resize(ctx context.Context, size int) {
+	from, err := s.slots.resize(ctx, size)
+	if err != nil || from == size {
+		return
+	}
+
+	s.mu.Lock()
+	s.size = size
+	s.mu.Unlock()
+	s.logger.Debug("Resized prefetch buffer", "from", from, "to", size)
+}
+
+// next returns the total buffer size for the next interval given the stats
+// of the last one. The caller must hold s.mu.
+func (s *bufferSizer) next(st bufferSizeStats) int {
+	degraded := s.latency.degraded(st.loadStats)
+	backlogged := st.backlogged()
+
+	switch {
+	case degraded:
+		if half := s.size / 2; half > s.min {
+			return half
+		}
+		return s.min
+	case backlogged && st.starved > 0:
+		if double := s.size * 2; double < s.max {
+			return double
+		}
+		return s.max
+	}
+	return s.size
+}
+
+// observeReceive records whether a receive returned a full batch.
+func (s *bufferSizer) observeReceive(full bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.observeReceive(full)
+}
+
+// observeStarved records that the processor found the buffers empty.
+func (s *bufferSizer) observeStarved() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.starved++
+}
+
+// batchDone records that a batch started at start finished.
+func (s *bufferSizer) batchDone(start time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.observeBatch(start)
+}
@@ -0,0 +1,67 @@
+package sequin
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// CatchUpResult summarizes a RunUntilEmpty run.
+type CatchUpResult struct {
+	Started   time.Time
+	Finished  time.Time
+	Processed int  // Messages that finished processing, successfully or not
+	Drained   bool // Whether the backlog was fully drained
+}
+
+// Duration is how long the run took.
+func (r CatchUpResult) Duration() time.Duration {
+	return r.Finished.Sub(r.Started)
+}
+
+// FallingBehind reports whether a consumer that runs every interval can't
+// keep up with its backlog: either the run ended before draining it, or it
+// took longer than the interval, so backlog is growing faster than the
+// schedule can absorb.
+func (r CatchUpResult) FallingBehind(interval time.Duration) bool {
+	return !r.Drained || r.Duration() > interval
+}
+
+// RunUntilEmpty processes messages until the backlog of the processor's
+// consumer groups is drained and every fetched message has been processed,
+// then returns. It is meant for batch-oriented consumers that run on a
+// schedule, such as cron jobs.
+//
+// If the backlog is drained, ProcessorOptions.Checkpoint is called with the
+// result. If ctx ends first, the result has Drained set to false and the
+// context's error is returned. If ProcessorOptions.CatchUpInterval is set, a
+// warning is logged when the run is falling behind it.
+func (p *Processor) RunUntilEmpty(ctx context.Context) (CatchUpResult, error) {
+	result := CatchUpResult{Started: time.Now()}
+
+	err := p.run(ctx, true)
+	result.Finished = time.Now()
+	result.Processed, result.Drained = p.backlog.summary()
+	if p.opts.CatchUpInterval > 0 && result.FallingBehind(p.opts.CatchUpInterval) {
+		p.opts.Logger.Warn("Catch-up run is falling behind its schedule",
+			"consumer_group", p.consumerGroup,
+			"interval", p.opts.CatchUpInterval,
+			"duration", result.Duration(),
+			"processed", result.Processed,
+			"drained", result.Drained)
+	}
+	if err != nil {
+		return result, err
+	}
+	if !result.Drained {
+		return result, ctx.Err()
+	}
+
+	if p.opts.Checkpoint != nil {
+		if err := p.opts.Checkpoint(ctx, result); err != nil {
+			return result, fmt.Errorf("checkpoint: %w", err)
+		}
+	}
+
+	return result, nil
+}
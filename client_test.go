@@ -0,0 +1,1061 @@
+package sequin
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer starts an httptest server and a Client pointed at it.
+func newTestServer(t *testing.T, handler http.HandlerFunc, opts *ClientOptions) *Client {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	if opts == nil {
+		opts = &ClientOptions{}
+	}
+	if opts.Token == "" {
+		opts.Token = "test-token"
+	}
+	opts.BaseURL = server.URL
+	return NewClient(opts)
+}
+
+// recordingLogger records Debug events and Warn messages for assertions.
+type recordingLogger struct {
+	nopLogger
+	mu       sync.Mutex
+	events   []map[string]any
+	warnings []string
+}
+
+func (l *recordingLogger) Warn(msg string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warnings = append(l.warnings, msg)
+}
+
+func (l *recordingLogger) Debug(msg string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	event := map[string]any{"msg": msg}
+	for i := 0; i+1 < len(args); i += 2 {
+		event[args[i].(string)] = args[i+1]
+	}
+	l.events = append(l.events, event)
+}
+
+// writeTestCert writes a self-signed certificate and key for commonName to
+// dir, returning their paths.
+func writeTestCert(t *testing.T, dir, commonName string) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile = filepath.Join(dir, "client.pem")
+	keyFile = filepath.Join(dir, "client-key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func TestClient(t *testing.T) {
+	t.Run("connectivity", func(t *testing.T) {
+		var mu sync.Mutex
+		status := http.StatusServiceUnavailable
+		var transitions []string
+
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			w.WriteHeader(status)
+		}, &ClientOptions{
+			DownAfter: 20 * time.Millisecond,
+			OnConnectivityChange: func(from, to ConnectivityState) {
+				transitions = append(transitions, from.String()+"->"+to.String())
+			},
+		})
+
+		ctx := context.Background()
+		assert.Equal(t, Connected, client.ConnectivityState())
+
+		require.Error(t, client.Ack(ctx, "group", []string{"a"}))
+		assert.Equal(t, Degraded, client.ConnectivityState())
+
+		time.Sleep(30 * time.Millisecond)
+		require.Error(t, client.Ack(ctx, "group", []string{"a"}))
+		assert.Equal(t, Down, client.ConnectivityState())
+
+		mu.Lock()
+		status = http.StatusOK
+		mu.Unlock()
+		require.NoError(t, client.Ack(ctx, "group", []string{"a"}))
+		assert.Equal(t, Connected, client.ConnectivityState())
+
+		assert.Equal(t, []string{"connected->degraded", "degraded->down", "down->connected"}, transitions)
+	})
+	t.Run("signs requests", func(t *testing.T) {
+		secret := []byte("shh")
+		signer := &HMACSigner{
+			KeyID:  "key-1",
+			Secret: secret,
+			now:    func() time.Time { return time.Unix(1700000000, 0) },
+		}
+
+		var signature, timestamp, keyID string
+		var body []byte
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			signature = r.Header.Get("X-Sequin-Signature")
+			timestamp = r.Header.Get("X-Sequin-Timestamp")
+			keyID = r.Header.Get("X-Sequin-Key-Id")
+			body, _ = io.ReadAll(r.Body)
+		}, &ClientOptions{Signer: signer})
+
+		require.NoError(t, client.Ack(context.Background(), "orders", []string{"a"}))
+
+		bodyHash := sha256.Sum256(body)
+		mac := hmac.New(sha256.New, secret)
+		fmt.Fprintf(mac, "POST\n/api/http_pull_consumers/orders/ack\n1700000000\n%s", hex.EncodeToString(bodyHash[:]))
+
+		assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), signature)
+		assert.Equal(t, "1700000000", timestamp)
+		assert.Equal(t, "key-1", keyID)
+	})
+	t.Run("parses messages", func(t *testing.T) {
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"data":[{"ack_id":"a1","data":{
+				"record":{"id":1},
+				"changes":{"name":"old"},
+				"action":"update",
+				"metadata":{
+					"table_schema":"public",
+					"table_name":"users",
+					"commit_lsn":42,
+					"commit_idx":3,
+					"commit_timestamp":"2024-05-01T12:00:00.123456Z",
+					"database_name":"main",
+					"consumer":{"id":"c-1","name":"orders"},
+					"idempotency_key":"NDItMw==",
+					"transaction_annotations":{"correlation_id":"req-7","origin":"billing"}
+				}
+			}},{"ack_id":"a2","data":{"record":{"id":2},"changes":null,"action":"insert"}}]}`))
+		}, nil)
+
+		msgs, err := client.Receive(context.Background(), "orders", nil)
+		require.NoError(t, err)
+		require.Len(t, msgs, 2)
+		assert.Equal(t, "a1", msgs[0].AckID)
+		assert.JSONEq(t, `{"id":1}`, string(msgs[0].Record))
+		assert.JSONEq(t, `{"name":"old"}`, string(msgs[0].Changes))
+		assert.Equal(t, ActionUpdate, msgs[0].Action)
+		assert.Equal(t, Metadata{
+			TableSchema:     "public",
+			TableName:       "users",
+			CommitLSN:       42,
+			CommitIdx:       3,
+			CommitTimestamp: time.Date(2024, 5, 1, 12, 0, 0, 123456000, time.UTC),
+			DatabaseName:    "main",
+			Consumer:        ConsumerInfo{ID: "c-1", Name: "orders"},
+			IdempotencyKey:  "NDItMw==",
+			TransactionAnnotations: map[string]any{
+				"correlation_id": "req-7",
+				"origin":         "billing",
+			},
+		}, msgs[0].Metadata)
+		assert.Nil(t, msgs[1].Changes)
+	})
+	t.Run("receives one message", func(t *testing.T) {
+		var body, response string
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			body = string(b)
+			fmt.Fprint(w, response)
+		}, nil)
+
+		response = `{"data":[{"ack_id":"a","data":{"record":{"id":1},"action":"insert"}}]}`
+		msg, err := client.ReceiveOne(context.Background(), "orders")
+		require.NoError(t, err)
+		require.NotNil(t, msg)
+		assert.Equal(t, "a", msg.AckID)
+		assert.JSONEq(t, `{"max_batch_size":1}`, body)
+
+		response = `{"data":[]}`
+		msg, err = client.ReceiveOne(context.Background(), "orders")
+		require.NoError(t, err)
+		assert.Nil(t, msg)
+	})
+	t.Run("streams messages", func(t *testing.T) {
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"meta":{"count":3},"data":[`+
+				`{"ack_id":"a","data":{"record":{"id":1},"action":"insert"}},`+
+				`{"ack_id":"b","data":{"record":{"id":2},"action":"update"}},`+
+				`{"ack_id":"c","data":{"record":{"id":3},"action":"delete"}}]}`)
+		}, nil)
+
+		var ackIDs []string
+		stop := errors.New("stop")
+		err := client.ReceiveEach(context.Background(), "orders", nil, func(msg Message) error {
+			ackIDs = append(ackIDs, msg.AckID)
+			if msg.Action == ActionUpdate {
+				return stop
+			}
+			return nil
+		})
+		assert.ErrorIs(t, err, stop)
+		assert.Equal(t, []string{"a", "b"}, ackIDs)
+
+		msgs, err := client.Receive(context.Background(), "orders", &ReceiveParams{MaxBatchSize: 10})
+		require.NoError(t, err)
+		require.Len(t, msgs, 3)
+		assert.JSONEq(t, `{"id":3}`, string(msgs[2].Record))
+
+		for _, body := range []string{`{"data":null}`, `{}`} {
+			client = newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, body)
+			}, nil)
+			msgs, err = client.Receive(context.Background(), "orders", nil)
+			require.NoError(t, err)
+			assert.Empty(t, msgs)
+		}
+
+		client = newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"data":[{"ack_id":"a"},`)
+		}, nil)
+		_, err = client.Receive(context.Background(), "orders", nil)
+		assert.ErrorContains(t, err, "decoding response")
+	})
+	t.Run("maps status codes to errors", func(t *testing.T) {
+		tests := []struct {
+			status int
+			body   string
+			want   error
+		}{
+			{http.StatusUnauthorized, "", ErrUnauthorized},
+			{http.StatusForbidden, "", ErrUnauthorized},
+			{http.StatusNotFound, `{"code":"not_found","summary":"No consumer found"}`, ErrConsumerNotFound},
+			{http.StatusTooManyRequests, "", ErrRateLimited},
+		}
+		for _, tt := range tests {
+			client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}, nil)
+
+			_, err := client.Receive(context.Background(), "orders", nil)
+			assert.ErrorIs(t, err, tt.want, "receive with status %d", tt.status)
+			assert.ErrorIs(t, client.Ack(context.Background(), "orders", []string{"a"}), tt.want, "ack with status %d", tt.status)
+			assert.ErrorIs(t, client.Nack(context.Background(), "orders", []string{"a"}), tt.want, "nack with status %d", tt.status)
+		}
+	})
+	t.Run("does not map other 404s to ErrConsumerGroupNotFound", func(t *testing.T) {
+		// A wrong PathPrefix or a proxy in front of Sequin
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			http.NotFound(w, r)
+		}, nil)
+
+		_, err := client.Receive(context.Background(), "orders", nil)
+		assert.NotErrorIs(t, err, ErrConsumerGroupNotFound)
+		var apiErr *APIError
+		require.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+		assert.Equal(t, "404 page not found", apiErr.Summary)
+	})
+	t.Run("returns API errors", func(t *testing.T) {
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"code":"validation_error","summary":"Validation failed","validation_errors":{"ack_ids":["can't be blank"]}}`))
+		}, nil)
+
+		err := client.Ack(context.Background(), "orders", nil)
+		var apiErr *APIError
+		require.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, &APIError{
+			StatusCode:       http.StatusUnprocessableEntity,
+			Code:             "validation_error",
+			Summary:          "Validation failed",
+			ValidationErrors: map[string][]string{"ack_ids": {"can't be blank"}},
+		}, apiErr)
+		assert.Contains(t, err.Error(), "status code 422 (validation_error): Validation failed; ack_ids: can't be blank")
+
+		client = newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":"not_found","summary":"No consumer found"}`))
+		}, nil)
+		_, err = client.Receive(context.Background(), "orders", nil)
+		require.ErrorIs(t, err, ErrConsumerGroupNotFound)
+		require.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, "not_found", apiErr.Code)
+
+		client = newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+		}, nil)
+		err = client.Nack(context.Background(), "orders", []string{"a"})
+		require.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, "bad gateway", apiErr.Summary)
+	})
+	t.Run("retries transient failures", func(t *testing.T) {
+		var mu sync.Mutex
+		var requests int
+		var bodies []string
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			requests++
+			body, _ := io.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+
+			switch requests {
+			case 1:
+				// Drop the connection without a response
+				conn, _, err := w.(http.Hijacker).Hijack()
+				require.NoError(t, err)
+				conn.Close()
+			case 2:
+				w.WriteHeader(http.StatusServiceUnavailable)
+			case 3:
+				w.WriteHeader(http.StatusOK)
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}, &ClientOptions{Retry: &RetryOptions{MaxAttempts: 3, BaseDelay: time.Millisecond}})
+
+		require.NoError(t, client.Ack(context.Background(), "orders", []string{"a"}))
+		assert.Equal(t, 3, requests)
+		assert.Equal(t, []string{`{"ack_ids":["a"]}`, `{"ack_ids":["a"]}`, `{"ack_ids":["a"]}`}, bodies)
+
+		// Client errors are not retried
+		require.Error(t, client.Ack(context.Background(), "orders", []string{"a"}))
+		assert.Equal(t, 4, requests)
+	})
+	t.Run("does not retry configuration errors", func(t *testing.T) {
+		var requests atomic.Int32
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+		}))
+		t.Cleanup(server.Close)
+		server.Config.ErrorLog = log.New(io.Discard, "", 0)
+
+		var attempts int
+		client := NewClient(&ClientOptions{
+			Token:   "test-token",
+			BaseURL: server.URL,
+			Retry:   &RetryOptions{MaxAttempts: 3, BaseDelay: time.Millisecond},
+			Interceptors: []Interceptor{func(next RoundTripFunc) RoundTripFunc {
+				return func(req *http.Request) (*http.Response, error) {
+					attempts++
+					return next(req)
+				}
+			}},
+		})
+
+		// The test server's certificate isn't trusted
+		err := client.Ack(context.Background(), "orders", []string{"a"})
+		require.Error(t, err)
+		assert.Equal(t, 1, attempts)
+		assert.Zero(t, requests.Load())
+
+		assert.True(t, transient(syscall.ECONNREFUSED))
+		assert.True(t, transient(&net.OpError{Op: "read", Err: syscall.ECONNRESET}))
+		assert.False(t, transient(errors.New("proxyconnect tcp: unknown proxy")))
+	})
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		var requests int
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.WriteHeader(http.StatusInternalServerError)
+		}, &ClientOptions{Retry: &RetryOptions{MaxAttempts: 2, BaseDelay: time.Millisecond}})
+
+		err := client.Nack(context.Background(), "orders", []string{"a"})
+		var apiErr *APIError
+		require.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, http.StatusInternalServerError, apiErr.StatusCode)
+		assert.Equal(t, 2, requests)
+	})
+	t.Run("per-operation timeouts", func(t *testing.T) {
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/receive") {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(time.Second):
+				}
+				return
+			}
+			select {
+			case <-r.Context().Done():
+			case <-time.After(100 * time.Millisecond):
+			}
+		}, &ClientOptions{ReceiveTimeout: 500 * time.Millisecond, AckTimeout: 20 * time.Millisecond})
+
+		err := client.Ack(context.Background(), "orders", []string{"a"})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		err = client.Nack(context.Background(), "orders", []string{"a"})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		start := time.Now()
+		_, err = client.Receive(context.Background(), "orders", nil)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+
+		assert.Panics(t, func() { NewClient(&ClientOptions{Token: "t", AckTimeout: -time.Second}) })
+	})
+	t.Run("circuit breaker", func(t *testing.T) {
+		var mu sync.Mutex
+		var requests int
+		healthy := false
+		var changes []string
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			requests++
+			if !healthy {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}, &ClientOptions{CircuitBreaker: &CircuitBreakerOptions{
+			FailureThreshold: 2,
+			OpenTimeout:      50 * time.Millisecond,
+			OnStateChange: func(from, to CircuitState) {
+				changes = append(changes, from.String()+"->"+to.String())
+			},
+		}})
+
+		require.Error(t, client.Ack(context.Background(), "orders", []string{"a"}))
+		require.Error(t, client.Ack(context.Background(), "orders", []string{"a"}))
+		assert.Equal(t, CircuitOpen, client.CircuitState())
+
+		err := client.Ack(context.Background(), "orders", []string{"a"})
+		var openErr *CircuitOpenError
+		require.ErrorAs(t, err, &openErr)
+		assert.ErrorIs(t, err, ErrCircuitOpen)
+		assert.Greater(t, openErr.RetryAfter, time.Duration(0))
+		assert.Equal(t, 2, requests)
+
+		// The trial request fails, reopening the circuit
+		time.Sleep(60 * time.Millisecond)
+		require.Error(t, client.Ack(context.Background(), "orders", []string{"a"}))
+		assert.Equal(t, CircuitOpen, client.CircuitState())
+		assert.Equal(t, 3, requests)
+
+		// The next trial request succeeds, closing it
+		mu.Lock()
+		healthy = true
+		mu.Unlock()
+		time.Sleep(60 * time.Millisecond)
+		require.NoError(t, client.Ack(context.Background(), "orders", []string{"a"}))
+		require.NoError(t, client.Ack(context.Background(), "orders", []string{"a"}))
+		assert.Equal(t, CircuitClosed, client.CircuitState())
+		assert.Equal(t, []string{
+			"closed->open", "open->half-open", "half-open->open", "open->half-open", "half-open->closed",
+		}, changes)
+
+		assert.Panics(t, func() {
+			NewClient(&ClientOptions{Token: "t", CircuitBreaker: &CircuitBreakerOptions{FailureThreshold: -1}})
+		})
+	})
+	t.Run("fails over to fallback base URLs", func(t *testing.T) {
+		var mu sync.Mutex
+		var hits []string
+		primaryDown := true
+		primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			hits = append(hits, "primary "+r.URL.Path)
+			if primaryDown {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		t.Cleanup(primary.Close)
+		secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			hits = append(hits, "secondary "+r.URL.Path)
+		}))
+		t.Cleanup(secondary.Close)
+		unreachable := httptest.NewServer(http.NotFoundHandler())
+		unreachable.Close()
+
+		client := NewClient(&ClientOptions{
+			Token:            "test-token",
+			BaseURL:          primary.URL,
+			FallbackBaseURLs: []string{unreachable.URL, secondary.URL},
+			FailoverCooldown: 50 * time.Millisecond,
+		})
+
+		ctx := context.Background()
+		require.NoError(t, client.Ack(ctx, "orders", []string{"a"}))
+		require.NoError(t, client.Nack(ctx, "orders", []string{"a"}))
+		assert.Equal(t, []string{
+			"primary /api/http_pull_consumers/orders/ack",
+			"secondary /api/http_pull_consumers/orders/ack",
+			"secondary /api/http_pull_consumers/orders/nack",
+		}, hits)
+
+		// Back on the primary once it recovers
+		mu.Lock()
+		primaryDown, hits = false, nil
+		mu.Unlock()
+		time.Sleep(60 * time.Millisecond)
+		require.NoError(t, client.Ack(ctx, "orders", []string{"a"}))
+		assert.Equal(t, []string{"primary /api/http_pull_consumers/orders/ack"}, hits)
+	})
+	t.Run("ping", func(t *testing.T) {
+		var path string
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			path = r.URL.Path
+		}, nil)
+		require.NoError(t, client.Ping(context.Background()))
+		assert.Equal(t, "/health", path)
+
+		client = newTestServer(t, http.NotFound, nil)
+		assert.ErrorContains(t, client.Ping(context.Background()), "check BaseURL")
+
+		client = newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}, nil)
+		var apiErr *APIError
+		require.ErrorAs(t, client.Ping(context.Background()), &apiErr)
+		assert.Equal(t, http.StatusServiceUnavailable, apiErr.StatusCode)
+	})
+	t.Run("rate limiting", func(t *testing.T) {
+		var waits []time.Duration
+		onRateLimited := func(_ *http.Request, retryAfter time.Duration) {
+			waits = append(waits, retryAfter)
+		}
+
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "2")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}, &ClientOptions{OnRateLimited: onRateLimited})
+
+		_, err := client.Receive(context.Background(), "orders", nil)
+		require.ErrorIs(t, err, ErrRateLimited)
+		var apiErr *APIError
+		require.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, 2*time.Second, apiErr.RetryAfter)
+		assert.Equal(t, []time.Duration{2 * time.Second}, waits)
+
+		// With retries, rate-limited requests are retried
+		var requests int
+		waits = nil
+		client = newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests == 1 {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}, &ClientOptions{
+			OnRateLimited: onRateLimited,
+			Retry:         &RetryOptions{BaseDelay: time.Millisecond},
+		})
+		require.NoError(t, client.Ack(context.Background(), "orders", []string{"a"}))
+		assert.Equal(t, 2, requests)
+		assert.Equal(t, []time.Duration{0}, waits)
+
+		now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		resp := &http.Response{Header: http.Header{"Retry-After": {now.Add(90 * time.Second).Format(http.TimeFormat)}}}
+		assert.Equal(t, 90*time.Second, retryAfter(resp, now))
+	})
+	t.Run("backs off exponentially", func(t *testing.T) {
+		opts := &RetryOptions{BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+		require.NoError(t, opts.validate())
+		assert.Equal(t, 100*time.Millisecond, opts.delay(1))
+		assert.Equal(t, 200*time.Millisecond, opts.delay(2))
+		assert.Equal(t, 300*time.Millisecond, opts.delay(3))
+		assert.Equal(t, 300*time.Millisecond, opts.delay(10))
+
+		opts.Jitter = 0.5
+		for i := 0; i < 10; i++ {
+			d := opts.delay(1)
+			assert.True(t, d > 50*time.Millisecond && d <= 100*time.Millisecond, "delay %v out of range", d)
+		}
+	})
+	t.Run("interceptors", func(t *testing.T) {
+		var order []string
+		named := func(name string) Interceptor {
+			return func(next RoundTripFunc) RoundTripFunc {
+				return func(req *http.Request) (*http.Response, error) {
+					order = append(order, name+" before")
+					req.Header.Add("X-Interceptors", name)
+					resp, err := next(req)
+					order = append(order, name+" after")
+					return resp, err
+				}
+			}
+		}
+
+		var headers []string
+		var auth string
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			headers = r.Header.Values("X-Interceptors")
+			auth = r.Header.Get("Authorization")
+		}, &ClientOptions{Interceptors: []Interceptor{named("outer"), named("inner")}})
+
+		require.NoError(t, client.Ack(context.Background(), "orders", []string{"a"}))
+		assert.Equal(t, []string{"outer before", "inner before", "inner after", "outer after"}, order)
+		assert.Equal(t, []string{"outer", "inner"}, headers)
+		assert.Equal(t, "Bearer test-token", auth)
+	})
+	t.Run("response hook", func(t *testing.T) {
+		var requests int
+		var infos []ResponseInfo
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Header().Set("X-Request-Id", fmt.Sprintf("req-%d", requests))
+			if requests == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		}, &ClientOptions{
+			Retry:      &RetryOptions{BaseDelay: time.Millisecond},
+			OnResponse: func(info ResponseInfo) { infos = append(infos, info) },
+		})
+		require.NoError(t, client.Ack(context.Background(), "orders", []string{"a"}))
+
+		require.Len(t, infos, 2)
+		for i, info := range infos {
+			assert.Equal(t, i+1, info.Attempt)
+			assert.NoError(t, info.Err)
+			assert.Equal(t, fmt.Sprintf("req-%d", i+1), info.Response.Header.Get("X-Request-Id"))
+			assert.Equal(t, "/api/http_pull_consumers/orders/ack", info.Request.URL.Path)
+			assert.Greater(t, info.Latency, time.Duration(0))
+		}
+		assert.Equal(t, http.StatusBadGateway, infos[0].Response.StatusCode)
+		assert.Equal(t, http.StatusOK, infos[1].Response.StatusCode)
+	})
+	t.Run("debug tracing", func(t *testing.T) {
+		logger := &recordingLogger{}
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"data":[{"ack_id":"a1","data":{"record":{"id":1}}}]}`))
+		}, &ClientOptions{Token: "secret-token", Logger: logger, Debug: true})
+
+		msgs, err := client.Receive(context.Background(), "orders", &ReceiveParams{MaxBatchSize: 5})
+		require.NoError(t, err)
+		require.Len(t, msgs, 1, "the traced response body is still decoded")
+
+		require.Len(t, logger.events, 1)
+		event := logger.events[0]
+		assert.Equal(t, "HTTP request", event["msg"])
+		assert.Equal(t, "POST", event["method"])
+		assert.Equal(t, http.StatusOK, event["status_code"])
+		assert.Equal(t, `{"max_batch_size":5}`, event["request_body"])
+		assert.Equal(t, `{"data":[{"ack_id":"a1","data":{"record":{"id":1}}}]}`, event["response_body"])
+		assert.Contains(t, event["headers"], "Authorization: REDACTED")
+		assert.NotContains(t, event["headers"], "secret-token")
+
+		headers := debugHeaders(http.Header{
+			"Cookie":              {"session=abc"},
+			"Proxy-Authorization": {"Basic cHJveHk6cGFzcw=="},
+			"X-Env":               {"prod"},
+		})
+		assert.Equal(t, "Cookie: REDACTED; Proxy-Authorization: REDACTED; X-Env: prod", headers)
+
+		long := strings.Repeat("x", 2*maxDebugBodyBytes)
+		assert.Equal(t, long[:maxDebugBodyBytes]+"...(truncated)", truncateDebugBody([]byte(long)))
+	})
+	t.Run("user agent", func(t *testing.T) {
+		var userAgent string
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			userAgent = r.UserAgent()
+		}
+
+		tests := []struct {
+			opts *ClientOptions
+			want string
+		}{
+			{&ClientOptions{}, "sequin-go/" + Version},
+			{&ClientOptions{AppName: "billing-worker/1.4"}, "sequin-go/" + Version + " billing-worker/1.4"},
+			{&ClientOptions{AppName: "ignored", UserAgent: "custom/1.0"}, "custom/1.0"},
+		}
+		for _, tt := range tests {
+			client := newTestServer(t, handler, tt.opts)
+			require.NoError(t, client.Ack(context.Background(), "orders", []string{"a"}))
+			assert.Equal(t, tt.want, userAgent)
+		}
+	})
+	t.Run("custom CA", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		t.Cleanup(server.Close)
+
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+		require.NoError(t, os.WriteFile(caFile, certPEM, 0o600))
+
+		untrusted := NewClient(&ClientOptions{Token: "test-token", BaseURL: server.URL})
+		require.Error(t, untrusted.Ack(context.Background(), "orders", []string{"a"}))
+
+		trusted := NewClient(&ClientOptions{Token: "test-token", BaseURL: server.URL, CACertFile: caFile})
+		require.NoError(t, trusted.Ack(context.Background(), "orders", []string{"a"}))
+
+		pool := x509.NewCertPool()
+		pool.AddCert(server.Certificate())
+		configured := NewClient(&ClientOptions{Token: "test-token", BaseURL: server.URL, TLSConfig: &tls.Config{RootCAs: pool}})
+		require.NoError(t, configured.Ack(context.Background(), "orders", []string{"a"}))
+	})
+	t.Run("mutual TLS", func(t *testing.T) {
+		var commonName string
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			commonName = r.TLS.PeerCertificates[0].Subject.CommonName
+		}))
+		server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+		server.StartTLS()
+		t.Cleanup(server.Close)
+
+		pool := x509.NewCertPool()
+		pool.AddCert(server.Certificate())
+
+		dir := t.TempDir()
+		certFile, keyFile := writeTestCert(t, dir, "worker-1")
+		client := NewClient(&ClientOptions{
+			Token:          "test-token",
+			BaseURL:        server.URL,
+			TLSConfig:      &tls.Config{RootCAs: pool},
+			ClientCertFile: certFile,
+			ClientKeyFile:  keyFile,
+		})
+		require.NoError(t, client.Ack(context.Background(), "orders", []string{"a"}))
+		assert.Equal(t, "worker-1", commonName)
+
+		// Rotate the certificate; new connections present the new one
+		writeTestCert(t, dir, "worker-2")
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(certFile, later, later))
+		require.NoError(t, os.Chtimes(keyFile, later, later))
+		client.httpClient.CloseIdleConnections()
+		require.NoError(t, client.Ack(context.Background(), "orders", []string{"a"}))
+		assert.Equal(t, "worker-2", commonName)
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		require.NoError(t, err)
+		client = NewClient(&ClientOptions{
+			Token:             "test-token",
+			BaseURL:           server.URL,
+			TLSConfig:         &tls.Config{RootCAs: pool},
+			ClientCertificate: &cert,
+		})
+		require.NoError(t, client.Ack(context.Background(), "orders", []string{"a"}))
+		assert.Equal(t, "worker-2", commonName)
+	})
+	t.Run("proxy", func(t *testing.T) {
+		var proxied string
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proxied = r.URL.String()
+		}))
+		t.Cleanup(proxy.Close)
+
+		client := NewClient(&ClientOptions{
+			Token:    "test-token",
+			BaseURL:  "http://sequin.internal",
+			ProxyURL: proxy.URL,
+		})
+		require.NoError(t, client.Ack(context.Background(), "orders", []string{"a"}))
+		assert.Equal(t, "http://sequin.internal/api/http_pull_consumers/orders/ack", proxied)
+
+		tests := []struct {
+			noProxy, url string
+			bypass       bool
+		}{
+			{"", "http://sequin.internal", false},
+			{"*", "http://sequin.internal", true},
+			{"internal", "http://sequin.internal", true},
+			{".internal", "http://sequin.internal", true},
+			{"other.internal, sequin.internal", "http://sequin.internal", true},
+			{"quin.internal", "http://sequin.internal", false},
+			{"sequin.internal:8080", "http://sequin.internal", false},
+			{"sequin.internal:8080", "http://sequin.internal:8080", true},
+			{"10.0.0.0/8", "http://10.1.2.3", true},
+			{"10.0.0.0/8", "http://192.168.1.1", false},
+			{"::1", "http://[::1]:7376", true},
+		}
+		proxyURL, _ := url.Parse(proxy.URL)
+		for _, tt := range tests {
+			req, err := http.NewRequest("GET", tt.url, nil)
+			require.NoError(t, err)
+			got, err := proxyFunc(proxyURL, tt.noProxy)(req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.bypass, got == nil, "NoProxy %q for %s", tt.noProxy, tt.url)
+		}
+	})
+	t.Run("connection tuning", func(t *testing.T) {
+		transport, err := newTransport(&ClientOptions{MaxIdleConnsPerHost: 50, IdleConnTimeout: time.Minute})
+		require.NoError(t, err)
+		assert.Equal(t, 50, transport.(*http.Transport).MaxIdleConnsPerHost)
+		assert.Equal(t, 100, transport.(*http.Transport).MaxIdleConns)
+		assert.Equal(t, time.Minute, transport.(*http.Transport).IdleConnTimeout)
+
+		_, err = newTransport(&ClientOptions{MaxIdleConnsPerHost: -1})
+		assert.Error(t, err)
+
+		var mu sync.Mutex
+		var protos []int
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			protos = append(protos, r.ProtoMajor)
+		}))
+		server.EnableHTTP2 = true
+		server.StartTLS()
+		t.Cleanup(server.Close)
+		roots := x509.NewCertPool()
+		roots.AddCert(server.Certificate())
+
+		var infos []ConnectionInfo
+		for _, disableHTTP2 := range []bool{false, true} {
+			client := NewClient(&ClientOptions{
+				Token:        "test-token",
+				BaseURL:      server.URL,
+				TLSConfig:    &tls.Config{RootCAs: roots},
+				DisableHTTP2: disableHTTP2,
+				OnConnection: func(info ConnectionInfo) {
+					mu.Lock()
+					defer mu.Unlock()
+					infos = append(infos, info)
+				},
+			})
+			require.NoError(t, client.Ack(context.Background(), "orders", []string{"a"}))
+			require.NoError(t, client.Ack(context.Background(), "orders", []string{"b"}))
+			assert.Equal(t, ConnectionStats{Dials: 1, Reused: 1}, client.ConnectionStats())
+		}
+		assert.Equal(t, []int{2, 2, 1, 1}, protos)
+		require.Len(t, infos, 4)
+		assert.False(t, infos[0].Reused)
+		assert.True(t, infos[1].Reused)
+	})
+	t.Run("functional options", func(t *testing.T) {
+		var auth string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth = r.Header.Get("Authorization")
+		}))
+		t.Cleanup(server.Close)
+
+		httpClient := &http.Client{}
+		client := New(
+			WithOptions(ClientOptions{AppName: "worker"}),
+			WithToken("functional-token"),
+			WithBaseURL(server.URL),
+			WithHTTPClient(httpClient),
+			WithTimeout(time.Minute),
+		)
+		require.NoError(t, client.Ack(context.Background(), "orders", []string{"a"}))
+		assert.Equal(t, "Bearer functional-token", auth)
+		assert.Same(t, httpClient, client.httpClient)
+		assert.Equal(t, "sequin-go/"+Version+" worker", client.userAgent)
+
+		assert.Panics(t, func() { New() }, "a token is still required")
+	})
+	t.Run("derived clients", func(t *testing.T) {
+		var mu sync.Mutex
+		var requests []string
+		handler := func(name string) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				requests = append(requests, name+" "+r.Header.Get("Authorization")+" "+r.Header.Get("X-Env"))
+			}
+		}
+		staging := httptest.NewServer(handler("staging"))
+		t.Cleanup(staging.Close)
+
+		addEnv := func(next RoundTripFunc) RoundTripFunc {
+			return func(req *http.Request) (*http.Response, error) {
+				req.Header.Set("X-Env", "set")
+				return next(req)
+			}
+		}
+		client := newTestServer(t, handler("prod"), &ClientOptions{Interceptors: []Interceptor{addEnv}})
+
+		tenant := client.With(WithToken("tenant-token"))
+		require.NoError(t, tenant.Ack(context.Background(), "orders", []string{"a"}))
+		assert.Same(t, client.httpClient, tenant.httpClient)
+		assert.Same(t, client.connectivity, tenant.connectivity)
+
+		other := tenant.With(WithBaseURL(staging.URL), WithTimeout(time.Minute))
+		require.NoError(t, other.Ack(context.Background(), "orders", []string{"a"}))
+		assert.Equal(t, time.Minute, other.httpClient.Timeout)
+		assert.Equal(t, 150*time.Second, client.httpClient.Timeout)
+		assert.Equal(t, client.httpClient.Transport, other.httpClient.Transport)
+		assert.NotSame(t, client.connectivity, other.connectivity)
+
+		require.NoError(t, client.Ack(context.Background(), "orders", []string{"a"}))
+		assert.Equal(t, []string{
+			"prod Bearer tenant-token set",
+			"staging Bearer tenant-token set",
+			"prod Bearer test-token set",
+		}, requests)
+	})
+	t.Run("from environment", func(t *testing.T) {
+		var auth, path string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth = r.Header.Get("Authorization")
+			path = r.URL.Path
+		}))
+		t.Cleanup(server.Close)
+
+		t.Setenv("SEQUIN_TOKEN", "")
+		_, err := NewClientFromEnv()
+		assert.EqualError(t, err, "SEQUIN_TOKEN is required")
+
+		t.Setenv("SEQUIN_TOKEN", "env-token")
+		t.Setenv("SEQUIN_URL", server.URL)
+		t.Setenv("SEQUIN_PATH_PREFIX", "/")
+		t.Setenv("SEQUIN_TIMEOUT", "45s")
+		client, err := NewClientFromEnv()
+		require.NoError(t, err)
+		assert.Equal(t, 45*time.Second, client.httpClient.Timeout)
+		require.NoError(t, client.Ack(context.Background(), "orders", []string{"a"}))
+		assert.Equal(t, "Bearer env-token", auth)
+		assert.Equal(t, "/http_pull_consumers/orders/ack", path)
+
+		t.Setenv("SEQUIN_TIMEOUT", "soon")
+		_, err = NewClientFromEnv()
+		assert.ErrorContains(t, err, "SEQUIN_TIMEOUT")
+
+		t.Setenv("SEQUIN_TIMEOUT", "")
+		t.Setenv("SEQUIN_CA_CERT_FILE", filepath.Join(t.TempDir(), "missing.pem"))
+		_, err = NewClientFromEnv()
+		assert.ErrorContains(t, err, "reading CA certificates")
+	})
+	t.Run("oauth2 client credentials", func(t *testing.T) {
+		var tokenRequests int
+		tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenRequests++
+			user, pass, _ := r.BasicAuth()
+			assert.Equal(t, "client", user)
+			assert.Equal(t, "secret", pass)
+			require.NoError(t, r.ParseForm())
+			assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+			assert.Equal(t, "sequin:read sequin:write", r.PostForm.Get("scope"))
+
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"bearer","expires_in":3600}`, tokenRequests)
+		}))
+		defer tokenServer.Close()
+
+		var auth []string
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			auth = append(auth, r.Header.Get("Authorization"))
+		}, &ClientOptions{
+			Token: "unused",
+			TokenProvider: &OAuth2ClientCredentials{
+				TokenURL:     tokenServer.URL,
+				ClientID:     "client",
+				ClientSecret: "secret",
+				Scopes:       []string{"sequin:read", "sequin:write"},
+			},
+		})
+
+		ctx := context.Background()
+		require.NoError(t, client.Ack(ctx, "group", []string{"a"}))
+		require.NoError(t, client.Ack(ctx, "group", []string{"b"}))
+
+		assert.Equal(t, 1, tokenRequests, "token should be cached until it expires")
+		assert.Equal(t, []string{"Bearer token-1", "Bearer token-1"}, auth)
+	})
+	t.Run("refreshes rejected tokens", func(t *testing.T) {
+		var tokenRequests int
+		tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenRequests++
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":3600}`, tokenRequests)
+		}))
+		defer tokenServer.Close()
+
+		var auth, bodies []string
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			auth = append(auth, r.Header.Get("Authorization"))
+			body, _ := io.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+			if r.Header.Get("Authorization") == "Bearer token-1" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}, &ClientOptions{TokenProvider: &OAuth2ClientCredentials{TokenURL: tokenServer.URL}})
+
+		require.NoError(t, client.Ack(context.Background(), "group", []string{"a"}))
+		assert.Equal(t, []string{"Bearer token-1", "Bearer token-2"}, auth)
+		assert.Equal(t, []string{`{"ack_ids":["a"]}`, `{"ack_ids":["a"]}`}, bodies)
+
+		// Providers that don't cache tokens are not asked again
+		var calls int
+		client = newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}, &ClientOptions{TokenProvider: TokenFunc(func(context.Context) (string, error) {
+			calls++
+			return "vault-token", nil
+		})})
+		assert.ErrorIs(t, client.Ack(context.Background(), "group", []string{"a"}), ErrUnauthorized)
+		assert.Equal(t, 1, calls)
+	})
+	t.Run("per-request token", func(t *testing.T) {
+		var auth []string
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			auth = append(auth, r.Header.Get("Authorization"))
+		}, nil)
+
+		ctx := context.Background()
+		require.NoError(t, client.Ack(ContextWithToken(ctx, "tenant-a"), "group", []string{"a"}))
+		require.NoError(t, client.Nack(ContextWithToken(ctx, "tenant-b"), "group", []string{"a"}))
+		require.NoError(t, client.Ack(ctx, "group", []string{"a"}))
+		assert.Equal(t, []string{"Bearer tenant-a", "Bearer tenant-b", "Bearer test-token"}, auth)
+	})
+	t.Run("path prefix", func(t *testing.T) {
+		tests := []struct {
+			baseURL, prefix, want string
+		}{
+			{"https://api.sequinstream.com", "/api", "https://api.sequinstream.com/api"},
+			{"https://api.sequinstream.com/api", "/api", "https://api.sequinstream.com/api"},
+			{"https://api.sequinstream.com/api/", "api", "https://api.sequinstream.com/api"},
+			{"https://gateway.internal/sequin", "/", "https://gateway.internal/sequin"},
+			{"https://gateway.internal", "/sequin/v1/", "https://gateway.internal/sequin/v1"},
+		}
+		for _, tt := range tests {
+			assert.Equal(t, tt.want, joinBaseURL(tt.baseURL, tt.prefix), "joinBaseURL(%q, %q)", tt.baseURL, tt.prefix)
+		}
+
+		var path string
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			path = r.URL.EscapedPath()
+		}, &ClientOptions{PathPrefix: "/"})
+		require.NoError(t, client.Ack(context.Background(), "my group", []string{"a"}))
+		assert.Equal(t, "/http_pull_consumers/my%20group/ack", path)
+	})
+}
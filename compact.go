@@ -0,0 +1,90 @@
+package sequin
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// compact collapses the messages of batch that share an OrderingKey, or a
+// RecordKey if none is set, into the latest of them, in the position of the
+// latest. Its Changes are merged so that each changed column keeps the
+// oldest of its previous values within the batch. collapsed maps the ack ID
+// of each message that others were collapsed into to those others.
+func (p *Processor) compact(batch []Message) (compacted []Message, collapsed map[string][]Message) {
+	key := p.opts.OrderingKey
+	if key == nil {
+		key = RecordKey
+	}
+
+	keys := make([]string, len(batch))
+	latest := make(map[string]int, len(batch))
+	for i, msg := range batch {
+		keys[i] = key(msg)
+		latest[keys[i]] = i
+	}
+	if len(latest) == len(batch) {
+		return batch, nil
+	}
+
+	changes := make(map[string][]json.RawMessage)
+	for i, msg := range batch {
+		if msg.Changes != nil {
+			changes[keys[i]] = append(changes[keys[i]], msg.Changes)
+		}
+	}
+
+	compacted = make([]Message, 0, len(latest))
+	collapsed = make(map[string][]Message)
+	for i, msg := range batch {
+		if j := latest[keys[i]]; j != i {
+			collapsed[batch[j].AckID] = append(collapsed[batch[j].AckID], msg)
+			continue
+		}
+		if c := changes[keys[i]]; len(c) > 1 {
+			msg.Changes = mergeChanges(c)
+		}
+		compacted = append(compacted, msg)
+	}
+	return compacted, collapsed
+}
+
+// expandCompacted adds the messages collapsed into each failed message of
+// a *BatchResult in err to its failures, so they are settled like the
+// message that stood in for them.
+func expandCompacted(err error, collapsed map[string][]Message) {
+	var result *BatchResult
+	if len(collapsed) == 0 || !errors.As(err, &result) {
+		return
+	}
+	failed := make([]FailedMessage, 0, len(result.Failed))
+	for _, f := range result.Failed {
+		for _, msg := range collapsed[f.Message.AckID] {
+			failed = append(failed, FailedMessage{Message: msg, Err: f.Err})
+		}
+		failed = append(failed, f)
+	}
+	result.Failed = failed
+}
+
+// mergeChanges merges the Changes of successive updates to a row, oldest
+// first, keeping the oldest previous value of each column. It returns the
+// latest Changes unmodified if any of them isn't a JSON object.
+func mergeChanges(changes []json.RawMessage) json.RawMessage {
+	merged := make(map[string]json.RawMessage)
+	for _, c := range changes {
+		var columns map[string]json.RawMessage
+		if err := json.Unmarshal(c, &columns); err != nil {
+			return changes[len(changes)-1]
+		}
+		for column, old := range columns {
+			if _, ok := merged[column]; !ok {
+				merged[column] = old
+			}
+		}
+	}
+	b, err := json.Marshal(merged)
+	if err != nil {
+		return changes[len(changes)-1]
+	}
+	return b
+}
@@ -0,0 +1,154 @@
+package sequin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is a client and a set of named processors loaded by LoadConfig.
+type Config struct {
+	Client     ClientOptions
+	Processors map[string]ProcessorConfig
+}
+
+// ProcessorConfig is one named processor from a config file.
+type ProcessorConfig struct {
+	ConsumerGroup string
+	Options       ProcessorOptions
+}
+
+// LoadConfig reads a YAML (.yaml, .yml) or JSON (.json) config file, so
+// consumers can be tuned without recompiling:
+//
+//	client:
+//	  base_url: https://sequin.internal
+//	  timeout: 30s
+//	processors:
+//	  orders:
+//	    consumer_group: orders
+//	    max_batch_size: 50
+//	    max_concurrent: 4
+//
+// The client section accepts token, base_url, path_prefix, timeout,
+// app_name, ca_cert_file, client_cert_file, client_key_file, proxy_url and
+// no_proxy. Each processor accepts consumer_group (required),
+// max_batch_size, fetch_batch_size, max_concurrent and dry_run. Durations
+// are Go durations such as "30s". Unknown keys are an error, to catch typos.
+//
+// Keep the token out of the file by leaving it empty and filling in
+// Config.Client.Token, for example from ClientOptionsFromEnv, before calling
+// NewClient. Handlers and hooks are set on Options in code.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+
+	var file configFile
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&file)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&file)
+	default:
+		return nil, fmt.Errorf("config file %s: unsupported extension %q, use .yaml, .yml or .json", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+
+	cfg, err := file.config()
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// configFile is the on-disk layout of a config file.
+type configFile struct {
+	Client     clientConfigFile               `json:"client" yaml:"client"`
+	Processors map[string]processorConfigFile `json:"processors" yaml:"processors"`
+}
+
+type clientConfigFile struct {
+	Token          string `json:"token" yaml:"token"`
+	BaseURL        string `json:"base_url" yaml:"base_url"`
+	PathPrefix     string `json:"path_prefix" yaml:"path_prefix"`
+	Timeout        string `json:"timeout" yaml:"timeout"`
+	AppName        string `json:"app_name" yaml:"app_name"`
+	CACertFile     string `json:"ca_cert_file" yaml:"ca_cert_file"`
+	ClientCertFile string `json:"client_cert_file" yaml:"client_cert_file"`
+	ClientKeyFile  string `json:"client_key_file" yaml:"client_key_file"`
+	ProxyURL       string `json:"proxy_url" yaml:"proxy_url"`
+	NoProxy        string `json:"no_proxy" yaml:"no_proxy"`
+}
+
+type processorConfigFile struct {
+	ConsumerGroup  string `json:"consumer_group" yaml:"consumer_group"`
+	MaxBatchSize   int    `json:"max_batch_size" yaml:"max_batch_size"`
+	FetchBatchSize int    `json:"fetch_batch_size" yaml:"fetch_batch_size"`
+	MaxConcurrent  int    `json:"max_concurrent" yaml:"max_concurrent"`
+	DryRun         bool   `json:"dry_run" yaml:"dry_run"`
+}
+
+func (f *configFile) config() (*Config, error) {
+	cfg := &Config{
+		Client: ClientOptions{
+			Token:          f.Client.Token,
+			BaseURL:        f.Client.BaseURL,
+			PathPrefix:     f.Client.PathPrefix,
+			AppName:        f.Client.AppName,
+			CACertFile:     f.Client.CACertFile,
+			ClientCertFile: f.Client.ClientCertFile,
+			ClientKeyFile:  f.Client.ClientKeyFile,
+			ProxyURL:       f.Client.ProxyURL,
+			NoProxy:        f.Client.NoProxy,
+		},
+		Processors: make(map[string]ProcessorConfig, len(f.Processors)),
+	}
+
+	var err error
+	if cfg.Client.Timeout, err = parseConfigDuration(f.Client.Timeout); err != nil {
+		return nil, fmt.Errorf("client.timeout: %w", err)
+	}
+
+	for name, p := range f.Processors {
+		if p.ConsumerGroup == "" {
+			return nil, fmt.Errorf("processors.%s.consumer_group is required", name)
+		}
+		cfg.Processors[name] = ProcessorConfig{
+			ConsumerGroup: p.ConsumerGroup,
+			Options: ProcessorOptions{
+				MaxBatchSize:   p.MaxBatchSize,
+				FetchBatchSize: p.FetchBatchSize,
+				MaxConcurrent:  p.MaxConcurrent,
+				DryRun:         p.DryRun,
+			},
+		}
+	}
+	return cfg, nil
+}
+
+// parseConfigDuration parses s, leaving an empty value at zero.
+func parseConfigDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,100 @@
+package sequin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	want := &Config{
+		Client: ClientOptions{
+			BaseURL: "https://sequin.internal",
+			Timeout: 30 * time.Second,
+			AppName: "billing",
+		},
+		Processors: map[string]ProcessorConfig{
+			"orders": {
+				ConsumerGroup: "orders-cg",
+				Options: ProcessorOptions{
+					MaxBatchSize:  50,
+					MaxConcurrent: 4,
+				},
+			},
+			"audit": {
+				ConsumerGroup: "audit-cg",
+				Options:       ProcessorOptions{DryRun: true},
+			},
+		},
+	}
+
+	t.Run("yaml", func(t *testing.T) {
+		path := writeConfig(t, "sequin.yaml", `
+client:
+  base_url: https://sequin.internal
+  timeout: 30s
+  app_name: billing
+processors:
+  orders:
+    consumer_group: orders-cg
+    max_batch_size: 50
+    max_concurrent: 4
+  audit:
+    consumer_group: audit-cg
+    dry_run: true
+`)
+		cfg, err := LoadConfig(path)
+		require.NoError(t, err)
+		assert.Equal(t, want, cfg)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		path := writeConfig(t, "sequin.json", `{
+  "client": {"base_url": "https://sequin.internal", "timeout": "30s", "app_name": "billing"},
+  "processors": {
+    "orders": {"consumer_group": "orders-cg", "max_batch_size": 50, "max_concurrent": 4},
+    "audit": {"consumer_group": "audit-cg", "dry_run": true}
+  }
+}`)
+		cfg, err := LoadConfig(path)
+		require.NoError(t, err)
+		assert.Equal(t, want, cfg)
+	})
+
+	t.Run("empty file", func(t *testing.T) {
+		cfg, err := LoadConfig(writeConfig(t, "sequin.yml", ""))
+		require.NoError(t, err)
+		assert.Equal(t, &Config{Processors: map[string]ProcessorConfig{}}, cfg)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+		assert.ErrorContains(t, err, "reading config")
+
+		_, err = LoadConfig(writeConfig(t, "sequin.toml", ""))
+		assert.ErrorContains(t, err, `unsupported extension ".toml"`)
+
+		_, err = LoadConfig(writeConfig(t, "sequin.yaml", "client:\n  base_ulr: x\n"))
+		assert.ErrorContains(t, err, "base_ulr")
+
+		_, err = LoadConfig(writeConfig(t, "sequin.json", `{"client": {"timeout": 30}}`))
+		assert.ErrorContains(t, err, "parsing config")
+
+		_, err = LoadConfig(writeConfig(t, "sequin.yaml", "client:\n  timeout: soon\n"))
+		assert.ErrorContains(t, err, "client.timeout")
+
+		_, err = LoadConfig(writeConfig(t, "sequin.yaml", "processors:\n  orders:\n    max_batch_size: 5\n"))
+		assert.ErrorContains(t, err, "processors.orders.consumer_group is required")
+	})
+}
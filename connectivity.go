@@ -0,0 +1,92 @@
+package sequin
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ConnectivityState describes whether the client can reach Sequin.
+type ConnectivityState int
+
+const (
+	// Connected means the most recent request reached the server.
+	Connected ConnectivityState = iota
+	// Degraded means recent requests failed to reach the server, but for
+	// less than ClientOptions.DownAfter.
+	Degraded
+	// Down means no request has reached the server for at least
+	// ClientOptions.DownAfter.
+	Down
+)
+
+func (s ConnectivityState) String() string {
+	switch s {
+	case Connected:
+		return "connected"
+	case Degraded:
+		return "degraded"
+	case Down:
+		return "down"
+	default:
+		return "unknown"
+	}
+}
+
+// connectivity tracks the client's ConnectivityState from request outcomes.
+type connectivity struct {
+	mu           sync.Mutex
+	state        ConnectivityState
+	failingSince time.Time
+	downAfter    time.Duration
+	onChange     func(from, to ConnectivityState)
+}
+
+// record updates the state after a request. Requests abandoned by their
+// caller say nothing about connectivity and are ignored.
+func (c *connectivity) record(req *http.Request, resp *http.Response, err error) {
+	if req.Context().Err() != nil {
+		return
+	}
+
+	c.mu.Lock()
+	from := c.state
+	now := time.Now()
+	if reachedServer(resp, err) {
+		c.state = Connected
+		c.failingSince = time.Time{}
+	} else {
+		if c.failingSince.IsZero() {
+			c.failingSince = now
+		}
+		c.state = Degraded
+		if now.Sub(c.failingSince) >= c.downAfter {
+			c.state = Down
+		}
+	}
+	to := c.state
+	c.mu.Unlock()
+
+	if from != to && c.onChange != nil {
+		c.onChange(from, to)
+	}
+}
+
+func (c *connectivity) current() ConnectivityState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// reachedServer reports whether a request made it to Sequin. Gateway errors
+// mean a proxy in front of Sequin could not reach it either.
+func reachedServer(resp *http.Response, err error) bool {
+	if err != nil {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return false
+	}
+	return true
+}
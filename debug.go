@@ -0,0 +1,105 @@
+package sequin
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxDebugBodyBytes is how much of each body a debug trace includes.
+const maxDebugBodyBytes = 1 << 10
+
+// redactedHeaders are never included in debug traces.
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Cookie":              true,
+	"Proxy-Authorization": true,
+	"X-Sequin-Signature":  true,
+}
+
+// debugTrace returns an Interceptor that logs every exchange to logger, for
+// ClientOptions.Debug. It sits closest to the transport, so it sees requests
+// exactly as they are sent.
+func debugTrace(logger Logger) Interceptor {
+	return func(next RoundTripFunc) RoundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			reqBody := peekRequestBody(req)
+
+			start := time.Now()
+			resp, err := next(req)
+			args := []any{
+				"method", req.Method,
+				"url", req.URL.Redacted(),
+				"headers", debugHeaders(req.Header),
+				"request_body", reqBody,
+				"latency", time.Since(start),
+			}
+			if err != nil {
+				logger.Debug("HTTP request failed", append(args, "error", err)...)
+				return resp, err
+			}
+
+			args = append(args, "status_code", resp.StatusCode, "response_body", peekResponseBody(resp))
+			logger.Debug("HTTP request", args...)
+			return resp, nil
+		}
+	}
+}
+
+// debugHeaders formats h for a trace, redacting credentials.
+func debugHeaders(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(h[name], ",")
+		if redactedHeaders[name] {
+			value = "REDACTED"
+		}
+		parts = append(parts, name+": "+value)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// peekRequestBody returns the start of the body of req without consuming it.
+func peekRequestBody(req *http.Request) string {
+	if req.GetBody == nil {
+		return ""
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return ""
+	}
+	defer body.Close()
+	return readDebugBody(body)
+}
+
+// peekResponseBody returns the start of the body of resp, leaving the body
+// fully readable for the caller.
+func peekResponseBody(resp *http.Response) string {
+	head, _ := io.ReadAll(io.LimitReader(resp.Body, maxDebugBodyBytes+1))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+	return truncateDebugBody(head)
+}
+
+func readDebugBody(r io.Reader) string {
+	head, _ := io.ReadAll(io.LimitReader(r, maxDebugBodyBytes+1))
+	return truncateDebugBody(head)
+}
+
+func truncateDebugBody(b []byte) string {
+	if len(b) > maxDebugBodyBytes {
+		return string(b[:maxDebugBodyBytes]) + "...(truncated)"
+	}
+	return string(b)
+}
@@ -0,0 +1,242 @@
+package sequin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiscoveryOptions configures a ProcessorGroup.
+type DiscoveryOptions struct {
+	// List returns the names of the existing consumer groups, e.g. from the
+	// management API or the configuration your infrastructure automation
+	// writes. Required.
+	List func(context.Context) ([]string, error)
+
+	// Prefix restricts discovery to consumer groups whose name starts with it.
+	// If empty, every listed consumer group is processed.
+	Prefix string
+
+	// Interval is how often List is called to pick up new consumer groups and
+	// stop processors for removed ones. Defaults to 30s.
+	Interval time.Duration
+
+	// NewHandler returns the handler for a newly discovered consumer group. Required.
+	NewHandler func(consumerGroup string) (ProcessorFunc, error)
+
+	// Processor configures every processor started by the group.
+	// Prefetching.SpillPath is not supported, since processors would share the file.
+	Processor ProcessorOptions
+
+	// ErrorHandler is called when listing consumer groups fails, or when a
+	// processor cannot be started or stops with an error. consumerGroup is
+	// empty for listing errors. Failed processors are restarted on the next
+	// discovery round if their consumer group still exists.
+	// If nil, errors are logged to Processor.Logger.
+	ErrorHandler func(ctx context.Context, consumerGroup string, err error)
+}
+
+func (o *DiscoveryOptions) validate() error {
+	if o.List == nil {
+		return errors.New("List is required")
+	}
+	if o.NewHandler == nil {
+		return errors.New("NewHandler is required")
+	}
+	if o.Interval < 0 {
+		return fmt.Errorf("Interval must be >= 0, got %v", o.Interval)
+	}
+	if o.Interval == 0 {
+		o.Interval = 30 * time.Second
+	}
+	if o.Processor.Prefetching != nil && o.Processor.Prefetching.SpillPath != "" {
+		return errors.New("Prefetching.SpillPath is not supported")
+	}
+	if o.ErrorHandler == nil {
+		var logger Logger = stdLogger{}
+		if o.Processor.Logger != nil {
+			logger = o.Processor.Logger
+		}
+		o.ErrorHandler = func(_ context.Context, consumerGroup string, err error) {
+			logger.Error("Processor group error", "consumer_group", consumerGroup, "error", err)
+		}
+	}
+	return nil
+}
+
+// ProcessorGroup runs a Processor for every consumer group matching a
+// prefix, starting and stopping processors as consumer groups are created
+// and deleted, so new per-table consumer groups are picked up without
+// redeploying the consumer service.
+type ProcessorGroup struct {
+	client SequinClient
+	opts   DiscoveryOptions
+
+	mu      sync.Mutex
+	running map[string]*groupProcessor
+}
+
+// groupProcessor is a processor started by a ProcessorGroup.
+type groupProcessor struct {
+	cancel context.CancelFunc
+	done   chan struct{} // closed when Run returns
+}
+
+// NewProcessorGroup creates a ProcessorGroup. Call Run to start discovery.
+func NewProcessorGroup(client SequinClient, opts DiscoveryOptions) (*ProcessorGroup, error) {
+	if client == nil {
+		return nil, errors.New("client cannot be nil")
+	}
+	if err := opts.validate(); err != nil {
+		return nil, fmt.Errorf("invalid options: %w", err)
+	}
+	return &ProcessorGroup{
+		client:  client,
+		opts:    opts,
+		running: make(map[string]*groupProcessor),
+	}, nil
+}
+
+// Run discovers consumer groups every Interval and processes them until ctx
+// is done, then stops every processor and waits for them to return.
+// Like Processor.Run, it returns nil if ctx was cancelled.
+func (g *ProcessorGroup) Run(ctx context.Context) error {
+	defer g.stopAll()
+
+	ticker := time.NewTicker(g.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		g.discover(ctx)
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return nil
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// ConsumerGroups returns the consumer groups that currently have a running
+// processor, sorted by name.
+func (g *ProcessorGroup) ConsumerGroups() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	groups := make([]string, 0, len(g.running))
+	for group, gp := range g.running {
+		select {
+		case <-gp.done:
+			continue
+		default:
+		}
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// discover starts processors for new consumer groups and stops those whose
+// consumer group no longer exists.
+func (g *ProcessorGroup) discover(ctx context.Context) {
+	listed, err := g.opts.List(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			g.opts.ErrorHandler(ctx, "", fmt.Errorf("listing consumer groups: %w", err))
+		}
+		return
+	}
+
+	want := make(map[string]bool, len(listed))
+	for _, group := range listed {
+		if group != "" && strings.HasPrefix(group, g.opts.Prefix) {
+			want[group] = true
+		}
+	}
+
+	g.mu.Lock()
+	var removed []*groupProcessor
+	for group, gp := range g.running {
+		select {
+		case <-gp.done:
+			// Stopped on its own; restarted below if still wanted
+			delete(g.running, group)
+			continue
+		default:
+		}
+		if !want[group] {
+			gp.cancel()
+			removed = append(removed, gp)
+			delete(g.running, group)
+		}
+	}
+	g.mu.Unlock()
+
+	// Wait without holding g.mu, as removed processors finish their batches
+	for _, gp := range removed {
+		<-gp.done
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for group := range want {
+		if _, ok := g.running[group]; ok {
+			continue
+		}
+		if err := g.start(ctx, group); err != nil {
+			g.opts.ErrorHandler(ctx, group, fmt.Errorf("starting processor: %w", err))
+		}
+	}
+}
+
+// start must be called with g.mu held.
+func (g *ProcessorGroup) start(ctx context.Context, group string) error {
+	handler, err := g.opts.NewHandler(group)
+	if err != nil {
+		return fmt.Errorf("creating handler: %w", err)
+	}
+
+	// Processors validate their options in place, so each gets its own copy
+	opts := g.opts.Processor
+	if opts.Prefetching != nil {
+		prefetching := *opts.Prefetching
+		opts.Prefetching = &prefetching
+	}
+	p, err := NewProcessor(g.client, group, handler, opts)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	gp := &groupProcessor{cancel: cancel, done: make(chan struct{})}
+	g.running[group] = gp
+
+	go func() {
+		defer close(gp.done)
+		if err := p.Run(ctx); err != nil && ctx.Err() == nil {
+			g.opts.ErrorHandler(ctx, group, err)
+		}
+	}()
+	return nil
+}
+
+func (g *ProcessorGroup) stopAll() {
+	g.mu.Lock()
+	running := g.running
+	g.running = make(map[string]*groupProcessor)
+	g.mu.Unlock()
+
+	for _, gp := range running {
+		gp.cancel()
+	}
+	for _, gp := range running {
+		<-gp.done
+	}
+}
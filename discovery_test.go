@@ -0,0 +1,143 @@
+package sequin
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessorGroup(t *testing.T) {
+	t.Run("starts and stops processors as groups change", func(t *testing.T) {
+		client := newGroupedMockClient("orders-a", "orders-b", "other")
+		for _, c := range client.groups {
+			c.receiveDelay = 5 * time.Millisecond
+		}
+		client.groups["orders-a"].setMessages(generateTestMessages(3))
+		client.groups["orders-b"].setMessages(generateTestMessages(2))
+
+		var mu sync.Mutex
+		listed := []string{"orders-a", "other"}
+		var handlers []string
+
+		g, err := NewProcessorGroup(client, DiscoveryOptions{
+			List: func(context.Context) ([]string, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				return append([]string{}, listed...), nil
+			},
+			Prefix:   "orders-",
+			Interval: 10 * time.Millisecond,
+			NewHandler: func(group string) (ProcessorFunc, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				handlers = append(handlers, group)
+				return newTestProcessorFunc().handler, nil
+			},
+			Processor: ProcessorOptions{
+				OnCaughtUp: func(context.Context) {},
+			},
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- g.Run(ctx)
+		}()
+
+		assert.Eventually(t, func() bool {
+			return len(client.groups["orders-a"].acknowledgedMessages()) == 3
+		}, time.Second, 5*time.Millisecond)
+		assert.Equal(t, []string{"orders-a"}, g.ConsumerGroups())
+
+		mu.Lock()
+		listed = []string{"orders-b", "other"}
+		mu.Unlock()
+
+		assert.Eventually(t, func() bool {
+			groups := g.ConsumerGroups()
+			return len(groups) == 1 && groups[0] == "orders-b"
+		}, time.Second, 5*time.Millisecond)
+		assert.Eventually(t, func() bool {
+			return len(client.groups["orders-b"].acknowledgedMessages()) == 2
+		}, time.Second, 5*time.Millisecond)
+
+		cancel()
+		require.NoError(t, <-errCh)
+		assert.Empty(t, g.ConsumerGroups())
+
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, []string{"orders-a", "orders-b"}, handlers)
+		assert.Zero(t, client.groups["other"].receiveCount)
+	})
+
+	t.Run("reports listing errors and keeps running processors", func(t *testing.T) {
+		client := newGroupedMockClient("orders-a")
+		client.groups["orders-a"].receiveDelay = 5 * time.Millisecond
+
+		var mu sync.Mutex
+		var listErr error
+		var reported []error
+		g, err := NewProcessorGroup(client, DiscoveryOptions{
+			List: func(context.Context) ([]string, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if listErr != nil {
+					return nil, listErr
+				}
+				return []string{"orders-a"}, nil
+			},
+			Interval:   10 * time.Millisecond,
+			NewHandler: func(string) (ProcessorFunc, error) { return newTestProcessorFunc().handler, nil },
+			Processor:  ProcessorOptions{OnCaughtUp: func(context.Context) {}},
+			ErrorHandler: func(_ context.Context, _ string, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				reported = append(reported, err)
+			},
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- g.Run(ctx)
+		}()
+
+		assert.Eventually(t, func() bool {
+			return len(g.ConsumerGroups()) == 1
+		}, time.Second, 5*time.Millisecond)
+
+		mu.Lock()
+		listErr = errors.New("management API unavailable")
+		mu.Unlock()
+
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(reported) > 0
+		}, time.Second, 5*time.Millisecond)
+		assert.Equal(t, []string{"orders-a"}, g.ConsumerGroups())
+
+		cancel()
+		require.NoError(t, <-errCh)
+	})
+
+	t.Run("rejects invalid options", func(t *testing.T) {
+		_, err := NewProcessorGroup(newMockClient(), DiscoveryOptions{
+			NewHandler: func(string) (ProcessorFunc, error) { return nil, nil },
+		})
+		assert.Error(t, err)
+
+		_, err = NewProcessorGroup(newMockClient(), DiscoveryOptions{
+			List: func(context.Context) ([]string, error) { return nil, nil },
+		})
+		assert.Error(t, err)
+	})
+}
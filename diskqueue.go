@@ -0,0 +1,318 @@
+package sequin
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DiskQueueOptions configures a disk-backed overflow queue for prefetching.
+//
+// With a disk queue, fetched messages are written to local files and fed
+// into the in-memory buffer as it drains, so catch-up consumers can prefetch
+// far beyond what fits in memory while keeping workers saturated. The queue
+// only holds messages for the current run: it is cleared when Run starts,
+// and messages left in it when Run returns are treated like the rest of the
+// prefetch buffer, i.e. nacked after Stop or with NackOnShutdown, or saved
+// to SpillPath.
+type DiskQueueOptions struct {
+	// Dir is the directory holding the queue files. Each consumer group gets
+	// its own subdirectory. Required.
+	Dir string
+
+	// MaxBytes bounds the size of unprocessed messages on disk per consumer
+	// group. Fetching pauses while the queue is full. Must be > 0.
+	MaxBytes int64
+
+	// SegmentBytes is the size at which the queue starts a new file, so that
+	// fully processed files can be deleted. Defaults to 64MB.
+	SegmentBytes int64
+}
+
+func (o *DiskQueueOptions) validate() error {
+	if o.Dir == "" {
+		return errors.New("Dir is required")
+	}
+	if o.MaxBytes <= 0 {
+		return fmt.Errorf("MaxBytes must be > 0, got %d", o.MaxBytes)
+	}
+	if o.SegmentBytes < 0 {
+		return fmt.Errorf("SegmentBytes must be >= 0, got %d", o.SegmentBytes)
+	}
+	if o.SegmentBytes == 0 {
+		o.SegmentBytes = 64 << 20
+	}
+	return nil
+}
+
+// diskQueue is a FIFO of buffered messages stored in segment files.
+// Each record is a 4-byte big-endian length followed by a JSON document.
+type diskQueue struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	mu       sync.Mutex
+	segments []*segment // oldest first; writes go to the last one
+	unread   int64      // bytes written but not yet popped
+	messages int        // messages written but not yet popped
+	nextID   int
+
+	// queued counts the messages in all of the processor's disk queues
+	queued *atomic.Int64
+
+	// pushed and popped are signalled to wake a waiting pop or push
+	pushed chan struct{}
+	popped chan struct{}
+}
+
+type segment struct {
+	file   *os.File
+	size   int64 // bytes written
+	offset int64 // bytes read
+}
+
+type diskRecord struct {
+	ReceivedAt time.Time `json:"received_at"`
+	Message    Message   `json:"message"`
+	TxEnd      bool      `json:"tx_end,omitempty"`
+}
+
+// openDiskQueue creates an empty queue for consumerGroup, discarding any
+// files left by a previous run. Its messages are counted in queued.
+func openDiskQueue(opts *DiskQueueOptions, consumerGroup string, queued *atomic.Int64) (*diskQueue, error) {
+	dir := filepath.Join(opts.Dir, url.PathEscape(consumerGroup))
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	q := &diskQueue{
+		dir:          dir,
+		maxBytes:     opts.MaxBytes,
+		segmentBytes: opts.SegmentBytes,
+		queued:       queued,
+		pushed:       make(chan struct{}, 1),
+		popped:       make(chan struct{}, 1),
+	}
+	if err := q.addSegment(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// addSegment must be called with q.mu held (or before q is shared).
+func (q *diskQueue) addSegment() error {
+	path := filepath.Join(q.dir, fmt.Sprintf("%08d.seg", q.nextID))
+	q.nextID++
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	q.segments = append(q.segments, &segment{file: f})
+	return nil
+}
+
+// push appends b, waiting while the queue is full. A record larger than
+// MaxBytes is accepted once the queue is empty.
+func (q *diskQueue) push(ctx context.Context, b bufferedMessage) error {
+	data, err := json.Marshal(diskRecord{ReceivedAt: b.receivedAt, Message: b.msg, TxEnd: b.txEnd})
+	if err != nil {
+		return err
+	}
+	record := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[4:], data)
+
+	for {
+		q.mu.Lock()
+		if q.unread == 0 || q.unread+int64(len(record)) <= q.maxBytes {
+			err := q.write(record)
+			q.mu.Unlock()
+			if err == nil {
+				signal(q.pushed)
+			}
+			return err
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-q.popped:
+		}
+	}
+}
+
+// write must be called with q.mu held.
+func (q *diskQueue) write(record []byte) error {
+	last := q.segments[len(q.segments)-1]
+	if last.size >= q.segmentBytes {
+		if err := q.addSegment(); err != nil {
+			return err
+		}
+		last = q.segments[len(q.segments)-1]
+	}
+
+	if _, err := last.file.WriteAt(record, last.size); err != nil {
+		return err
+	}
+	last.size += int64(len(record))
+	q.unread += int64(len(record))
+	q.messages++
+	q.queued.Add(1)
+	return nil
+}
+
+// pop removes the oldest message, waiting until one is available.
+func (q *diskQueue) pop(ctx context.Context) (bufferedMessage, error) {
+	for {
+		q.mu.Lock()
+		if q.unread > 0 {
+			b, err := q.read()
+			q.mu.Unlock()
+			if err == nil {
+				signal(q.popped)
+			}
+			return b, err
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return bufferedMessage{}, ctx.Err()
+		case <-q.pushed:
+		}
+	}
+}
+
+// read must be called with q.mu held and q.unread > 0.
+func (q *diskQueue) read() (bufferedMessage, error) {
+	seg := q.segments[0]
+	if seg.offset == seg.size {
+		// Everything in the oldest segment has been read.
+		// Writes have moved on to a newer one, so it can be deleted
+		if err := q.removeOldest(); err != nil {
+			return bufferedMessage{}, err
+		}
+		seg = q.segments[0]
+	}
+
+	var header [4]byte
+	if _, err := seg.file.ReadAt(header[:], seg.offset); err != nil {
+		return bufferedMessage{}, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := seg.file.ReadAt(data, seg.offset+4); err != nil {
+		return bufferedMessage{}, err
+	}
+	n := int64(4 + len(data))
+	seg.offset += n
+	q.unread -= n
+	q.messages--
+	q.queued.Add(-1)
+
+	// Reuse the only segment once it has been fully read
+	if len(q.segments) == 1 && seg.offset == seg.size {
+		seg.offset, seg.size = 0, 0
+		if err := seg.file.Truncate(0); err != nil {
+			return bufferedMessage{}, err
+		}
+	}
+
+	var record diskRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return bufferedMessage{}, err
+	}
+	return bufferedMessage{msg: record.Message, receivedAt: record.ReceivedAt, txEnd: record.TxEnd}, nil
+}
+
+// removeOldest must be called with q.mu held.
+func (q *diskQueue) removeOldest() error {
+	seg := q.segments[0]
+	q.segments = q.segments[1:]
+	if err := seg.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(seg.file.Name())
+}
+
+// drain removes every message left in the queue, oldest first. On error,
+// it returns the messages read so far.
+func (q *diskQueue) drain() ([]bufferedMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var drained []bufferedMessage
+	for q.unread > 0 {
+		b, err := q.read()
+		if err != nil {
+			return drained, err
+		}
+		drained = append(drained, b)
+	}
+	return drained, nil
+}
+
+// len returns the number of messages in the queue.
+func (q *diskQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.messages
+}
+
+// close deletes the queue's files.
+func (q *diskQueue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, seg := range q.segments {
+		seg.file.Close()
+	}
+	q.segments = nil
+	q.queued.Add(-int64(q.messages))
+	q.messages = 0
+	return os.RemoveAll(q.dir)
+}
+
+func (p *Processor) openDiskQueues() error {
+	for _, l := range p.lanes {
+		q, err := openDiskQueue(p.opts.Prefetching.DiskQueue, l.consumerGroup, &p.stats.onDisk)
+		if err != nil {
+			p.closeDiskQueues(context.Background())
+			return err
+		}
+		l.disk = q
+	}
+	return nil
+}
+
+func (p *Processor) closeDiskQueues(ctx context.Context) {
+	for _, l := range p.lanes {
+		if l.disk == nil {
+			continue
+		}
+		// Messages left on disk are redelivered after the visibility timeout
+		p.unreserve(l.disk.len())
+		if err := l.disk.close(); err != nil {
+			p.reportError(ctx, l.consumerGroup, nil, fmt.Errorf("closing disk queue: %w", err))
+		}
+		l.disk = nil
+	}
+}
+
+// signal wakes a waiter on ch without blocking.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
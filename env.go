@@ -0,0 +1,70 @@
+package sequin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ClientOptionsFromEnv reads client options from environment variables:
+//
+//	SEQUIN_TOKEN             Token (required)
+//	SEQUIN_BASE_URL          BaseURL; SEQUIN_URL is accepted as well
+//	SEQUIN_PATH_PREFIX       PathPrefix
+//	SEQUIN_TIMEOUT           Timeout, as a Go duration such as "30s"
+//	SEQUIN_APP_NAME          AppName
+//	SEQUIN_CA_CERT_FILE      CACertFile
+//	SEQUIN_CLIENT_CERT_FILE  ClientCertFile
+//	SEQUIN_CLIENT_KEY_FILE   ClientKeyFile
+//	SEQUIN_PROXY_URL         ProxyURL
+//	SEQUIN_NO_PROXY          NoProxy
+//
+// Unset variables leave their option at its default. Use it to combine
+// environment configuration with options that can't come from the
+// environment, such as a TokenProvider, before calling NewClient.
+func ClientOptionsFromEnv() (ClientOptions, error) {
+	opts := ClientOptions{
+		Token:          os.Getenv("SEQUIN_TOKEN"),
+		BaseURL:        os.Getenv("SEQUIN_BASE_URL"),
+		PathPrefix:     os.Getenv("SEQUIN_PATH_PREFIX"),
+		AppName:        os.Getenv("SEQUIN_APP_NAME"),
+		CACertFile:     os.Getenv("SEQUIN_CA_CERT_FILE"),
+		ClientCertFile: os.Getenv("SEQUIN_CLIENT_CERT_FILE"),
+		ClientKeyFile:  os.Getenv("SEQUIN_CLIENT_KEY_FILE"),
+		ProxyURL:       os.Getenv("SEQUIN_PROXY_URL"),
+		NoProxy:        os.Getenv("SEQUIN_NO_PROXY"),
+	}
+	if opts.BaseURL == "" {
+		opts.BaseURL = os.Getenv("SEQUIN_URL")
+	}
+
+	if v := os.Getenv("SEQUIN_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return ClientOptions{}, fmt.Errorf("parsing SEQUIN_TIMEOUT: %w", err)
+		}
+		opts.Timeout = timeout
+	}
+
+	return opts, nil
+}
+
+// NewClientFromEnv creates a client configured by the environment
+// variables read by ClientOptionsFromEnv. Unlike NewClient, it reports
+// missing or invalid configuration as an error.
+func NewClientFromEnv() (*Client, error) {
+	opts, err := ClientOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Token == "" {
+		return nil, errors.New("SEQUIN_TOKEN is required")
+	}
+
+	// Validate the transport settings here, where NewClient would panic
+	if _, err := newTransport(&opts); err != nil {
+		return nil, fmt.Errorf("configuring transport: %w", err)
+	}
+	return NewClient(&opts), nil
+}
@@ -0,0 +1,141 @@
+package sequin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrConsumerGroupNotFound is returned when the server reports that a
+// consumer group does not exist, e.g. because it was deleted: a 404 with
+// Sequin's not_found error code.
+var ErrConsumerGroupNotFound = errors.New("consumer group not found")
+
+// ErrConsumerNotFound is an alias of ErrConsumerGroupNotFound.
+var ErrConsumerNotFound = ErrConsumerGroupNotFound
+
+// ErrUnauthorized is returned when the server rejects the client's
+// credentials (401) or denies access to a resource (403).
+var ErrUnauthorized = errors.New("unauthorized")
+
+// ErrRateLimited is returned when the server rejects a request because the
+// client is sending too many (429).
+var ErrRateLimited = errors.New("rate limited")
+
+// ErrCircuitOpen is returned, as a *CircuitOpenError, for requests the
+// client's circuit breaker rejects without sending them.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitOpenError is returned for requests rejected by an open circuit
+// breaker, see ClientOptions.CircuitBreaker. It matches ErrCircuitOpen.
+type CircuitOpenError struct {
+	// RetryAfter is how long until the breaker lets a request through again.
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%v, retry in %v", ErrCircuitOpen, e.RetryAfter)
+}
+
+func (e *CircuitOpenError) Unwrap() error { return ErrCircuitOpen }
+
+// APIError is an unsuccessful response from the Sequin API. Errors wrapping
+// a sentinel such as ErrUnauthorized also wrap the APIError, so both
+// errors.Is and errors.As work on them.
+type APIError struct {
+	StatusCode int    // HTTP status code
+	Code       string // Sequin error code, e.g. "not_found", if reported
+	Summary    string // Human-readable description of the error
+
+	// ValidationErrors lists the problems with each invalid request field.
+	ValidationErrors map[string][]string
+
+	// RetryAfter is how long the server asked the client to wait before
+	// retrying, from the Retry-After header of a 429 or 503 response.
+	// Zero if the server did not say.
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "status code %d", e.StatusCode)
+	if e.Code != "" {
+		fmt.Fprintf(&b, " (%s)", e.Code)
+	}
+	if e.Summary != "" {
+		b.WriteString(": ")
+		b.WriteString(e.Summary)
+	}
+
+	fields := make([]string, 0, len(e.ValidationErrors))
+	for field := range e.ValidationErrors {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		fmt.Fprintf(&b, "; %s: %s", field, strings.Join(e.ValidationErrors[field], ", "))
+	}
+	return b.String()
+}
+
+// maxErrorBodyBytes bounds how much of an error response is read.
+const maxErrorBodyBytes = 64 << 10
+
+// newAPIError reads the error details from an unsuccessful response.
+// Bodies that are not Sequin's JSON error format become the Summary.
+func newAPIError(resp *http.Response) *APIError {
+	apiErr := &APIError{StatusCode: resp.StatusCode}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		apiErr.RetryAfter = retryAfter(resp, time.Now())
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+	if err != nil || len(body) == 0 {
+		return apiErr
+	}
+
+	var details struct {
+		Code             string              `json:"code"`
+		Summary          string              `json:"summary"`
+		ValidationErrors map[string][]string `json:"validation_errors"`
+	}
+	if err := json.Unmarshal(body, &details); err != nil {
+		apiErr.Summary = strings.TrimSpace(string(body))
+		return apiErr
+	}
+	apiErr.Code = details.Code
+	apiErr.Summary = details.Summary
+	apiErr.ValidationErrors = details.ValidationErrors
+	return apiErr
+}
+
+// checkStatus maps an unsuccessful response for a consumer group request to
+// an APIError, wrapped with the matching sentinel if there is one.
+func checkStatus(resp *http.Response, consumerGroupID string) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	apiErr := newAPIError(resp)
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("%w: %w", ErrUnauthorized, apiErr)
+	case http.StatusNotFound:
+		// Only Sequin's own not_found error identifies a missing consumer
+		// group. Other 404s, e.g. from a wrong BaseURL or PathPrefix,
+		// are returned as they are.
+		if apiErr.Code != "not_found" {
+			return apiErr
+		}
+		return fmt.Errorf("%w: %s: %w", ErrConsumerGroupNotFound, consumerGroupID, apiErr)
+	case http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %w", ErrRateLimited, apiErr)
+	default:
+		return apiErr
+	}
+}
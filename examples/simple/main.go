@@ -18,17 +18,28 @@ func main() {
 	consumerGroup := flag.String("consumer-group", "", "Consumer Group name or ID")
 	outputFile := flag.String("output", "", "Output file path (optional, defaults to stdout)")
 	maxBatchSize := flag.Int("max-batch-size", 10, "Maximum batch size for processing messages")
-	baseURL := flag.String("base-url", "", "Sequin API base URL (optional, defaults to https://api.sequinstream.com/api)")
+	baseURL := flag.String("base-url", "", "Sequin API base URL (optional, defaults to https://api.sequinstream.com)")
 	flag.Parse()
 
+	// Read SEQUIN_TOKEN, SEQUIN_BASE_URL, etc., letting flags override them
+	clientOpts, err := sequin.ClientOptionsFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid environment: %v", err)
+	}
+	if *token != "" {
+		clientOpts.Token = *token
+	}
+	if *baseURL != "" {
+		clientOpts.BaseURL = *baseURL
+	}
+
 	// Validate required flags
-	if *token == "" || *consumerGroup == "" {
-		log.Fatal("token and consumer-group flags are required")
+	if clientOpts.Token == "" || *consumerGroup == "" {
+		log.Fatal("token (or SEQUIN_TOKEN) and consumer-group flags are required")
 	}
 
 	// Setup output destination
 	var output *os.File
-	var err error
 	if *outputFile != "" {
 		output, err = os.OpenFile(*outputFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
@@ -40,10 +51,7 @@ func main() {
 	}
 
 	// Initialize Sequin client
-	client := sequin.NewClient(&sequin.ClientOptions{
-		Token:   *token,
-		BaseURL: *baseURL,
-	})
+	client := sequin.NewClient(&clientOpts)
 
 	// Create message processor
 	processor, err := sequin.NewProcessor(
@@ -0,0 +1,62 @@
+package sequin
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// endpoints tracks the health of the client's base URLs for failover,
+// preferring them in the order configured.
+type endpoints struct {
+	urls     []string // base URLs joined with the path prefix, primary first
+	cooldown time.Duration
+
+	mu        sync.Mutex
+	downUntil []time.Time // when each URL is tried again after failing
+}
+
+func newEndpoints(primary string, fallbacks []string, prefix string, cooldown time.Duration) *endpoints {
+	urls := []string{joinBaseURL(primary, prefix)}
+	for _, u := range fallbacks {
+		urls = append(urls, joinBaseURL(u, prefix))
+	}
+	return &endpoints{urls: urls, cooldown: cooldown, downUntil: make([]time.Time, len(urls))}
+}
+
+// pick returns the index of the first healthy URL, or of the one that
+// will recover soonest if none are healthy.
+func (e *endpoints) pick(now time.Time) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	best := 0
+	for i, until := range e.downUntil {
+		if !now.Before(until) {
+			return i
+		}
+		if until.Before(e.downUntil[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+// markDown records that the URL at index i could not be reached.
+func (e *endpoints) markDown(i int, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.downUntil[i] = now.Add(e.cooldown)
+}
+
+// target points req at the URL at index i, given its path under baseURL.
+func (e *endpoints) target(req *http.Request, i int, path string) error {
+	u, err := url.Parse(e.urls[i] + path)
+	if err != nil {
+		return err
+	}
+	req.URL = u
+	req.Host = u.Host
+	return nil
+}
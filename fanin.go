@@ -0,0 +1,107 @@
+package sequin
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// NewFanInProcessor creates a processor that merges several consumer groups
+// into one handler stream, e.g. to build a single projection from related
+// tables such as users, profiles and settings.
+//
+// Each consumer group is prefetched into its own buffer, and batches are
+// taken from the buffers in turn so that no source starves the others.
+// Prefetching is required. A batch only ever contains messages from a single
+// consumer group. Set ProcessorOptions.OrderingKey to preserve per-key
+// ordering within each source while batches run concurrently.
+func NewFanInProcessor(client SequinClient, consumerGroups []string, handler ProcessorFunc, opts ProcessorOptions) (*Processor, error) {
+	if err := validateConsumerGroups(consumerGroups); err != nil {
+		return nil, err
+	}
+	if opts.Prefetching == nil {
+		return nil, errors.New("fan-in processing requires Prefetching")
+	}
+
+	p, err := newProcessor(client, consumerGroups, handler, opts)
+	if err != nil {
+		return nil, err
+	}
+	p.roundRobin = true
+	return p, nil
+}
+
+// orderingKey identifies messages that must be handled in order.
+type orderingKey struct {
+	consumerGroup string
+	key           string
+}
+
+// orderingKeys returns the distinct ordering keys of batch.
+func (p *Processor) orderingKeys(consumerGroup string, batch []Message) []orderingKey {
+	seen := make(map[orderingKey]bool, len(batch))
+	keys := make([]orderingKey, 0, len(batch))
+	for _, msg := range batch {
+		k := orderingKey{consumerGroup: consumerGroup, key: p.opts.OrderingKey(msg)}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// keyLocks tracks the ordering keys held by in-flight batches.
+type keyLocks struct {
+	mu       sync.Mutex
+	held     map[orderingKey]bool
+	released chan struct{} // closed and replaced whenever keys are unlocked
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{
+		held:     make(map[orderingKey]bool),
+		released: make(chan struct{}),
+	}
+}
+
+// lock waits until none of keys is held, then holds all of them.
+func (k *keyLocks) lock(ctx context.Context, keys []orderingKey) error {
+	for {
+		k.mu.Lock()
+		free := true
+		for _, key := range keys {
+			if k.held[key] {
+				free = false
+				break
+			}
+		}
+		if free {
+			for _, key := range keys {
+				k.held[key] = true
+			}
+			k.mu.Unlock()
+			return nil
+		}
+		released := k.released
+		k.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+// unlock releases keys held by a finished batch.
+func (k *keyLocks) unlock(keys []orderingKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, key := range keys {
+		delete(k.held, key)
+	}
+	close(k.released)
+	k.released = make(chan struct{})
+}
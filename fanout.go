@@ -0,0 +1,132 @@
+package sequin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FanOut runs several independent handlers on every batch, e.g. so one
+// consumer group can feed both a cache updater and a search indexer.
+//
+// Handlers run concurrently and are isolated from each other: a failing
+// handler does not stop the others, and is retried on its own when Retry is
+// configured. FanOut.Process satisfies ProcessorFunc and only succeeds once
+// every handler has succeeded, so a batch is acknowledged only after all
+// handlers have processed it. After a failure the whole batch is redelivered,
+// or only the messages some handler failed when handlers return a
+// *BatchResult, so handlers should be idempotent.
+type FanOut struct {
+	handlers    []namedHandler
+	maxAttempts int
+	backoff     time.Duration
+}
+
+type namedHandler struct {
+	name string
+	fn   ProcessorFunc
+}
+
+// NewFanOut creates a FanOut without handlers.
+func NewFanOut() *FanOut {
+	return &FanOut{maxAttempts: 1}
+}
+
+// Handle registers fn under name, which identifies it in errors.
+func (f *FanOut) Handle(name string, fn ProcessorFunc) *FanOut {
+	f.handlers = append(f.handlers, namedHandler{name: name, fn: fn})
+	return f
+}
+
+// Retry makes each handler try a batch up to maxAttempts times before
+// reporting a failure, waiting backoff after the first failure and doubling
+// the wait after each further one. Only the failing handler is retried.
+func (f *FanOut) Retry(maxAttempts int, backoff time.Duration) *FanOut {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	f.maxAttempts = maxAttempts
+	f.backoff = backoff
+	return f
+}
+
+// Process runs every handler on msgs and waits for all of them. It returns
+// the errors of the handlers that failed, joined. If any handler reported a
+// *BatchResult, it returns a single *BatchResult instead, failing every
+// message that some handler failed, so a message is only acknowledged once
+// every handler has processed it.
+func (f *FanOut) Process(ctx context.Context, msgs []Message) error {
+	errs := make([]error, len(f.handlers))
+
+	var wg sync.WaitGroup
+	for i, h := range f.handlers {
+		i, h := i, h
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f.run(ctx, h.fn, msgs); err != nil {
+				errs[i] = fmt.Errorf("handler %s: %w", h.name, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		var result *BatchResult
+		if errors.As(err, &result) {
+			return f.merge(msgs, errs)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// merge combines the handler errors errs, some of which are *BatchResults,
+// into one *BatchResult. A handler that failed without a *BatchResult fails
+// every message.
+func (f *FanOut) merge(msgs []Message, errs []error) *BatchResult {
+	failures := make(map[string][]error, len(msgs))
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		var result *BatchResult
+		if !errors.As(err, &result) {
+			for _, msg := range msgs {
+				failures[msg.AckID] = append(failures[msg.AckID], err)
+			}
+			continue
+		}
+		for _, failed := range result.Failed {
+			err := fmt.Errorf("handler %s: %w", f.handlers[i].name, failed.Err)
+			failures[failed.Message.AckID] = append(failures[failed.Message.AckID], err)
+		}
+	}
+
+	merged := &BatchResult{}
+	for _, msg := range msgs {
+		if errs := failures[msg.AckID]; len(errs) > 0 {
+			merged.Fail(msg, errors.Join(errs...))
+		}
+	}
+	return merged
+}
+
+// run calls fn, retrying failures as configured.
+func (f *FanOut) run(ctx context.Context, fn ProcessorFunc, msgs []Message) error {
+	backoff := f.backoff
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx, msgs)
+		if err == nil || attempt >= f.maxAttempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,117 @@
+package sequin
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFanOut(t *testing.T) {
+	msgs := generateTestMessages(3)
+
+	t.Run("runs every handler", func(t *testing.T) {
+		var mu sync.Mutex
+		got := make(map[string]int)
+		record := func(name string) ProcessorFunc {
+			return func(_ context.Context, msgs []Message) error {
+				mu.Lock()
+				defer mu.Unlock()
+				got[name] += len(msgs)
+				return nil
+			}
+		}
+
+		f := NewFanOut().Handle("cache", record("cache")).Handle("index", record("index"))
+		require.NoError(t, f.Process(context.Background(), msgs))
+		assert.Equal(t, map[string]int{"cache": 3, "index": 3}, got)
+	})
+
+	t.Run("isolates failing handlers", func(t *testing.T) {
+		var indexed bool
+		f := NewFanOut().
+			Handle("cache", func(context.Context, []Message) error { return errors.New("boom") }).
+			Handle("index", func(context.Context, []Message) error { indexed = true; return nil })
+
+		err := f.Process(context.Background(), msgs)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "handler cache: boom")
+		assert.True(t, indexed, "other handlers still run")
+	})
+
+	t.Run("merges partial failures", func(t *testing.T) {
+		f := NewFanOut().
+			Handle("cache", func(_ context.Context, msgs []Message) error {
+				var result BatchResult
+				result.Fail(msgs[0], errors.New("stale"))
+				return result.Err()
+			}).
+			Handle("index", func(_ context.Context, msgs []Message) error {
+				var result BatchResult
+				result.Fail(msgs[1], errors.New("conflict"))
+				return result.Err()
+			})
+
+		var result *BatchResult
+		require.ErrorAs(t, f.Process(context.Background(), msgs), &result)
+		assert.Equal(t, []Message{msgs[0], msgs[1]}, result.messages())
+		assert.EqualError(t, result.Failed[0].Err, "handler cache: stale")
+	})
+
+	t.Run("fails every message when a handler fails the whole batch", func(t *testing.T) {
+		f := NewFanOut().
+			Handle("cache", func(_ context.Context, msgs []Message) error {
+				var result BatchResult
+				result.Fail(msgs[0], errors.New("stale"))
+				return result.Err()
+			}).
+			Handle("index", func(context.Context, []Message) error { return errors.New("down") })
+
+		var result *BatchResult
+		require.ErrorAs(t, f.Process(context.Background(), msgs), &result)
+		assert.Equal(t, msgs, result.messages())
+		assert.EqualError(t, result.Failed[0].Err, "handler cache: stale\nhandler index: down")
+
+		client := newMockClient()
+		client.setMessages(msgs)
+		p, err := NewProcessor(client, "test-group", f.Process, ProcessorOptions{
+			MaxBatchSize: 3,
+			ErrorHandler: func(context.Context, []Message, error) {},
+		})
+		require.NoError(t, err)
+		require.NoError(t, runUntilCaughtUp(context.Background(), p))
+		assert.Empty(t, client.acknowledgedMessages(), "messages the index handler failed must not be acknowledged")
+	})
+
+	t.Run("retries only the failing handler", func(t *testing.T) {
+		var cacheCalls, indexCalls int
+		f := NewFanOut().
+			Handle("cache", func(context.Context, []Message) error {
+				cacheCalls++
+				if cacheCalls < 3 {
+					return errors.New("unavailable")
+				}
+				return nil
+			}).
+			Handle("index", func(context.Context, []Message) error { indexCalls++; return nil }).
+			Retry(3, time.Millisecond)
+
+		require.NoError(t, f.Process(context.Background(), msgs))
+		assert.Equal(t, 3, cacheCalls)
+		assert.Equal(t, 1, indexCalls)
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		var calls int
+		f := NewFanOut().
+			Handle("cache", func(context.Context, []Message) error { calls++; return errors.New("unavailable") }).
+			Retry(2, time.Millisecond)
+
+		require.Error(t, f.Process(context.Background(), msgs))
+		assert.Equal(t, 2, calls)
+	})
+}
@@ -0,0 +1,94 @@
+package sequin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Limiter caps batch processing across every Processor that shares it.
+//
+// A service running many processors against one downstream system can pass
+// the same Limiter to each of them through ProcessorOptions.Limiter to bound
+// the total number of batches in flight, independently of each processor's
+// own MaxConcurrent.
+type Limiter struct {
+	sem *semaphore.Weighted
+
+	// interval is the minimum spacing between batch starts, zero if unlimited
+	interval time.Duration
+	mu       sync.Mutex
+	next     time.Time
+}
+
+// LimiterOptions configures a Limiter.
+type LimiterOptions struct {
+	// MaxConcurrent is the maximum number of batches processed at once across
+	// all processors sharing the limiter. Must be > 0.
+	MaxConcurrent int
+
+	// BatchesPerSecond optionally caps how many batches may start per second
+	// across all processors sharing the limiter. If zero, starts are not rate limited.
+	BatchesPerSecond float64
+}
+
+// NewLimiter creates a Limiter to share between processors.
+func NewLimiter(opts LimiterOptions) (*Limiter, error) {
+	if opts.MaxConcurrent <= 0 {
+		return nil, fmt.Errorf("MaxConcurrent must be > 0, got %d", opts.MaxConcurrent)
+	}
+	if opts.BatchesPerSecond < 0 {
+		return nil, fmt.Errorf("BatchesPerSecond must be >= 0, got %v", opts.BatchesPerSecond)
+	}
+
+	l := &Limiter{
+		sem: semaphore.NewWeighted(int64(opts.MaxConcurrent)),
+	}
+	if opts.BatchesPerSecond > 0 {
+		l.interval = time.Duration(float64(time.Second) / opts.BatchesPerSecond)
+	}
+	return l, nil
+}
+
+// acquire blocks until a batch may start. Every successful acquire must be
+// paired with a release.
+func (l *Limiter) acquire(ctx context.Context) error {
+	if err := l.sem.Acquire(ctx, 1); err != nil {
+		return err
+	}
+
+	if l.interval == 0 {
+		return nil
+	}
+
+	// Reserve the next start slot
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		l.sem.Release(1)
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (l *Limiter) release() {
+	l.sem.Release(1)
+}
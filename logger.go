@@ -0,0 +1,59 @@
+package sequin
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives structured log events from the client and processors.
+// Each event has a message and alternating key/value pairs, such as
+// "consumer_group", "orders", "batch_size", 10.
+//
+// A *slog.Logger satisfies Logger, so structured logging only takes
+// passing slog.Default() or your own slog.Logger.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// stdLogger writes events at Info level and above, or with debug set at
+// every level, to the standard library's default logger, as
+// "LEVEL msg key=value ...".
+type stdLogger struct {
+	debug bool
+}
+
+func (l stdLogger) Debug(msg string, args ...any) {
+	if l.debug {
+		stdPrint("DEBUG", msg, args)
+	}
+}
+func (stdLogger) Info(msg string, args ...any)  { stdPrint("INFO", msg, args) }
+func (stdLogger) Warn(msg string, args ...any)  { stdPrint("WARN", msg, args) }
+func (stdLogger) Error(msg string, args ...any) { stdPrint("ERROR", msg, args) }
+
+func stdPrint(level, msg string, args []any) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(&b, " %v", args[i])
+			break
+		}
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+	log.Print(b.String())
+}
+
+// nopLogger discards every event.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
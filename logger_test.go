@@ -0,0 +1,85 @@
+//go:build go1.21
+
+package sequin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var _ Logger = (*slog.Logger)(nil)
+
+// logRecords decodes the JSON lines written by a slog.JSONHandler.
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var r map[string]any
+		require.NoError(t, dec.Decode(&r))
+		delete(r, "time")
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestSlogLogger(t *testing.T) {
+	t.Run("processor", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+		client := newMockClient()
+		client.setMessages(generateTestMessages(2))
+		p, err := NewProcessor(client, "orders", func(context.Context, []Message) error {
+			return errors.New("boom")
+		}, ProcessorOptions{MaxBatchSize: 2, Logger: logger})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err = runUntilCaughtUp(ctx, p)
+		require.NoError(t, err)
+
+		records := logRecords(t, &buf)
+		require.Len(t, records, 3)
+		assert.Equal(t, map[string]any{"level": "DEBUG", "msg": "Received messages", "consumer_group": "orders", "count": 2.0}, records[0])
+		assert.Equal(t, map[string]any{"level": "DEBUG", "msg": "Processing batch", "consumer_group": "orders", "batch_size": 2.0}, records[1])
+		assert.Equal(t, map[string]any{
+			"level":          "ERROR",
+			"msg":            "Processing failed",
+			"consumer_group": "orders",
+			"batch_size":     2.0,
+			"error":          "handler failed: boom",
+		}, records[2])
+	})
+
+	t.Run("client retries", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+		var requests int
+		client := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		}, &ClientOptions{Logger: logger, Retry: &RetryOptions{BaseDelay: time.Millisecond}})
+		require.NoError(t, client.Ack(context.Background(), "orders", []string{"a"}))
+
+		records := logRecords(t, &buf)
+		require.Len(t, records, 1)
+		assert.Equal(t, "Retrying request", records[0]["msg"])
+		assert.Equal(t, "POST", records[0]["method"])
+		assert.Equal(t, 1.0, records[0]["attempt"])
+		assert.Equal(t, 502.0, records[0]["status_code"])
+	})
+}
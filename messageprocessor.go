@@ -0,0 +1,106 @@
+package sequin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// NewMessageProcessor creates a processor that hands the messages of each
+// fetched batch to handler one at a time, in order, and settles each
+// message on its own: messages whose handler returns nil are acknowledged
+// and the others are left for redelivery, or nacked with NackOnError or
+// NackDelay. Batch failures are reported to the ErrorHandler with the
+// failed messages only.
+//
+// Batches still run concurrently up to MaxConcurrent. The Manual AckPolicy
+// is not supported.
+func NewMessageProcessor(client SequinClient, consumerGroup string, handler MessageFunc, opts ProcessorOptions) (*Processor, error) {
+	if handler == nil {
+		return nil, errors.New("handler cannot be nil")
+	}
+	if opts.AckPolicy == Manual {
+		return nil, errors.New("per-message processing does not support the manual AckPolicy")
+	}
+	return NewProcessor(client, consumerGroup, eachMessage(handler), opts)
+}
+
+// eachMessage adapts handler to a ProcessorFunc that reports the messages
+// it failed on with a *BatchResult.
+func eachMessage(handler MessageFunc) ProcessorFunc {
+	return func(ctx context.Context, msgs []Message) error {
+		var result BatchResult
+		for _, msg := range msgs {
+			if err := handler(ctx, msg); err != nil {
+				result.Fail(msg, fmt.Errorf("message %s: %w", msg.AckID, err))
+			}
+		}
+		return result.Err()
+	}
+}
+
+// BatchResult reports a batch that partly failed. A ProcessorFunc returns
+// it as its error, usually through Err, to have the Processor acknowledge
+// every message of the batch except the failed ones, which are left for
+// redelivery or nacked like a failed batch. Failures are reported to the
+// ErrorHandler with the failed messages only.
+type BatchResult struct {
+	// Failed lists the messages that failed, with their errors.
+	Failed []FailedMessage
+}
+
+// FailedMessage is a message that failed within a BatchResult.
+type FailedMessage struct {
+	Message Message
+	Err     error
+}
+
+// Fail records that msg failed with err.
+func (r *BatchResult) Fail(msg Message, err error) {
+	r.Failed = append(r.Failed, FailedMessage{Message: msg, Err: err})
+}
+
+// Err returns r if any message failed, and nil otherwise.
+func (r *BatchResult) Err() error {
+	if len(r.Failed) == 0 {
+		return nil
+	}
+	return r
+}
+
+func (r *BatchResult) Error() string {
+	return fmt.Sprintf("%d messages failed: %v", len(r.Failed), errors.Join(r.Unwrap()...))
+}
+
+// Unwrap returns the errors of the failed messages.
+func (r *BatchResult) Unwrap() []error {
+	errs := make([]error, len(r.Failed))
+	for i, f := range r.Failed {
+		errs[i] = f.Err
+	}
+	return errs
+}
+
+// messages returns the failed messages.
+func (r *BatchResult) messages() []Message {
+	msgs := make([]Message, len(r.Failed))
+	for i, f := range r.Failed {
+		msgs[i] = f.Message
+	}
+	return msgs
+}
+
+// succeeded returns the messages of batch that did not fail.
+func (r *BatchResult) succeeded(batch []Message) []Message {
+	failed := make(map[string]bool, len(r.Failed))
+	for _, f := range r.Failed {
+		failed[f.Message.AckID] = true
+	}
+	succeeded := make([]Message, 0, len(batch))
+	for _, msg := range batch {
+		if !failed[msg.AckID] {
+			succeeded = append(succeeded, msg)
+		}
+	}
+	return succeeded
+}
@@ -8,6 +8,10 @@ import (
 	"time"
 )
 
+// emptyReceiveDelay is how long the mock waits before answering a receive
+// with no messages.
+const emptyReceiveDelay = time.Millisecond
+
 // mockClient implements a controllable test double for Client
 type mockClient struct {
 	mu sync.Mutex
@@ -15,6 +19,7 @@ type mockClient struct {
 	// Tracks calls to methods
 	receiveCount      int
 	receiveBatchSizes []int
+	receiveParams     []ReceiveParams
 	ackCount          int
 
 	// Messages to return from Receive
@@ -24,10 +29,15 @@ type mockClient struct {
 	// Records which messages were acknowledged
 	ackedMessages map[string]bool
 
+	// Records nacked ack IDs in order
+	nackedMessages []string
+
 	// For controlling behavior
 	receiveDelay time.Duration
+	receiveLimit int // if set, caps each batch like a server cutting it short
 	receiveErr   error
 	ackErr       error
+	ackErrFor    func(ackIDs []string) error // if set, called on every Ack
 }
 
 func newMockClient() *mockClient {
@@ -37,16 +47,36 @@ func newMockClient() *mockClient {
 }
 
 func (m *mockClient) Receive(ctx context.Context, consumerGroupID string, params *ReceiveParams) ([]Message, error) {
+	if m.receiveDelay > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(m.receiveDelay):
+		}
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	m.receiveCount++
 	if params != nil {
 		m.receiveBatchSizes = append(m.receiveBatchSizes, params.MaxBatchSize)
+		m.receiveParams = append(m.receiveParams, *params)
+	}
+
+	if m.receiveErr != nil {
+		return nil, m.receiveErr
 	}
 
-	// Return no more messages after all messages have been delivered
+	// Return no more messages after all messages have been delivered, after
+	// a short wait standing in for the server's long poll
 	if m.messageIdx >= len(m.messages) {
+		m.mu.Unlock()
+		defer m.mu.Lock()
+		select {
+		case <-ctx.Done():
+		case <-time.After(emptyReceiveDelay):
+		}
 		return nil, nil
 	}
 
@@ -55,6 +85,9 @@ func (m *mockClient) Receive(ctx context.Context, consumerGroupID string, params
 	if params != nil && params.MaxBatchSize > 0 {
 		batchSize = params.MaxBatchSize
 	}
+	if m.receiveLimit > 0 && batchSize > m.receiveLimit {
+		batchSize = m.receiveLimit
+	}
 
 	// Calculate end index
 	end := m.messageIdx + batchSize
@@ -74,6 +107,11 @@ func (m *mockClient) Ack(ctx context.Context, consumerGroupID string, ackIDs []s
 	if m.ackErr != nil {
 		return m.ackErr
 	}
+	if m.ackErrFor != nil {
+		if err := m.ackErrFor(ackIDs); err != nil {
+			return err
+		}
+	}
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -177,8 +215,43 @@ func (t *testProcessorFunc) processedMessages() [][]Message {
 // Ensure mockClient implements SequinClient interface
 var _ SequinClient = (*mockClient)(nil)
 
-// Add Nack method to satisfy interface
 func (m *mockClient) Nack(ctx context.Context, consumerGroupID string, ackIDs []string) error {
-	// Implementation for tests if needed
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nackedMessages = append(m.nackedMessages, ackIDs...)
 	return nil
 }
+
+func (m *mockClient) nacked() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.nackedMessages...)
+}
+
+// groupedMockClient routes calls to a separate mockClient per consumer group
+type groupedMockClient struct {
+	groups map[string]*mockClient
+}
+
+func newGroupedMockClient(groups ...string) *groupedMockClient {
+	c := &groupedMockClient{groups: make(map[string]*mockClient)}
+	for _, group := range groups {
+		c.groups[group] = newMockClient()
+	}
+	return c
+}
+
+func (c *groupedMockClient) Receive(ctx context.Context, consumerGroupID string, params *ReceiveParams) ([]Message, error) {
+	return c.groups[consumerGroupID].Receive(ctx, consumerGroupID, params)
+}
+
+func (c *groupedMockClient) Ack(ctx context.Context, consumerGroupID string, ackIDs []string) error {
+	return c.groups[consumerGroupID].Ack(ctx, consumerGroupID, ackIDs)
+}
+
+func (c *groupedMockClient) Nack(ctx context.Context, consumerGroupID string, ackIDs []string) error {
+	return c.groups[consumerGroupID].Nack(ctx, consumerGroupID, ackIDs)
+}
+
+var _ SequinClient = (*groupedMockClient)(nil)
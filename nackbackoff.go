@@ -0,0 +1,59 @@
+package sequin
+
+import (
+	"sync"
+	"time"
+)
+
+// maxTrackedFailures bounds how many failing messages a nackBackoff tracks.
+const maxTrackedFailures = 10000
+
+// nackBackoff grows the nack delay of messages that keep failing. Sequin
+// doesn't report how often a message was delivered, so consecutive
+// failures are counted by idempotency key in the processor, and start over
+// when it restarts.
+type nackBackoff struct {
+	base, max time.Duration
+
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+func newNackBackoff(base, max time.Duration) *nackBackoff {
+	return &nackBackoff{base: base, max: max, failures: make(map[string]int)}
+}
+
+// delay records a failure of msg and returns how long its redelivery
+// should be delayed.
+func (b *nackBackoff) delay(msg Message) time.Duration {
+	key := msg.Metadata.IdempotencyKey
+	if key == "" {
+		return b.base
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, ok := b.failures[key]
+	if !ok && len(b.failures) >= maxTrackedFailures {
+		// Forget an arbitrary message to bound memory
+		for k := range b.failures {
+			delete(b.failures, k)
+			break
+		}
+	}
+	n++
+	b.failures[key] = n
+	return backoff(b.base, b.max, 0, n)
+}
+
+// forget clears the failures of msgs, which were settled.
+func (b *nackBackoff) forget(msgs []Message) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, msg := range msgs {
+		delete(b.failures, msg.Metadata.IdempotencyKey)
+	}
+}
@@ -0,0 +1,87 @@
+package sequin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// delayedNacks holds messages until their redelivery delay has passed, then
+// nacks them. Sequin redelivers nacked messages right away, so the delays
+// of NackDelay and DeferUntil are kept by the processor. Messages still
+// held when the run ends are left for redelivery after their visibility
+// timeout.
+type delayedNacks struct {
+	mu      sync.Mutex
+	pending map[*time.Timer]struct{}
+	stopped bool
+	sending sync.WaitGroup
+}
+
+func newDelayedNacks() *delayedNacks {
+	return &delayedNacks{pending: make(map[*time.Timer]struct{})}
+}
+
+// after calls nack once delay has passed, unless stop is called first.
+func (d *delayedNacks) after(delay time.Duration, nack func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(delay, func() {
+		d.mu.Lock()
+		if _, ok := d.pending[t]; !ok {
+			d.mu.Unlock()
+			return
+		}
+		delete(d.pending, t)
+		d.sending.Add(1)
+		d.mu.Unlock()
+		defer d.sending.Done()
+		nack()
+	})
+	d.pending[t] = struct{}{}
+}
+
+// stop drops the messages still held and waits for nacks being sent.
+func (d *delayedNacks) stop() {
+	d.mu.Lock()
+	d.stopped = true
+	for t := range d.pending {
+		t.Stop()
+	}
+	d.pending = nil
+	d.mu.Unlock()
+	d.sending.Wait()
+}
+
+// nackAfter nacks msgs once the delay returned for each has passed, in one
+// request per distinct delay. Failures are reported as failures to do what.
+func (p *Processor) nackAfter(ctx context.Context, consumerGroup string, msgs []Message, delay func(Message) time.Duration, what string) {
+	ctx = detach(ctx)
+	nack := func(msgs []Message) {
+		err := p.client.Nack(ctx, consumerGroup, ackIDsOf(msgs))
+		p.stats.nack(len(msgs), err)
+		p.notFound.observe(consumerGroup, err)
+		if err != nil {
+			p.reportError(ctx, consumerGroup, msgs, fmt.Errorf("%s: %w", what, err))
+		}
+	}
+
+	byDelay := make(map[time.Duration][]Message)
+	var delays []time.Duration
+	for _, msg := range msgs {
+		d := delay(msg)
+		if _, ok := byDelay[d]; !ok {
+			delays = append(delays, d)
+		}
+		byDelay[d] = append(byDelay[d], msg)
+	}
+	for _, d := range delays {
+		group := byDelay[d]
+		p.delays.after(d, func() { nack(group) })
+	}
+}
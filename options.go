@@ -0,0 +1,106 @@
+package sequin
+
+import (
+	"net/http"
+	"time"
+)
+
+// Option configures a Client created with New.
+type Option func(*ClientOptions)
+
+// New creates a new Sequin client configured by opts, e.g.
+//
+//	client := sequin.New(sequin.WithToken(token), sequin.WithTimeout(time.Minute))
+//
+// It is equivalent to NewClient with the corresponding ClientOptions.
+func New(opts ...Option) *Client {
+	var o ClientOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return NewClient(&o)
+}
+
+// WithToken sets ClientOptions.Token.
+func WithToken(token string) Option {
+	return func(o *ClientOptions) { o.Token = token }
+}
+
+// WithBaseURL sets ClientOptions.BaseURL.
+func WithBaseURL(baseURL string) Option {
+	return func(o *ClientOptions) { o.BaseURL = baseURL }
+}
+
+// WithHTTPClient sets ClientOptions.HTTPClient.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(o *ClientOptions) { o.HTTPClient = httpClient }
+}
+
+// WithTimeout sets ClientOptions.Timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *ClientOptions) { o.Timeout = timeout }
+}
+
+// WithOptions applies every field of opts, as a way to reach settings that
+// have no dedicated Option. It replaces options applied before it.
+func WithOptions(opts ClientOptions) Option {
+	return func(o *ClientOptions) { *o = opts }
+}
+
+// With returns a copy of c with the Token, TokenProvider, BaseURL,
+// PathPrefix, HTTPClient or Timeout set by opts overridden, e.g. for
+// per-tenant or per-environment clients. Other options are ignored. The
+// copy shares c's connection pool unless HTTPClient is overridden, and
+// keeps c's retry, interceptor and other settings.
+//
+// A copy with a different BaseURL tracks its own ConnectivityState and
+// circuit breaker, and does not fail over to FallbackBaseURLs.
+func (c *Client) With(opts ...Option) *Client {
+	var o ClientOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	clone := *c
+	if o.Token != "" {
+		clone.tokens = StaticToken(o.Token)
+	}
+	if o.TokenProvider != nil {
+		clone.tokens = o.TokenProvider
+	}
+
+	if o.BaseURL != "" || o.PathPrefix != "" {
+		if o.BaseURL != "" {
+			clone.rawBaseURL = o.BaseURL
+		}
+		if o.PathPrefix != "" {
+			clone.pathPrefix = o.PathPrefix
+		}
+		clone.baseURL = joinBaseURL(clone.rawBaseURL, clone.pathPrefix)
+		if clone.baseURL != c.baseURL {
+			clone.connectivity = &connectivity{
+				downAfter: c.connectivity.downAfter,
+				onChange:  c.connectivity.onChange,
+			}
+			if c.breaker != nil {
+				clone.breaker = &breaker{opts: c.breaker.opts}
+			}
+			clone.endpoints = nil
+		}
+	}
+
+	if o.HTTPClient != nil || o.Timeout != 0 {
+		httpClient := o.HTTPClient
+		if httpClient == nil {
+			// Shallow-copy the http.Client to share its Transport
+			hc := *c.httpClient
+			hc.Timeout = o.Timeout
+			httpClient = &hc
+		} else {
+			clone.conns = newConnStats(c.conns.onConnection)
+		}
+		clone.httpClient = httpClient
+		clone.roundTrip = c.middleware(httpClient.Do)
+	}
+	return &clone
+}
@@ -0,0 +1,106 @@
+package sequin
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"sync"
+)
+
+// RecordKey is the default OrderingKey for PartitionByKey: the message's
+// schema-qualified table and the "id" column of its record. Messages whose
+// record has no "id" column are keyed by their ack ID, so they are not
+// ordered relative to each other.
+func RecordKey(msg Message) string {
+	var record struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(msg.Record, &record); err != nil || len(record.ID) == 0 {
+		return "ack:" + msg.AckID
+	}
+	table := msg.Metadata.TableName
+	if msg.Metadata.TableSchema != "" {
+		table = msg.Metadata.TableSchema + "." + table
+	}
+	return table + ":" + string(record.ID)
+}
+
+// partition splits batch into MaxConcurrent sub-batches by the hash of
+// each message's OrderingKey, keeping messages in the order received within
+// each sub-batch. Messages sharing a key always land in the same partition.
+// Some partitions may be empty.
+func (p *Processor) partition(batch []Message) [][]Message {
+	parts := make([][]Message, p.maxConcurrent())
+	for _, msg := range batch {
+		i := partitionOf(p.opts.OrderingKey(msg), len(parts))
+		parts[i] = append(parts[i], msg)
+	}
+	return parts
+}
+
+// partitionOf returns the partition, out of n, that key belongs to.
+func partitionOf(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+type partitionContextKey struct{}
+
+// PartitionFromContext returns the partition, between 0 and MaxConcurrent-1,
+// of the batch being handled under ctx. ok is false unless the Processor
+// partitions batches by key.
+func PartitionFromContext(ctx context.Context) (partition int, ok bool) {
+	partition, ok = ctx.Value(partitionContextKey{}).(int)
+	return partition, ok
+}
+
+// stickyWorkers are the long-lived workers of StickyPartitions, one per
+// partition, each handling its partition's batches in turn.
+type stickyWorkers struct {
+	queues []chan stickyBatch
+	wg     sync.WaitGroup
+}
+
+type stickyBatch struct {
+	consumerGroup string
+	msgs          []Message
+}
+
+// startWorkers starts a worker per partition. Batches are handled under
+// ctx, which should outlive the processing loop so that queued batches
+// still complete during shutdown.
+func (p *Processor) startWorkers(ctx context.Context) *stickyWorkers {
+	w := &stickyWorkers{queues: make([]chan stickyBatch, p.maxConcurrent())}
+	for i := range w.queues {
+		queue := make(chan stickyBatch)
+		w.queues[i] = queue
+		workerCtx := context.WithValue(ctx, partitionContextKey{}, i)
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for b := range queue {
+				p.handleBatch(workerCtx, b.consumerGroup, b.msgs)
+			}
+		}()
+	}
+	return w
+}
+
+// send queues the sub-batch of partition i for its worker.
+func (w *stickyWorkers) send(ctx context.Context, i int, b stickyBatch) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case w.queues[i] <- b:
+		return nil
+	}
+}
+
+// stop waits for the workers to finish their batches.
+func (w *stickyWorkers) stop() {
+	for _, queue := range w.queues {
+		close(queue)
+	}
+	w.wg.Wait()
+}
@@ -0,0 +1,52 @@
+package sequin
+
+import "context"
+
+// Pause stops the processor from receiving messages until Resume is called,
+// e.g. while a downstream database is being migrated, without ending Run.
+// Batches already received are still handled and settled, and messages in
+// the prefetch buffer are still processed; a receive that is already
+// waiting for messages completes. Pause also holds across runs, and has no
+// effect on a paused processor.
+func (p *Processor) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed == nil {
+		p.resumed = make(chan struct{})
+		p.opts.Logger.Info("Paused processor")
+	}
+}
+
+// Resume lets a paused processor receive messages again.
+func (p *Processor) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed != nil {
+		close(p.resumed)
+		p.resumed = nil
+		p.opts.Logger.Info("Resumed processor")
+	}
+}
+
+// Paused reports whether the processor is paused.
+func (p *Processor) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resumed != nil
+}
+
+// waitResumed waits while the processor is paused.
+func (p *Processor) waitResumed(ctx context.Context) error {
+	p.mu.Lock()
+	resumed := p.resumed
+	p.mu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-resumed:
+		return nil
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"net/http"
+	"sync"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
@@ -15,6 +17,9 @@ import (
 //
 // If an error is returned, none of the messages in the batch will be acknowledged
 // and they will be redelivered after the visibility timeout.
+//
+// Return a *BatchResult instead to report that only some messages of the
+// batch failed; the others are then acknowledged.
 type ProcessorFunc func(context.Context, []Message) error
 
 // PrefetchingOptions configures message prefetching behavior.
@@ -22,12 +27,72 @@ type PrefetchingOptions struct {
 	// BufferSize determines how many messages to prefetch.
 	// Must be > 0.
 	BufferSize int
+
+	// MaxBufferBytes optionally bounds the total size of the records held in
+	// the prefetch buffer, in bytes. Prefetching pauses while the buffer is at
+	// its byte budget, even if it holds fewer than BufferSize messages.
+	// A single record larger than the budget is still buffered on its own.
+	// If zero, the buffer is bounded only by BufferSize.
+	MaxBufferBytes int64
+
+	// SpillPath optionally names a file where messages still in the buffer
+	// are saved when Run returns. The next Run restores them before fetching
+	// new messages, so expensive work isn't repeated after a restart. Messages
+	// received longer than SpillTTL ago are discarded on restore, since their
+	// ack IDs will have expired and Sequin redelivers them anyway.
+	SpillPath string
+
+	// SpillTTL is how long spilled messages remain valid, and should match the
+	// consumer group's visibility timeout. Defaults to 30s.
+	SpillTTL time.Duration
+
+	// DiskQueue optionally adds a disk-backed queue in front of the buffer,
+	// so far more messages can be prefetched than fit in memory. BufferSize
+	// and MaxBufferBytes then bound only the in-memory part.
+	DiskQueue *DiskQueueOptions
+
+	// AutoSize optionally adjusts the buffer size between a minimum and
+	// BufferSize, growing it while handlers keep up with a backlog and
+	// shrinking it when handler latency rises. If nil, the buffer always
+	// holds up to BufferSize messages.
+	AutoSize *BufferAutoSizeOptions
+
+	// FlushInterval optionally makes a batch wait up to this long, from its
+	// first message, for more messages before it is dispatched partly
+	// filled. This trades a bounded delay for fuller batches on
+	// low-throughput streams. If zero, a batch takes only the messages
+	// already buffered.
+	FlushInterval time.Duration
 }
 
 func (o *PrefetchingOptions) validate() error {
 	if o.BufferSize <= 0 {
 		return fmt.Errorf("BufferSize must be > 0, got %d", o.BufferSize)
 	}
+	if o.MaxBufferBytes < 0 {
+		return fmt.Errorf("MaxBufferBytes must be >= 0, got %d", o.MaxBufferBytes)
+	}
+	if o.SpillTTL < 0 {
+		return fmt.Errorf("SpillTTL must be >= 0, got %v", o.SpillTTL)
+	}
+	if o.SpillTTL == 0 {
+		o.SpillTTL = 30 * time.Second
+	}
+	if o.DiskQueue != nil {
+		if err := o.DiskQueue.validate(); err != nil {
+			return fmt.Errorf("invalid disk queue options: %w", err)
+		}
+	}
+	if o.AutoSize != nil {
+		autoSize := *o.AutoSize
+		if err := autoSize.validate(o.BufferSize); err != nil {
+			return fmt.Errorf("invalid auto-size options: %w", err)
+		}
+		o.AutoSize = &autoSize
+	}
+	if o.FlushInterval < 0 {
+		return fmt.Errorf("FlushInterval must be >= 0, got %v", o.FlushInterval)
+	}
 	return nil
 }
 
@@ -47,13 +112,224 @@ type ProcessorOptions struct {
 	// If zero, defaults to 1.
 	MaxConcurrent int
 
+	// Autoscale optionally adjusts concurrency between its MinConcurrent
+	// and MaxConcurrent, based on the backlog and handler latency, instead
+	// of always running up to MaxConcurrent batches. It can't be combined
+	// with StickyPartitions.
+	Autoscale *AutoscaleOptions
+
+	// IdleBackoff optionally waits between receives that return no
+	// messages, backing off exponentially while a consumer group stays
+	// empty, for servers that answer receives immediately instead of long
+	// polling. If nil, the processor receives again right away.
+	IdleBackoff *IdleBackoffOptions
+
+	// MaxInFlight optionally caps the number of messages received but not
+	// yet settled, across the prefetch buffer and all concurrent batches.
+	// Receives request no more messages than the cap leaves room for, and
+	// wait while it is reached. Use it to bound memory and the consumer
+	// group's pending messages whatever the batch and concurrency settings.
+	// If zero, the number in flight is bounded only by those settings.
+	MaxInFlight int
+
 	// Prefetching configures message prefetching behavior.
 	// If nil, messages are processed immediately as they arrive.
 	Prefetching *PrefetchingOptions
 
 	// ErrorHandler is called when message processing fails.
-	// If nil, errors are logged to stderr.
+	// If nil, errors are logged to Logger.
 	ErrorHandler func(context.Context, []Message, error)
+
+	// AckErrorHandler is called instead of ErrorHandler when a batch was
+	// processed successfully but acknowledging it failed, with the ack IDs
+	// that could not be acknowledged. The messages may be redelivered, so
+	// this is the place to record "processed but possibly redelivered"
+	// events for reconciliation.
+	// If nil, ack failures are reported to ErrorHandler.
+	AckErrorHandler func(ctx context.Context, ackIDs []string, err error)
+
+	// OnCaughtUp is called once, after the processor has drained the backlog
+	// of its consumer group (such as an initial table backfill) and every
+	// fetched message has been processed. Use it to switch into live serving
+	// mode, e.g. to start serving reads from a cache the backfill populated.
+	// The processor keeps consuming live changes after the callback.
+	OnCaughtUp func(context.Context)
+
+	// GroupByTransaction invokes the handler once per source transaction
+	// (messages sharing a commit LSN) instead of once per batch, and acks each
+	// group as soon as it succeeds. This lets sinks apply multi-row changes
+	// atomically. A transaction at the end of a full receive is held until
+	// the next receive shows where it ends, so each handler call gets a
+	// whole transaction, even one larger than MaxBatchSize. Only
+	// transactions of MaxInFlight messages or more, which can't be held
+	// while receiving the rest, and transactions cut short by a partial
+	// receive are split across handler calls.
+	GroupByTransaction bool
+
+	// Limiter optionally shares a concurrency (and rate) budget with other
+	// processors. Batches must acquire both a slot from MaxConcurrent and
+	// from the Limiter before the handler is invoked.
+	Limiter *Limiter
+
+	// DeferUntil optionally derives, from a message's record, the earliest
+	// time it should be processed. Messages whose time is still in the future
+	// are withheld from the handler and held by the processor until that
+	// time, then nacked so Sequin redelivers them once they are due.
+	// Messages still held when Run returns, or whose visibility timeout
+	// expires first, are redelivered and checked again. This enables simple
+	// delayed-action workflows on top of change events. A zero time means
+	// the message is due immediately.
+	DeferUntil func(Message) time.Time
+
+	// Checkpoint is called by RunUntilEmpty after it drains the backlog, to
+	// persist a completion marker for scheduled catch-up runs. An error from
+	// Checkpoint is returned by RunUntilEmpty.
+	Checkpoint func(context.Context, CatchUpResult) error
+
+	// CatchUpInterval is how often RunUntilEmpty is scheduled. If set,
+	// RunUntilEmpty logs a warning when its result is FallingBehind the
+	// interval, so a backlog that outgrows the schedule doesn't go
+	// unnoticed.
+	CatchUpInterval time.Duration
+
+	// OnConsumerGroupNotFound is called when the server keeps reporting that
+	// a consumer group no longer exists, e.g. because it was deleted mid-run.
+	// Receives, acks and nacks all count towards it.
+	// Return nil after recreating the consumer group to keep processing, or
+	// an error to stop.
+	//
+	// If nil, Run stops and returns an error wrapping ErrConsumerGroupNotFound.
+	OnConsumerGroupNotFound func(ctx context.Context, consumerGroup string) error
+
+	// NackDelay makes the processor nack batches whose handler fails, so
+	// they are redelivered after this delay rather than once their
+	// visibility timeout expires. The processor holds them for the delay
+	// before nacking them; messages still held when Run returns, or whose
+	// visibility timeout expires first, are redelivered after the visibility
+	// timeout instead. If zero, failed batches are left to the visibility
+	// timeout.
+	NackDelay time.Duration
+
+	// MaxNackDelay makes NackDelay grow for messages that keep failing: it
+	// doubles with each consecutive failure of a message, up to
+	// MaxNackDelay, so a poison message backs off to minutes instead of
+	// being redelivered every NackDelay. Sequin doesn't report delivery
+	// attempts, so the processor counts failures by
+	// Metadata.IdempotencyKey, and starts over when it restarts. Requires
+	// NackDelay.
+	MaxNackDelay time.Duration
+
+	// NackOnError makes the processor nack batches whose handler fails, so
+	// they are redelivered immediately rather than once their visibility
+	// timeout expires. Setting NackDelay implies it.
+	NackOnError bool
+
+	// NackOnShutdown makes the processor nack, as Run returns, the messages
+	// still in the prefetch buffer and the batches that never started, so
+	// another instance can receive them immediately rather than once their
+	// visibility timeout expires. Stop always does this. It can't be
+	// combined with Prefetching.SpillPath, which saves those messages for
+	// the next run instead.
+	NackOnShutdown bool
+
+	// Retry optionally retries batches whose handler fails, in the
+	// processor, before the failure is reported and the batch is left for
+	// redelivery. Use it for transient failures such as a database
+	// failover. Only the failed messages of a *BatchResult are retried.
+	Retry *HandlerRetryOptions
+
+	// DeadLetter is optionally called with the messages of a batch whose
+	// handler failed, once Retry is exhausted, and the handler's error. It
+	// should store them elsewhere, e.g. in a dead-letter table or queue, for
+	// later inspection. If it returns nil, the messages are acknowledged so
+	// they no longer hold up the consumer group; otherwise they fail as if
+	// DeadLetter were nil.
+	DeadLetter func(ctx context.Context, msgs []Message, err error) error
+
+	// AckPolicy determines when batches are acknowledged. Defaults to
+	// AckOnSuccess. With Manual, the handler acknowledges messages itself
+	// through AckerFromContext.
+	AckPolicy AckPolicy
+
+	// AckCoalescing acknowledges processed batches in the background,
+	// merging the ack IDs of many batches into fewer, larger Ack calls to
+	// cut HTTP round-trips for high-throughput consumers. Acks still queued
+	// when Run returns are sent first, and acks made after that are sent
+	// directly. Failed acks are reported to AckErrorHandler, or
+	// ErrorHandler without messages.
+	// If nil, each batch is acknowledged as soon as it is processed.
+	AckCoalescing *AckCoalescingOptions
+
+	// FailFast makes Run check its configuration on startup instead of
+	// reporting and retrying: if the client is a Pinger, it first checks
+	// that BaseURL reaches a running server, and it returns the error if
+	// the first Receive of a consumer group fails with ErrUnauthorized or
+	// ErrConsumerGroupNotFound, e.g. because of a wrong Token or consumer
+	// group name.
+	FailFast bool
+
+	// OnMessageLatency is called for each successfully handled message with
+	// its end-to-end latency: the time from the source transaction's commit
+	// (Metadata.CommitTimestamp) to the handler returning. Use it to feed a
+	// latency histogram for SLOs. Messages without a commit timestamp are
+	// skipped. Optional.
+	OnMessageLatency func(ctx context.Context, msg Message, latency time.Duration)
+
+	// OrderingKey optionally derives a key, such as a primary key, from each
+	// message. Messages from the same consumer group that share a key are
+	// handled in the order they were received: a batch does not start while
+	// an earlier batch holding one of its keys is still in flight. Batches
+	// without conflicting keys still run concurrently.
+	OrderingKey func(Message) string
+
+	// PartitionByKey splits every fetched batch into up to MaxConcurrent
+	// sub-batches by the hash of each message's OrderingKey, which defaults
+	// to RecordKey. The sub-batches run concurrently, while updates to the
+	// same row stay in order, both within a batch and across batches.
+	// It can't be combined with GroupByTransaction, since a transaction's
+	// changes may span partitions.
+	PartitionByKey bool
+
+	// StickyPartitions runs each partition of PartitionByKey, which it
+	// implies, on its own long-lived worker for the life of the Processor,
+	// so a key is always handled by the same worker and per-entity state
+	// kept by the handler, keyed by PartitionFromContext, needs no locking.
+	// A worker handles its partition's batches one at a time.
+	StickyPartitions bool
+
+	// CompactBatches collapses the messages of a batch that share an
+	// OrderingKey, by default RecordKey, into the latest one before the
+	// handler runs, for upsert-style sinks that only need a row's final
+	// state. The latest message's Changes are merged to hold the oldest
+	// previous value of each changed column. Collapsed messages are
+	// settled with the message they were collapsed into: acknowledged when
+	// it succeeds, and failed with it when a *BatchResult fails it. It
+	// can't be combined with the Manual AckPolicy.
+	CompactBatches bool
+
+	// DryRun nacks messages after the handler succeeds instead of
+	// acknowledging them, so a new consumer version can be validated against
+	// production traffic without consuming it: nacked messages are
+	// immediately available for redelivery to other consumers. Every
+	// dry-run batch is logged.
+	DryRun bool
+
+	// Shadow optionally runs a second handler on the same batches as the
+	// primary one, e.g. to canary a rewritten handler against live traffic.
+	// It runs concurrently with the handler; its errors (and panics) are
+	// reported to ShadowErrorHandler and never affect acknowledgement. A
+	// batch's concurrency slot is held until its shadow run finishes.
+	Shadow ProcessorFunc
+
+	// ShadowErrorHandler is called when the Shadow handler fails.
+	// If nil, shadow errors are logged to Logger.
+	ShadowErrorHandler func(context.Context, []Message, error)
+
+	// Logger receives errors not handled by ErrorHandler and batch
+	// lifecycle events at Debug level, with consumer group and batch size
+	// fields. A *slog.Logger can be used directly.
+	// If nil, events at Info level and above are written with the log package.
+	Logger Logger
 }
 
 // validate checks ProcessorOptions and applies defaults.
@@ -79,15 +355,103 @@ func (o *ProcessorOptions) validate() error {
 		o.MaxConcurrent = 1
 	}
 
+	if o.Autoscale != nil {
+		autoscale := *o.Autoscale
+		if err := autoscale.validate(o.MaxConcurrent); err != nil {
+			return fmt.Errorf("invalid autoscale options: %w", err)
+		}
+		o.Autoscale = &autoscale
+	}
+
+	if o.IdleBackoff != nil {
+		idle := *o.IdleBackoff
+		if err := idle.validate(); err != nil {
+			return fmt.Errorf("invalid idle backoff options: %w", err)
+		}
+		o.IdleBackoff = &idle
+	}
+
+	if o.MaxInFlight < 0 {
+		return fmt.Errorf("MaxInFlight must be >= 0, got %d", o.MaxInFlight)
+	}
+
+	if o.AckCoalescing != nil {
+		acks := *o.AckCoalescing
+		if err := acks.validate(); err != nil {
+			return fmt.Errorf("invalid ack coalescing options: %w", err)
+		}
+		o.AckCoalescing = &acks
+	}
+
+	if o.Retry != nil {
+		retry := *o.Retry
+		if err := retry.validate(); err != nil {
+			return fmt.Errorf("invalid retry options: %w", err)
+		}
+		o.Retry = &retry
+	}
+
+	if o.NackDelay < 0 {
+		return fmt.Errorf("NackDelay must be >= 0, got %v", o.NackDelay)
+	}
+	if o.CatchUpInterval < 0 {
+		return fmt.Errorf("CatchUpInterval must be >= 0, got %v", o.CatchUpInterval)
+	}
+	if o.MaxNackDelay != 0 && (o.NackDelay == 0 || o.MaxNackDelay < o.NackDelay) {
+		return fmt.Errorf("MaxNackDelay must be >= NackDelay (%v), got %v", o.NackDelay, o.MaxNackDelay)
+	}
+
+	switch o.AckPolicy {
+	case AckOnSuccess:
+	case AlwaysAck, Manual:
+		if o.DeadLetter != nil {
+			return fmt.Errorf("DeadLetter can't be used with the %v AckPolicy", o.AckPolicy)
+		}
+		if o.NackOnError || o.NackDelay > 0 {
+			return fmt.Errorf("NackOnError and NackDelay can't be used with the %v AckPolicy", o.AckPolicy)
+		}
+		if o.DryRun {
+			return fmt.Errorf("DryRun can't be used with the %v AckPolicy", o.AckPolicy)
+		}
+	default:
+		return fmt.Errorf("unknown AckPolicy %d", o.AckPolicy)
+	}
+	if o.CompactBatches && o.AckPolicy == Manual {
+		return fmt.Errorf("CompactBatches can't be used with the %v AckPolicy", o.AckPolicy)
+	}
+
+	if o.StickyPartitions {
+		if o.Autoscale != nil {
+			return errors.New("StickyPartitions can't be used with Autoscale")
+		}
+		o.PartitionByKey = true
+	}
+	if o.PartitionByKey {
+		if o.GroupByTransaction {
+			return errors.New("PartitionByKey can't be used with GroupByTransaction")
+		}
+		if o.OrderingKey == nil {
+			o.OrderingKey = RecordKey
+		}
+	}
+
 	if o.Prefetching != nil {
 		if err := o.Prefetching.validate(); err != nil {
 			return fmt.Errorf("invalid prefetching options: %w", err)
 		}
+		if o.NackOnShutdown && o.Prefetching.SpillPath != "" {
+			return errors.New("NackOnShutdown can't be used with SpillPath")
+		}
 	}
 
-	if o.ErrorHandler == nil {
-		o.ErrorHandler = func(_ context.Context, msgs []Message, err error) {
-			log.Printf("Error processing batch of %d messages: %v", len(msgs), err)
+	if o.Logger == nil {
+		o.Logger = stdLogger{}
+	}
+
+	if o.Shadow != nil && o.ShadowErrorHandler == nil {
+		logger := o.Logger
+		o.ShadowErrorHandler = func(_ context.Context, msgs []Message, err error) {
+			logger.Error("Shadow handler failed", "batch_size", len(msgs), "error", err)
 		}
 	}
 
@@ -99,16 +463,88 @@ type Processor struct {
 	consumerGroup string
 	handler       ProcessorFunc
 	opts          ProcessorOptions
-	msgBuffer     chan Message
+	lanes         []*lane
+	buffered      chan struct{}       // one token per message buffered across lanes
+	bufferBytes   *semaphore.Weighted // nil unless MaxBufferBytes is set
+	inFlight      *semaphore.Weighted // nil unless MaxInFlight is set
+	scaler        *autoscaler         // nil unless Autoscale is set
+	sizer         *bufferSizer        // nil unless Prefetching.AutoSize is set
+	nackBackoff   *nackBackoff        // nil unless MaxNackDelay is set
+	backlog       *backlog
+	notFound      *notFoundCounter
+	untilEmpty    bool           // set for RunUntilEmpty
+	roundRobin    bool           // take batches from lanes in turn instead of by priority
+	nextLane      int            // lane to try first, advanced in round-robin mode
+	keys          *keyLocks      // nil unless OrderingKey is set
+	acks          *ackCoalescer  // nil unless AckCoalescing is set
+	delays        *delayedNacks  // messages held for NackDelay and DeferUntil
+	workers       *stickyWorkers // nil unless StickyPartitions is set
+
+	halted context.Context // cancelled when a Stop's grace period ends
+	live   liveOptions
+	stats  processorStats
+
+	mu      sync.Mutex
+	running *runStop      // nil unless Run is running
+	resumed chan struct{} // non-nil while paused, closed by Resume
+	slots   *batchSlots   // of the running processing loop
+}
+
+// lane is a consumer group feeding the prefetch buffer.
+type lane struct {
+	consumerGroup string
+	buffer        chan bufferedMessage
+	disk          *diskQueue // nil unless Prefetching.DiskQueue is set
+}
+
+// bufferedMessage is a prefetched message waiting for a batch.
+type bufferedMessage struct {
+	msg        Message
+	receivedAt time.Time
+	txEnd      bool // last buffered message of its transaction, for GroupByTransaction
 }
 
 func NewProcessor(client SequinClient, consumerGroup string, handler ProcessorFunc, opts ProcessorOptions) (*Processor, error) {
-	if client == nil {
-		return nil, errors.New("client cannot be nil")
-	}
 	if consumerGroup == "" {
 		return nil, errors.New("consumer group cannot be empty")
 	}
+	return newProcessor(client, []string{consumerGroup}, handler, opts)
+}
+
+// NewPriorityProcessor creates a processor that feeds one handler from
+// several consumer groups in priority order, highest priority first.
+//
+// Each consumer group is prefetched into its own buffer, and batches are
+// always taken from the highest-priority buffer that has messages. This lets
+// urgent change streams jump ahead of bulk traffic sharing the same workers.
+// Prefetching is required. A batch only ever contains messages from a single
+// consumer group.
+func NewPriorityProcessor(client SequinClient, consumerGroups []string, handler ProcessorFunc, opts ProcessorOptions) (*Processor, error) {
+	if err := validateConsumerGroups(consumerGroups); err != nil {
+		return nil, err
+	}
+	if opts.Prefetching == nil {
+		return nil, errors.New("priority processing requires Prefetching")
+	}
+	return newProcessor(client, consumerGroups, handler, opts)
+}
+
+func validateConsumerGroups(consumerGroups []string) error {
+	if len(consumerGroups) == 0 {
+		return errors.New("consumer groups cannot be empty")
+	}
+	for _, group := range consumerGroups {
+		if group == "" {
+			return errors.New("consumer group cannot be empty")
+		}
+	}
+	return nil
+}
+
+func newProcessor(client SequinClient, consumerGroups []string, handler ProcessorFunc, opts ProcessorOptions) (*Processor, error) {
+	if client == nil {
+		return nil, errors.New("client cannot be nil")
+	}
 	if handler == nil {
 		return nil, errors.New("handler cannot be nil")
 	}
@@ -118,27 +554,135 @@ func NewProcessor(client SequinClient, consumerGroup string, handler ProcessorFu
 
 	p := &Processor{
 		client:        client,
-		consumerGroup: consumerGroup,
+		consumerGroup: consumerGroups[0],
 		handler:       handler,
 		opts:          opts,
+		notFound:      newNotFoundCounter(),
+	}
+	p.live.maxBatchSize.Store(int64(opts.MaxBatchSize))
+	p.live.fetchBatchSize.Store(int64(opts.FetchBatchSize))
+	p.live.maxConcurrent.Store(int64(opts.MaxConcurrent))
+
+	if opts.Autoscale != nil {
+		p.scaler = newAutoscaler(*opts.Autoscale, opts.MaxConcurrent, opts.Logger)
+	}
+	if opts.MaxNackDelay > 0 {
+		p.nackBackoff = newNackBackoff(opts.NackDelay, opts.MaxNackDelay)
+	}
+	if opts.MaxInFlight > 0 {
+		p.inFlight = semaphore.NewWeighted(int64(opts.MaxInFlight))
 	}
 
-	// Initialize message buffer if prefetching is enabled
+	// Sticky workers already handle each key's batches in order
+	if opts.OrderingKey != nil && !opts.StickyPartitions {
+		p.keys = newKeyLocks()
+	}
+
+	// Initialize message buffers if prefetching is enabled
 	if opts.Prefetching != nil {
-		p.msgBuffer = make(chan Message, opts.Prefetching.BufferSize)
+		for _, group := range consumerGroups {
+			p.lanes = append(p.lanes, &lane{
+				consumerGroup: group,
+				buffer:        make(chan bufferedMessage, opts.Prefetching.BufferSize),
+			})
+		}
+		p.buffered = make(chan struct{}, len(consumerGroups)*opts.Prefetching.BufferSize)
+		if opts.Prefetching.MaxBufferBytes > 0 {
+			p.bufferBytes = semaphore.NewWeighted(opts.Prefetching.MaxBufferBytes)
+		}
+		if opts.Prefetching.AutoSize != nil {
+			p.sizer = newBufferSizer(*opts.Prefetching.AutoSize, opts.Prefetching.BufferSize, len(consumerGroups), opts.Logger)
+		}
 	}
 
 	return p, nil
 }
 
+// Run processes messages until ctx is cancelled, waiting for new messages
+// whenever the consumer groups are drained. Use RunUntilEmpty to stop once
+// the backlog has been processed instead.
 func (p *Processor) Run(ctx context.Context) error {
+	return p.run(ctx, false)
+}
+
+// run processes messages until ctx is done. If untilEmpty is set, it also
+// returns once the processor has caught up with its consumer groups.
+func (p *Processor) run(ctx context.Context, untilEmpty bool) error {
+	runCtx := ctx
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	halted, finish := p.startRun(stop)
+	defer finish()
+	p.halted = halted
+
+	lanes := len(p.lanes)
+	if lanes == 0 {
+		lanes = 1
+	}
+	p.untilEmpty = untilEmpty
+	p.backlog = newBacklog(lanes, func() {
+		if p.opts.OnCaughtUp != nil {
+			p.opts.OnCaughtUp(runCtx)
+		}
+		if untilEmpty {
+			stop()
+		}
+	})
+
+	if pinger, ok := p.client.(Pinger); ok && p.opts.FailFast {
+		if err := pinger.Ping(ctx); err != nil {
+			return fmt.Errorf("pinging Sequin: %w", err)
+		}
+	}
+
+	// Disk queues are closed last, so that what is left in them is spilled
+	// or nacked with the rest of the buffer
+	if p.opts.Prefetching != nil && p.opts.Prefetching.DiskQueue != nil {
+		if err := p.openDiskQueues(); err != nil {
+			return fmt.Errorf("opening disk queue: %w", err)
+		}
+		defer p.closeDiskQueues(runCtx)
+	}
+
+	if p.opts.Prefetching != nil && p.opts.Prefetching.SpillPath != "" {
+		p.restore(ctx)
+		defer p.spill(runCtx)
+	}
+
+	p.delays = newDelayedNacks()
+	defer p.delays.stop()
+
+	if p.opts.AckCoalescing != nil {
+		p.acks = newAckCoalescer(p, *p.opts.AckCoalescing)
+		go p.acks.run(runCtx)
+		defer p.acks.stop()
+	}
+
+	if p.sizer != nil {
+		go p.sizer.run(ctx)
+	}
+
+	if p.opts.StickyPartitions {
+		p.workers = p.startWorkers(runCtx)
+		defer p.workers.stop()
+	}
+
 	g, ctx := errgroup.WithContext(ctx)
 
 	if p.opts.Prefetching != nil {
 		// With prefetching: separate fetcher and processor goroutines
-		g.Go(func() error {
-			return p.fetch(ctx)
-		})
+		for i, l := range p.lanes {
+			i, l := i, l
+			g.Go(func() error {
+				return p.fetch(ctx, i, l)
+			})
+			if l.disk != nil {
+				g.Go(func() error {
+					return p.feed(ctx, l)
+				})
+			}
+		}
 		g.Go(func() error {
 			return p.processFromBuffer(ctx)
 		})
@@ -149,158 +693,1071 @@ func (p *Processor) Run(ctx context.Context) error {
 		})
 	}
 
-	return g.Wait()
+	err := g.Wait()
+	if p.opts.Prefetching != nil && p.opts.Prefetching.SpillPath == "" && p.nackOnExit() {
+		p.nackBuffered(runCtx)
+	}
+
+	// Cancellation is the normal way to stop a processor
+	if err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
 }
 
-func (p *Processor) fetch(ctx context.Context) error {
+// drained reports whether a receive of n messages means the consumer group
+// has been drained. A short batch is taken as drained, except by
+// RunUntilEmpty, which waits for an empty receive so that a batch the server
+// cut short doesn't end the run with backlog left.
+func (p *Processor) drained(n, batchSize int) bool {
+	if p.untilEmpty {
+		return n == 0
+	}
+	return n < batchSize
+}
+
+// fetch fills the buffer of the lane at index i
+func (p *Processor) fetch(ctx context.Context, i int, l *lane) error {
+	var empty int
+	started := false
+
+	// The trailing transaction of the last receive, with GroupByTransaction
+	var held []Message
+	defer func() {
+		if len(held) > 0 {
+			p.drop(ctx, l.consumerGroup, held)
+		}
+	}()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
-			messages, err := p.client.Receive(ctx, p.consumerGroup, &ReceiveParams{
-				MaxBatchSize: p.opts.FetchBatchSize,
-				WaitFor:      120000, // 2 minute long polling
-			})
+			if err := p.waitResumed(ctx); err != nil {
+				return err
+			}
+			if err := p.checkNotFound(ctx, l.consumerGroup); err != nil {
+				return err
+			}
+			batchSize, err := p.reserve(ctx, p.fetchBatchSize())
+			if err != nil {
+				return err
+			}
+			start := time.Now()
+			messages, err := p.client.Receive(ctx, l.consumerGroup, p.receiveParams(batchSize))
+			p.unreserve(batchSize - len(messages))
 			if err != nil {
 				if ctx.Err() != nil {
 					return ctx.Err()
 				}
-				p.opts.ErrorHandler(ctx, nil, fmt.Errorf("receiving messages: %w", err))
+				if err := p.startFailed(started, err); err != nil {
+					return err
+				}
+				if err := p.receiveFailed(ctx, l.consumerGroup, err); err != nil {
+					return err
+				}
 				continue
 			}
+			started = true
+			p.notFound.observe(l.consumerGroup, nil)
+			p.stats.receive(start, len(messages))
+			if len(messages) > 0 {
+				p.opts.Logger.Debug("Received messages", "consumer_group", l.consumerGroup, "count", len(messages))
+			}
 
-			for _, msg := range messages {
-				select {
-				case <-ctx.Done():
-					return ctx.Err()
-				case p.msgBuffer <- msg:
+			p.backlog.add(i, len(messages))
+			received := len(messages)
+			messages, held = p.holdTransaction(append(held, messages...), received >= batchSize)
+			receivedAt := time.Now()
+			for j, msg := range messages {
+				end := j == len(messages)-1 || !sameTransaction(msg, messages[j+1])
+				b := bufferedMessage{msg: msg, receivedAt: receivedAt, txEnd: end}
+				if l.disk != nil {
+					err = l.disk.push(ctx, b)
+				} else {
+					err = p.enqueue(ctx, l, b)
+				}
+				if err != nil {
+					p.drop(ctx, l.consumerGroup, messages[j:])
+					return err
 				}
 			}
+
+			p.scaler.observeReceive(received >= batchSize)
+			p.sizer.observeReceive(received >= batchSize)
+			if p.drained(received, batchSize) {
+				p.backlog.markDrained(i)
+			}
+			if err := p.idle(ctx, received, &empty); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// idle waits out IdleBackoff after a receive that returned no messages.
+// empty counts consecutive empty receives.
+func (p *Processor) idle(ctx context.Context, received int, empty *int) error {
+	if p.opts.IdleBackoff == nil {
+		return nil
+	}
+	if received > 0 {
+		*empty = 0
+		return nil
+	}
+	*empty++
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(p.opts.IdleBackoff.delay(*empty)):
+		return nil
+	}
+}
+
+// reserve waits until at least one more message may be in flight under
+// MaxInFlight, and reserves room for up to n. It returns how many were
+// reserved, which is n without MaxInFlight.
+func (p *Processor) reserve(ctx context.Context, n int) (int, error) {
+	if p.inFlight == nil {
+		return n, nil
+	}
+	if err := p.inFlight.Acquire(ctx, 1); err != nil {
+		return 0, err
+	}
+	reserved := 1
+	for reserved < n && p.inFlight.TryAcquire(1) {
+		reserved++
+	}
+	return reserved, nil
+}
+
+// unreserve releases room for n messages reserved with reserve.
+func (p *Processor) unreserve(n int) {
+	if p.inFlight != nil && n > 0 {
+		p.inFlight.Release(int64(n))
+	}
+}
+
+// receiveParams returns the parameters for fetching up to batchSize messages.
+func (p *Processor) receiveParams(batchSize int) *ReceiveParams {
+	return &ReceiveParams{
+		MaxBatchSize: batchSize,
+		WaitFor:      120000, // 2 minute long polling
+	}
+}
+
+// enqueue adds b to the in-memory buffer of l, waiting for space.
+func (p *Processor) enqueue(ctx context.Context, l *lane, b bufferedMessage) error {
+	if err := p.sizer.acquire(ctx); err != nil {
+		return err
+	}
+	if p.bufferBytes != nil {
+		if err := p.bufferBytes.Acquire(ctx, p.bufferWeight(b.msg)); err != nil {
+			p.sizer.release()
+			return err
+		}
+	}
+	select {
+	case <-ctx.Done():
+		p.releaseBuffered(b.msg)
+		return ctx.Err()
+	case l.buffer <- b:
+	}
+	p.buffered <- struct{}{}
+	return nil
+}
+
+// feed moves messages from the disk queue of l into its in-memory buffer.
+func (p *Processor) feed(ctx context.Context, l *lane) error {
+	for {
+		b, err := l.disk.pop(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("reading disk queue: %w", err)
+		}
+		if err := p.enqueue(ctx, l, b); err != nil {
+			p.drop(ctx, l.consumerGroup, []Message{b.msg})
+			return err
 		}
 	}
 }
 
 // processDirectly processes messages as they arrive without buffering
 func (p *Processor) processDirectly(ctx context.Context) error {
-	sem := semaphore.NewWeighted(int64(p.opts.MaxConcurrent))
+	slots, stopSlots := p.startSlots(ctx)
+	defer stopSlots()
+	sem := slots.sem
+
+	// Wait for any in-flight processing to complete before returning
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	if p.scaler != nil {
+		defer p.scaler.start(ctx, sem)()
+	}
+
+	var empty int
+	started := false
+
+	// The trailing transaction of the last receive, with GroupByTransaction
+	var held []Message
+	defer func() {
+		if len(held) > 0 {
+			p.drop(ctx, p.consumerGroup, held)
+		}
+	}()
 
 	for {
 		// Check context before receiving
 		select {
 		case <-ctx.Done():
-			// Wait for any in-flight processing to complete
-			if err := sem.Acquire(ctx, int64(p.opts.MaxConcurrent)); err != nil {
-				return fmt.Errorf("waiting for in-flight processing: %w", err)
-			}
 			return ctx.Err()
 		default:
 		}
 
-		messages, err := p.client.Receive(ctx, p.consumerGroup, &ReceiveParams{
-			MaxBatchSize: p.opts.MaxBatchSize,
-			WaitFor:      120000, // 2 minute long polling
-		})
+		if err := p.waitResumed(ctx); err != nil {
+			return err
+		}
+		if err := p.checkNotFound(ctx, p.consumerGroup); err != nil {
+			return err
+		}
+		batchSize, err := p.reserve(ctx, p.maxBatchSize())
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		messages, err := p.client.Receive(ctx, p.consumerGroup, p.receiveParams(batchSize))
+		p.unreserve(batchSize - len(messages))
 		if err != nil {
 			if ctx.Err() != nil {
 				return ctx.Err()
 			}
-			p.opts.ErrorHandler(ctx, nil, fmt.Errorf("receiving messages: %w", err))
+			if err := p.startFailed(started, err); err != nil {
+				return err
+			}
+			if err := p.receiveFailed(ctx, p.consumerGroup, err); err != nil {
+				return err
+			}
 			continue
 		}
+		started = true
+		p.notFound.observe(p.consumerGroup, nil)
+		p.stats.receive(start, len(messages))
 
-		if len(messages) == 0 {
-			continue
+		if len(messages) > 0 {
+			p.opts.Logger.Debug("Received messages", "consumer_group", p.consumerGroup, "count", len(messages))
+			p.backlog.add(0, len(messages))
 		}
 
-		// Process the batch
-		if err := sem.Acquire(ctx, 1); err != nil {
-			return fmt.Errorf("acquiring semaphore: %w", err)
+		batch := make([]Message, 0, len(held)+len(messages))
+		batch = append(append(batch, held...), messages...)
+		batch, held = p.holdTransaction(batch, len(messages) >= batchSize)
+		if len(batch) > 0 {
+			if err := p.dispatch(ctx, sem, &wg, p.consumerGroup, batch); err != nil {
+				return err
+			}
 		}
 
-		messagesCopy := make([]Message, len(messages))
-		copy(messagesCopy, messages)
+		p.scaler.observeReceive(len(messages) >= batchSize)
+		if p.drained(len(messages), batchSize) {
+			p.backlog.markDrained(0)
+			if p.untilEmpty {
+				return nil
+			}
+		}
+		if err := p.idle(ctx, len(messages), &empty); err != nil {
+			return err
+		}
+	}
+}
+
+// notFoundThreshold is how many consecutive receives, acks or nacks must
+// report a missing consumer group before the processor treats it as deleted.
+const notFoundThreshold = 3
 
-		// Process synchronously since we're already in a goroutine
-		err = p.processBatch(ctx, messagesCopy)
-		sem.Release(1)
+// notFoundCounter counts the consecutive ErrConsumerGroupNotFound errors of
+// each consumer group's requests. Once a count reaches notFoundThreshold,
+// the latest error is kept until the processor takes it, even if a later
+// request succeeds.
+type notFoundCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+	gone   map[string]error
+}
 
-		if err != nil {
-			if ctx.Err() != nil {
-				return ctx.Err()
-			}
-			p.opts.ErrorHandler(ctx, messagesCopy, err)
-			continue
+func newNotFoundCounter() *notFoundCounter {
+	return &notFoundCounter{counts: make(map[string]int), gone: make(map[string]error)}
+}
+
+// observe records the outcome of a request for consumerGroup. Any outcome
+// other than ErrConsumerGroupNotFound resets its count.
+func (c *notFoundCounter) observe(consumerGroup string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !errors.Is(err, ErrConsumerGroupNotFound) {
+		delete(c.counts, consumerGroup)
+		return
+	}
+	c.counts[consumerGroup]++
+	if c.counts[consumerGroup] >= notFoundThreshold {
+		delete(c.counts, consumerGroup)
+		c.gone[consumerGroup] = err
+	}
+}
+
+// take returns the error that made consumerGroup reach notFoundThreshold,
+// if it has since it was last taken, and nil otherwise.
+func (c *notFoundCounter) take(consumerGroup string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.gone[consumerGroup]
+	delete(c.gone, consumerGroup)
+	return err
+}
+
+// startFailed returns err, for Run to stop with, if it is a FailFast
+// configuration error from the first Receive of a consumer group.
+func (p *Processor) startFailed(started bool, err error) error {
+	if !p.opts.FailFast || started {
+		return nil
+	}
+	if errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrConsumerGroupNotFound) {
+		return fmt.Errorf("receiving messages: %w", err)
+	}
+	return nil
+}
+
+// receiveFailed reports a receive error and decides whether the processor
+// should stop.
+func (p *Processor) receiveFailed(ctx context.Context, consumerGroup string, err error) error {
+	p.reportError(ctx, consumerGroup, nil, fmt.Errorf("receiving messages: %w", err))
+
+	// Honour the server's request to slow down, or an open circuit
+	// breaker, before receiving again
+	var wait time.Duration
+	var apiErr *APIError
+	var openErr *CircuitOpenError
+	if errors.As(err, &apiErr) {
+		wait = apiErr.RetryAfter
+	} else if errors.As(err, &openErr) {
+		wait = openErr.RetryAfter
+	}
+	if wait > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
 		}
 	}
+
+	p.notFound.observe(consumerGroup, err)
+	return p.checkNotFound(ctx, consumerGroup)
+}
+
+// checkNotFound decides whether the processor should stop once requests for
+// consumerGroup have reported it missing notFoundThreshold times in a row.
+func (p *Processor) checkNotFound(ctx context.Context, consumerGroup string) error {
+	err := p.notFound.take(consumerGroup)
+	if err == nil {
+		return nil
+	}
+	if p.opts.OnConsumerGroupNotFound == nil {
+		return err
+	}
+	if herr := p.opts.OnConsumerGroupNotFound(ctx, consumerGroup); herr != nil {
+		return fmt.Errorf("%w: recovering: %w", err, herr)
+	}
+	return nil
 }
 
 // processFromBuffer processes messages from the prefetch buffer
 func (p *Processor) processFromBuffer(ctx context.Context) error {
-	sem := semaphore.NewWeighted(int64(p.opts.MaxConcurrent))
-	g, ctx := errgroup.WithContext(ctx)
+	slots, stopSlots := p.startSlots(ctx)
+	defer stopSlots()
+	sem := slots.sem
+
+	// Wait for any in-flight processing to complete before returning
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	if p.scaler != nil {
+		defer p.scaler.start(ctx, sem)()
+	}
 
 	for {
-		batch := make([]Message, 0, p.opts.MaxBatchSize)
+		// Wait for at least one message
+		if len(p.buffered) == 0 {
+			p.sizer.observeStarved()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.buffered:
+		}
+
+		l, b := p.takeBuffered()
+		maxBatchSize := p.maxBatchSize()
+		batch := make([]Message, 0, maxBatchSize)
+		batch = append(batch, b.msg)
+		txEnd := b.txEnd
 
-		// Try to fill a batch
-		for len(batch) < p.opts.MaxBatchSize {
+		// Try to fill the batch from the same lane, waiting up to
+		// FlushInterval for more messages
+		var flush <-chan time.Time
+		var timer *time.Timer
+		if p.opts.Prefetching.FlushInterval > 0 && len(batch) < maxBatchSize {
+			timer = time.NewTimer(p.opts.Prefetching.FlushInterval)
+			flush = timer.C
+		}
+	Fill:
+		for len(batch) < maxBatchSize {
 			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case msg := <-p.msgBuffer:
-				batch = append(batch, msg)
+			case <-p.buffered:
+			default:
+				if flush == nil {
+					// No more messages immediately available
+					break Fill
+				}
+				select {
+				case <-p.buffered:
+				case <-flush:
+					break Fill
+				case <-ctx.Done():
+					break Fill
+				}
+			}
+
+			select {
+			case b := <-l.buffer:
+				p.releaseBuffered(b.msg)
+				batch = append(batch, b.msg)
+				txEnd = b.txEnd
 			default:
-				// No more messages immediately available
-				goto ProcessBatch
+				// The next message belongs to another lane
+				p.buffered <- struct{}{}
+				break Fill
+			}
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if p.opts.GroupByTransaction && !txEnd {
+			batch = p.completeTransaction(ctx, l, batch)
+		}
+
+		if err := p.dispatch(ctx, sem, &wg, l.consumerGroup, batch); err != nil {
+			return err
+		}
+	}
+}
+
+// completeTransaction adds to batch the rest of its last transaction, for
+// GroupByTransaction. The fetcher buffers transactions whole, so the rest
+// is in l's buffer or on its way there.
+func (p *Processor) completeTransaction(ctx context.Context, l *lane, batch []Message) []Message {
+	for {
+		// Tokens aren't tied to lanes, so any one stands for the message
+		// awaited from l
+		select {
+		case <-p.buffered:
+		case <-ctx.Done():
+			return batch
+		}
+		select {
+		case b := <-l.buffer:
+			p.releaseBuffered(b.msg)
+			batch = append(batch, b.msg)
+			if b.txEnd {
+				return batch
 			}
+		case <-ctx.Done():
+			p.buffered <- struct{}{}
+			return batch
 		}
+	}
+}
+
+// dispatch starts handling batch, split by key with PartitionByKey and
+// handed to the partitions' workers with StickyPartitions.
+func (p *Processor) dispatch(ctx context.Context, sem *resizableSemaphore, wg *sync.WaitGroup, consumerGroup string, batch []Message) error {
+	if !p.opts.PartitionByKey {
+		return p.dispatchBatch(ctx, sem, wg, consumerGroup, batch)
+	}
+	parts := p.partition(batch)
+	for i, part := range parts {
+		if len(part) == 0 {
+			continue
+		}
+		var err error
+		if p.workers != nil {
+			if err = p.workers.send(ctx, i, stickyBatch{consumerGroup: consumerGroup, msgs: part}); err != nil {
+				p.drop(ctx, consumerGroup, part)
+			}
+		} else {
+			err = p.dispatchBatch(context.WithValue(ctx, partitionContextKey{}, i), sem, wg, consumerGroup, part)
+		}
+		if err != nil {
+			// The failed part was dropped; so are the parts after it
+			for _, rest := range parts[i+1:] {
+				if len(rest) > 0 {
+					p.drop(ctx, consumerGroup, rest)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// dispatchBatch starts handling batch in a new goroutine once a concurrency
+// slot and, with OrderingKey set, the batch's ordering keys are available.
+func (p *Processor) dispatchBatch(ctx context.Context, sem *resizableSemaphore, wg *sync.WaitGroup, consumerGroup string, batch []Message) error {
+	var keys []orderingKey
+	if p.keys != nil {
+		keys = p.orderingKeys(consumerGroup, batch)
+		if err := p.keys.lock(ctx, keys); err != nil {
+			p.drop(ctx, consumerGroup, batch)
+			return fmt.Errorf("waiting for ordering keys: %w", err)
+		}
+	}
+
+	if err := sem.Acquire(ctx, 1); err != nil {
+		if keys != nil {
+			p.keys.unlock(keys)
+		}
+		p.drop(ctx, consumerGroup, batch)
+		return fmt.Errorf("acquiring semaphore: %w", err)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer sem.Release(1)
+		if keys != nil {
+			defer p.keys.unlock(keys)
+		}
+		defer p.scaler.batchDone(p.scaler.batchStarted())
+		p.handleBatch(ctx, consumerGroup, batch)
+	}()
+	return nil
+}
 
-	ProcessBatch:
-		if len(batch) == 0 {
-			// Wait for at least one message
+// takeBuffered removes the next message from the highest-priority lane that
+// has one, or in round-robin mode from the next lane in turn that has one.
+// The caller must hold a token from p.buffered.
+func (p *Processor) takeBuffered() (*lane, bufferedMessage) {
+	for {
+		for i := range p.lanes {
+			idx := (p.nextLane + i) % len(p.lanes)
+			l := p.lanes[idx]
 			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case msg := <-p.msgBuffer:
-				batch = append(batch, msg)
+			case b := <-l.buffer:
+				p.releaseBuffered(b.msg)
+				if p.roundRobin {
+					p.nextLane = (idx + 1) % len(p.lanes)
+				}
+				return l, b
+			default:
 			}
 		}
+	}
+}
+
+// bufferWeight is the share of the byte budget a buffered message occupies.
+func (p *Processor) bufferWeight(msg Message) int64 {
+	size := int64(len(msg.Record))
+	if max := p.opts.Prefetching.MaxBufferBytes; size > max {
+		return max
+	}
+	return size
+}
 
-		if err := sem.Acquire(ctx, 1); err != nil {
-			return fmt.Errorf("acquiring semaphore: %w", err)
+// releaseBuffered returns a message's buffer slot and share of the byte
+// budget once it leaves the prefetch buffer.
+func (p *Processor) releaseBuffered(msg Message) {
+	p.sizer.release()
+	if p.bufferBytes != nil {
+		p.bufferBytes.Release(p.bufferWeight(msg))
+	}
+}
+
+// handleBatch processes a batch and reports any failure to the ErrorHandler.
+// Batches that have started are allowed to finish after ctx is cancelled so
+// they can still be acknowledged during shutdown.
+func (p *Processor) handleBatch(ctx context.Context, consumerGroup string, msgs []Message) {
+	p.stats.inFlight.Add(int64(len(msgs)))
+	defer p.stats.inFlight.Add(-int64(len(msgs)))
+	defer p.backlog.done(len(msgs))
+	defer p.unreserve(len(msgs))
+	defer p.sizer.batchDone(time.Now())
+
+	if p.opts.Limiter != nil {
+		// Batches that never started are left for redelivery on shutdown,
+		// or nacked by Stop
+		if err := p.opts.Limiter.acquire(ctx); err != nil {
+			p.abandon(ctx, consumerGroup, msgs)
+			return
 		}
+		defer p.opts.Limiter.release()
+	}
 
-		batchCopy := make([]Message, len(batch))
-		copy(batchCopy, batch)
+	if p.opts.DeferUntil != nil {
+		msgs = p.dueMessages(ctx, consumerGroup, msgs)
+		if len(msgs) == 0 {
+			return
+		}
+	}
 
-		g.Go(func() error {
-			defer sem.Release(1)
+	groups := [][]Message{msgs}
+	if p.opts.GroupByTransaction {
+		groups = groupByTransaction(msgs)
+	}
 
-			if err := p.processBatch(ctx, batchCopy); err != nil {
-				p.opts.ErrorHandler(ctx, batchCopy, err)
+	for _, group := range groups {
+		start := time.Now()
+		p.opts.Logger.Debug("Processing batch", "consumer_group", consumerGroup, "batch_size", len(group))
+		if err := p.processBatch(ctx, consumerGroup, group); err != nil {
+			// Later groups are left for redelivery to preserve commit order
+			var result *BatchResult
+			if errors.As(err, &result) {
+				group = result.messages()
 			}
-			return nil
-		})
+			p.reportError(ctx, consumerGroup, group, err)
+			return
+		}
+		p.opts.Logger.Debug("Processed batch", "consumer_group", consumerGroup, "batch_size", len(group), "duration", time.Since(start))
 	}
 }
 
-func (p *Processor) processBatch(ctx context.Context, msgs []Message) error {
+// reportError passes a processing error to the ErrorHandler, or logs it.
+// consumerGroup is empty for errors that don't concern a single group.
+func (p *Processor) reportError(ctx context.Context, consumerGroup string, msgs []Message, err error) {
+	p.stats.recordError(err)
+	if p.opts.ErrorHandler != nil {
+		p.opts.ErrorHandler(ctx, msgs, err)
+		return
+	}
+	args := []any{"batch_size", len(msgs), "error", err}
+	if consumerGroup != "" {
+		args = append([]any{"consumer_group", consumerGroup}, args...)
+	}
+	p.opts.Logger.Error("Processing failed", args...)
+}
+
+// dueMessages returns the messages in msgs that are not deferred, and holds
+// the others until they are due, then nacks them to be redelivered.
+func (p *Processor) dueMessages(ctx context.Context, consumerGroup string, msgs []Message) []Message {
+	now := time.Now()
+	due := make([]Message, 0, len(msgs))
+	var deferred []Message
+	delays := make(map[string]time.Duration)
+	for _, msg := range msgs {
+		until := p.opts.DeferUntil(msg)
+		if !until.After(now) {
+			due = append(due, msg)
+			continue
+		}
+		deferred = append(deferred, msg)
+		delays[msg.AckID] = until.Sub(now)
+	}
+
+	if len(deferred) > 0 {
+		delay := func(msg Message) time.Duration { return delays[msg.AckID] }
+		p.nackAfter(ctx, consumerGroup, deferred, delay, "deferring messages")
+	}
+	return due
+}
+
+// holdTransaction splits off, with GroupByTransaction, the trailing
+// transaction of msgs when the receive they complete was full, so more of
+// it may follow; it is delivered with the next receive. Transactions of
+// MaxInFlight messages or more aren't held, since the next receive would
+// have no room.
+func (p *Processor) holdTransaction(msgs []Message, full bool) (ready, held []Message) {
+	if !p.opts.GroupByTransaction || !full || len(msgs) == 0 {
+		return msgs, nil
+	}
+	i := len(msgs) - 1
+	if msgs[i].Metadata.CommitLSN == 0 {
+		return msgs, nil
+	}
+	for i > 0 && sameTransaction(msgs[i-1], msgs[i]) {
+		i--
+	}
+	if p.opts.MaxInFlight > 0 && len(msgs)-i >= p.opts.MaxInFlight {
+		return msgs, nil
+	}
+	return msgs[:i:i], append([]Message(nil), msgs[i:]...)
+}
+
+// sameTransaction reports whether a and b come from the same source
+// transaction.
+func sameTransaction(a, b Message) bool {
+	return a.Metadata.CommitLSN != 0 && a.Metadata.CommitLSN == b.Metadata.CommitLSN
+}
+
+// groupByTransaction splits msgs into runs of consecutive messages from the
+// same transaction. Messages without a commit LSN are grouped on their own.
+func groupByTransaction(msgs []Message) [][]Message {
+	var groups [][]Message
+	start := 0
+	for i := 1; i <= len(msgs); i++ {
+		if i < len(msgs) && sameTransaction(msgs[start], msgs[i]) {
+			continue
+		}
+		groups = append(groups, msgs[start:i])
+		start = i
+	}
+	return groups
+}
+
+// processBatch handles msgs and settles them. It runs to completion after ctx
+// is cancelled, except that handler retries stop.
+func (p *Processor) processBatch(ctx context.Context, consumerGroup string, msgs []Message) error {
+	stop := ctx.Done()
+	ctx = detach(ctx)
+
+	if p.opts.Shadow != nil {
+		done := make(chan struct{})
+		shadowMsgs := append([]Message(nil), msgs...)
+		go func() {
+			defer close(done)
+			p.runShadow(ctx, shadowMsgs)
+		}()
+		defer func() { <-done }()
+	}
+
+	var handlerCtx context.Context = haltContext{ctx, p.halted}
+	if p.opts.AckPolicy == Manual {
+		handlerCtx = context.WithValue(handlerCtx, ackerContextKey{}, Acker(&batchAcker{p: p, consumerGroup: consumerGroup}))
+	}
+
+	handled := msgs
+	var collapsed map[string][]Message
+	if p.opts.CompactBatches {
+		handled, collapsed = p.compact(msgs)
+	}
+
 	// Process the batch
-	if err := p.handler(ctx, msgs); err != nil {
-		return fmt.Errorf("handler failed: %w", err)
+	p.stats.batches.Add(1)
+	exhausted, err := p.callHandler(handlerCtx, stop, handled)
+	expandCompacted(err, collapsed)
+	p.stats.handled(msgs, err)
+	if err != nil {
+		err = fmt.Errorf("handler failed: %w", err)
+		if p.opts.AckPolicy == AlwaysAck {
+			p.reportError(ctx, consumerGroup, msgs, err)
+			return p.settle(ctx, consumerGroup, msgs)
+		}
+
+		// A BatchResult reports which messages failed; the rest are
+		// acknowledged
+		failed := msgs
+		var serr error
+		var result *BatchResult
+		if errors.As(err, &result) {
+			failed = result.messages()
+			succeeded := result.succeeded(msgs)
+			if p.opts.OnMessageLatency != nil {
+				p.reportLatency(ctx, succeeded)
+			}
+			p.nackBackoff.forget(succeeded)
+			serr = p.settle(ctx, consumerGroup, succeeded)
+		}
+
+		if exhausted && p.opts.DeadLetter != nil {
+			if derr := p.opts.DeadLetter(ctx, failed, err); derr != nil {
+				err = fmt.Errorf("%w; dead-lettering messages: %w", err, derr)
+			} else {
+				p.opts.Logger.Warn("Dead-lettered failed messages", "consumer_group", consumerGroup, "batch_size", len(failed), "error", err)
+				p.nackBackoff.forget(failed)
+				return errors.Join(serr, p.settle(ctx, consumerGroup, failed))
+			}
+		}
+		if serr != nil {
+			err = fmt.Errorf("%w; %w", err, serr)
+		}
+		if p.opts.NackOnError || p.opts.NackDelay > 0 {
+			if nerr := p.nackFailed(ctx, consumerGroup, failed); nerr != nil {
+				return fmt.Errorf("%w; nacking messages: %w", err, nerr)
+			}
+		}
+		return err
+	}
+	if p.opts.OnMessageLatency != nil {
+		p.reportLatency(ctx, msgs)
+	}
+	if p.opts.AckPolicy == Manual {
+		return nil
+	}
+	p.nackBackoff.forget(msgs)
+	return p.settle(ctx, consumerGroup, msgs)
+}
+
+// callHandler runs the handler on msgs, retrying failures as configured
+// by Retry until stop is closed. Only the failed messages of a
+// *BatchResult are retried. exhausted reports whether a failure was
+// retried as often as Retry allows.
+func (p *Processor) callHandler(ctx context.Context, stop <-chan struct{}, msgs []Message) (exhausted bool, err error) {
+	err = p.handler(ctx, msgs)
+	if p.opts.Retry == nil {
+		return true, err
+	}
+
+	pending := msgs
+	attempt := 1
+retry:
+	for ; err != nil && attempt < p.opts.Retry.MaxAttempts; attempt++ {
+		var result *BatchResult
+		if errors.As(err, &result) {
+			pending = result.messages()
+		}
+		wait := p.opts.Retry.delay(attempt)
+		p.opts.Logger.Warn("Retrying failed batch", "batch_size", len(pending), "attempt", attempt, "wait", wait, "error", err)
+
+		select {
+		case <-stop:
+			break retry
+		case <-time.After(wait):
+		}
+		err = p.handler(ctx, pending)
+	}
+	exhausted = attempt >= p.opts.Retry.MaxAttempts
+
+	// Messages that succeeded on an earlier attempt must not be
+	// redelivered with the ones still failing
+	var result *BatchResult
+	if err != nil && len(pending) < len(msgs) && !errors.As(err, &result) {
+		result = &BatchResult{}
+		for _, msg := range pending {
+			result.Fail(msg, err)
+		}
+		return exhausted, result
+	}
+	return exhausted, err
+}
+
+// settle acknowledges msgs, which were processed, or nacks them in DryRun
+// mode.
+func (p *Processor) settle(ctx context.Context, consumerGroup string, msgs []Message) error {
+	if len(msgs) == 0 {
+		return nil
 	}
+	ackIDs := ackIDsOf(msgs)
 
-	// Collect ack IDs
-	ackIDs := make([]string, len(msgs))
-	for i, msg := range msgs {
-		ackIDs[i] = msg.AckID
+	if p.opts.DryRun {
+		p.opts.Logger.Info("Dry run: nacking processed messages", "consumer_group", consumerGroup, "batch_size", len(ackIDs))
+		err := p.client.Nack(ctx, consumerGroup, ackIDs)
+		p.stats.nack(len(ackIDs), err)
+		p.notFound.observe(consumerGroup, err)
+		if err != nil {
+			return fmt.Errorf("nacking dry-run messages: %w", err)
+		}
+		return nil
+	}
+
+	if p.acks != nil && p.acks.add(consumerGroup, ackIDs) {
+		return nil
 	}
 
 	// Acknowledge the batch
-	if err := p.client.Ack(ctx, p.consumerGroup, ackIDs); err != nil {
-		return fmt.Errorf("acknowledging messages: %w", err)
+	if failed, err := p.ack(ctx, consumerGroup, ackIDs); err != nil {
+		if p.opts.AckErrorHandler != nil {
+			p.stats.recordError(err)
+			p.opts.AckErrorHandler(ctx, failed, err)
+			return nil
+		}
+		return err
 	}
 
 	return nil
 }
+
+// ack acknowledges ackIDs, returning those that could not be acknowledged.
+// If the server rejects the batch, e.g. because one of its ack IDs is
+// invalid, the batch is split in halves until the rejected IDs are
+// isolated, so the rest of the batch isn't redelivered. The ack endpoint
+// doesn't report which IDs it rejected or why, so IDs that fail on their
+// own are returned with the error. Transient failures are retried by the
+// client if ClientOptions.Retry is set.
+func (p *Processor) ack(ctx context.Context, consumerGroup string, ackIDs []string) ([]string, error) {
+	failed, errs := p.ackSplit(ctx, consumerGroup, ackIDs)
+	switch {
+	case len(failed) == 0:
+		return nil, nil
+	case len(errs) == 1 && len(failed) == len(ackIDs):
+		return failed, fmt.Errorf("acknowledging messages: %w", errs[0])
+	}
+	return failed, fmt.Errorf("acknowledging %d of %d messages: %w", len(failed), len(ackIDs), errors.Join(errs...))
+}
+
+// ackSplit acknowledges ackIDs, halving rejected batches, and returns the
+// IDs that failed with the errors of the requests that failed them.
+func (p *Processor) ackSplit(ctx context.Context, consumerGroup string, ackIDs []string) ([]string, []error) {
+	start := time.Now()
+	err := p.client.Ack(ctx, consumerGroup, ackIDs)
+	p.stats.ack(start, len(ackIDs), err == nil)
+	p.notFound.observe(consumerGroup, err)
+	if err == nil {
+		return nil, nil
+	}
+	if len(ackIDs) == 1 || !rejectedAck(err) {
+		return ackIDs, []error{err}
+	}
+
+	half := len(ackIDs) / 2
+	failed, errs := p.ackSplit(ctx, consumerGroup, ackIDs[:half])
+	moreFailed, moreErrs := p.ackSplit(ctx, consumerGroup, ackIDs[half:])
+	return append(failed, moreFailed...), append(errs, moreErrs...)
+}
+
+// rejectedAck reports whether err is the server rejecting the content of
+// an ack request, rather than a transient or authorization failure that
+// splitting the batch wouldn't avoid.
+func rejectedAck(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.StatusCode {
+	case http.StatusBadRequest, http.StatusConflict, http.StatusGone, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// nackFailed nacks msgs, whose handler failed. With NackDelay set, they
+// are held for that delay, grown by the nack backoff for messages that keep
+// failing, before being nacked in the background.
+func (p *Processor) nackFailed(ctx context.Context, consumerGroup string, msgs []Message) error {
+	if p.opts.NackDelay == 0 {
+		err := p.client.Nack(ctx, consumerGroup, ackIDsOf(msgs))
+		p.stats.nack(len(msgs), err)
+		p.notFound.observe(consumerGroup, err)
+		return err
+	}
+
+	delay := func(Message) time.Duration { return p.opts.NackDelay }
+	if p.nackBackoff != nil {
+		delay = p.nackBackoff.delay
+	}
+	p.nackAfter(ctx, consumerGroup, msgs, delay, "nacking failed messages")
+	return nil
+}
+
+// runShadow runs the Shadow handler on msgs, reporting failures.
+func (p *Processor) runShadow(ctx context.Context, msgs []Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.opts.ShadowErrorHandler(ctx, msgs, fmt.Errorf("shadow handler panicked: %v", r))
+		}
+	}()
+	if err := p.opts.Shadow(ctx, msgs); err != nil {
+		p.opts.ShadowErrorHandler(ctx, msgs, fmt.Errorf("shadow handler failed: %w", err))
+	}
+}
+
+// reportLatency reports the end-to-end latency of msgs, which have just
+// been handled.
+func (p *Processor) reportLatency(ctx context.Context, msgs []Message) {
+	now := time.Now()
+	for _, msg := range msgs {
+		if msg.Metadata.CommitTimestamp.IsZero() {
+			continue
+		}
+		p.opts.OnMessageLatency(ctx, msg, now.Sub(msg.Metadata.CommitTimestamp))
+	}
+}
+
+// backlog tracks messages that have been fetched but not yet processed,
+// so the processor can tell when it has caught up with its consumer groups.
+type backlog struct {
+	mu        sync.Mutex
+	pending   int
+	processed int
+	drained   []bool // per lane
+
+	once       sync.Once
+	onCaughtUp func()
+}
+
+func newBacklog(lanes int, onCaughtUp func()) *backlog {
+	return &backlog{
+		drained:    make([]bool, lanes),
+		onCaughtUp: onCaughtUp,
+	}
+}
+
+// add records n newly fetched messages from lane.
+func (b *backlog) add(lane, n int) {
+	if n == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending += n
+	b.drained[lane] = false
+}
+
+// done records that n fetched messages finished processing.
+func (b *backlog) done(n int) {
+	b.mu.Lock()
+	b.pending -= n
+	b.processed += n
+	caughtUp := b.caughtUp()
+	b.mu.Unlock()
+
+	if caughtUp {
+		b.once.Do(b.onCaughtUp)
+	}
+}
+
+// markDrained records that the server returned everything it had for lane.
+func (b *backlog) markDrained(lane int) {
+	b.mu.Lock()
+	b.drained[lane] = true
+	caughtUp := b.caughtUp()
+	b.mu.Unlock()
+
+	if caughtUp {
+		b.once.Do(b.onCaughtUp)
+	}
+}
+
+// summary returns the number of processed messages and whether the
+// processor is caught up.
+func (b *backlog) summary() (processed int, caughtUp bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.processed, b.caughtUp()
+}
+
+// caughtUp must be called with b.mu held.
+func (b *backlog) caughtUp() bool {
+	if b.pending != 0 {
+		return false
+	}
+	for _, drained := range b.drained {
+		if !drained {
+			return false
+		}
+	}
+	return true
+}
+
+// detachedContext keeps the values of its parent but is never cancelled.
+type detachedContext struct {
+	context.Context
+}
+
+func detach(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
@@ -0,0 +1,100 @@
+package sequin
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// resizableSemaphore is a semaphore whose size can change while its slots
+// are in use. It holds the slots of a semaphore of max slots above the
+// current size.
+type resizableSemaphore struct {
+	*semaphore.Weighted
+
+	mu   sync.Mutex // serializes resizes
+	size int
+}
+
+func newResizableSemaphore(max, size int) *resizableSemaphore {
+	s := &resizableSemaphore{Weighted: semaphore.NewWeighted(int64(max)), size: size}
+	s.TryAcquire(int64(max - size))
+	return s
+}
+
+// resize holds or releases slots until size are available, waiting for
+// slots in use to be released when shrinking. It returns the previous
+// size, and ctx's error if it ended before the semaphore could shrink.
+func (s *resizableSemaphore) resize(ctx context.Context, size int) (from int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from = s.size
+	if size > from {
+		s.Release(int64(size - from))
+	} else if size < from {
+		if err := s.Acquire(ctx, int64(from-size)); err != nil {
+			return from, err
+		}
+	}
+	s.size = size
+	return from, nil
+}
+
+// loadStats are the observations of one resizing interval, for the
+// autoscaler and the buffer sizer.
+type loadStats struct {
+	receives     int
+	fullReceives int
+	batches      int
+	latency      time.Duration // total handler latency of batches
+}
+
+// observeReceive records whether a receive returned a full batch.
+func (s *loadStats) observeReceive(full bool) {
+	s.receives++
+	if full {
+		s.fullReceives++
+	}
+}
+
+// observeBatch records that a batch started at start finished.
+func (s *loadStats) observeBatch(start time.Time) {
+	s.batches++
+	s.latency += time.Since(start)
+}
+
+// backlogged reports whether most receives returned full batches.
+func (s loadStats) backlogged() bool {
+	return s.receives > 0 && 2*s.fullReceives >= s.receives
+}
+
+// latencyDecay is the share of the gap to a slower average latency that the
+// best latency of a latencyTracker closes every interval.
+const latencyDecay = 4
+
+// latencyTracker remembers the lowest average handler latency seen in an
+// interval, to tell when handlers slow down. The best latency drifts up
+// towards slower averages, so a lasting slowdown, e.g. of a downstream
+// database, becomes the new baseline instead of holding resizing back for
+// good.
+type latencyTracker struct {
+	tolerance float64
+	best      time.Duration
+}
+
+// degraded records the average latency of s and reports whether it rose
+// more than tolerance times above the best seen.
+func (t *latencyTracker) degraded(s loadStats) bool {
+	if s.batches == 0 {
+		return false
+	}
+	avg := s.latency / time.Duration(s.batches)
+	if t.best == 0 || avg < t.best {
+		t.best = avg
+	}
+	degraded := float64(avg) > float64(t.best)*t.tolerance
+	t.best += (avg - t.best) / latencyDecay
+	return degraded
+}
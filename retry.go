@@ -0,0 +1,219 @@
+package sequin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryOptions configures how the client retries requests that fail
+// transiently: refused, reset or dropped connections, timeouts, 5xx
+// responses, and 429 responses, which are retried no sooner than their
+// Retry-After header allows. Receive, Ack and Nack are all safe to retry.
+type RetryOptions struct {
+	// MaxAttempts is the total number of attempts per request, including the
+	// first one. Defaults to 3.
+	MaxAttempts int
+
+	// BaseDelay is the wait before the first retry. It doubles with each
+	// further retry, up to MaxDelay. Defaults to 100ms.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the wait between attempts. Defaults to 5s.
+	MaxDelay time.Duration
+
+	// Jitter is the fraction of each delay, between 0 and 1, that is
+	// randomized so that many clients don't retry in lockstep. If zero,
+	// delays are not randomized.
+	Jitter float64
+}
+
+func (o *RetryOptions) validate() error {
+	if o.MaxAttempts < 0 {
+		return fmt.Errorf("MaxAttempts must be >= 0, got %d", o.MaxAttempts)
+	}
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = 3
+	}
+	if o.BaseDelay < 0 {
+		return fmt.Errorf("BaseDelay must be >= 0, got %v", o.BaseDelay)
+	}
+	if o.BaseDelay == 0 {
+		o.BaseDelay = 100 * time.Millisecond
+	}
+	if o.MaxDelay < 0 {
+		return fmt.Errorf("MaxDelay must be >= 0, got %v", o.MaxDelay)
+	}
+	if o.MaxDelay == 0 {
+		o.MaxDelay = 5 * time.Second
+	}
+	if o.Jitter < 0 || o.Jitter > 1 {
+		return fmt.Errorf("Jitter must be between 0 and 1, got %v", o.Jitter)
+	}
+	return nil
+}
+
+// delay returns the wait after the given failed attempt, starting at 1.
+func (o *RetryOptions) delay(attempt int) time.Duration {
+	return backoff(o.BaseDelay, o.MaxDelay, o.Jitter, attempt)
+}
+
+// backoff returns base doubled for each attempt after the first, capped at
+// max, with the given fraction of it randomized.
+func backoff(base, max time.Duration, jitter float64, attempt int) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if jitter > 0 {
+		d -= time.Duration(jitter * rand.Float64() * float64(d))
+	}
+	return d
+}
+
+// HandlerRetryOptions configures ProcessorOptions.Retry.
+type HandlerRetryOptions struct {
+	// MaxAttempts is the total number of times a batch is handled,
+	// including the first one. Defaults to 3.
+	MaxAttempts int
+
+	// Backoff is the wait before the first retry. It doubles with each
+	// further retry, up to MaxBackoff. Defaults to 100ms.
+	Backoff time.Duration
+
+	// MaxBackoff caps the wait between attempts. Defaults to 5s.
+	MaxBackoff time.Duration
+}
+
+func (o *HandlerRetryOptions) validate() error {
+	if o.MaxAttempts < 0 {
+		return fmt.Errorf("MaxAttempts must be >= 0, got %d", o.MaxAttempts)
+	}
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = 3
+	}
+	if o.Backoff < 0 {
+		return fmt.Errorf("Backoff must be >= 0, got %v", o.Backoff)
+	}
+	if o.Backoff == 0 {
+		o.Backoff = 100 * time.Millisecond
+	}
+	if o.MaxBackoff < 0 {
+		return fmt.Errorf("MaxBackoff must be >= 0, got %v", o.MaxBackoff)
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = 5 * time.Second
+	}
+	return nil
+}
+
+// delay returns the wait after the given failed attempt, starting at 1.
+func (o *HandlerRetryOptions) delay(attempt int) time.Duration {
+	return backoff(o.Backoff, o.MaxBackoff, 0, attempt)
+}
+
+// IdleBackoffOptions configures ProcessorOptions.IdleBackoff.
+type IdleBackoffOptions struct {
+	// MinDelay is the wait after the first empty receive. It doubles with
+	// each further empty receive, up to MaxDelay. Defaults to 100ms.
+	MinDelay time.Duration
+
+	// MaxDelay caps the wait between empty receives. Defaults to 5s.
+	MaxDelay time.Duration
+
+	// Jitter is the fraction of each delay, between 0 and 1, that is
+	// randomized so that idle replicas don't poll in lockstep. If zero,
+	// delays are not randomized.
+	Jitter float64
+}
+
+func (o *IdleBackoffOptions) validate() error {
+	if o.MinDelay < 0 {
+		return fmt.Errorf("MinDelay must be >= 0, got %v", o.MinDelay)
+	}
+	if o.MinDelay == 0 {
+		o.MinDelay = 100 * time.Millisecond
+	}
+	if o.MaxDelay < 0 {
+		return fmt.Errorf("MaxDelay must be >= 0, got %v", o.MaxDelay)
+	}
+	if o.MaxDelay == 0 {
+		o.MaxDelay = 5 * time.Second
+	}
+	if o.MaxDelay < o.MinDelay {
+		return fmt.Errorf("MaxDelay must be >= MinDelay (%v), got %v", o.MinDelay, o.MaxDelay)
+	}
+	if o.Jitter < 0 || o.Jitter > 1 {
+		return fmt.Errorf("Jitter must be between 0 and 1, got %v", o.Jitter)
+	}
+	return nil
+}
+
+// delay returns the wait after the given number of consecutive empty
+// receives, starting at 1.
+func (o *IdleBackoffOptions) delay(empty int) time.Duration {
+	return backoff(o.MinDelay, o.MaxDelay, o.Jitter, empty)
+}
+
+// retryAfter parses the Retry-After header of resp, given in either seconds
+// or as an HTTP date. It returns zero if the header is missing or invalid.
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	h := resp.Header.Get("Retry-After")
+	if h == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(h); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// retryable reports whether a request failed transiently. Requests
+// abandoned by their caller are never retried.
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if err != nil {
+		return transient(err)
+	}
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// transient reports whether a transport error is worth retrying: timeouts,
+// and connections that were refused, reset or closed before a response.
+// Errors that would fail again the same way, such as TLS certificate or
+// proxy configuration errors, are not.
+func transient(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// discard drains and closes the body of a response that won't be used, so
+// that its connection can be reused.
+func discard(resp *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxErrorBodyBytes))
+	resp.Body.Close()
+}
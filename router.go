@@ -0,0 +1,99 @@
+package sequin
+
+import (
+	"context"
+	"fmt"
+)
+
+// MessageFunc processes a single message.
+type MessageFunc func(context.Context, Message) error
+
+// Router dispatches messages to handlers registered per table and action.
+//
+// Tables can be registered either by name ("users") or by schema-qualified
+// name ("public.users"). When both match, the schema-qualified route wins.
+// Router.Process satisfies ProcessorFunc, so a Router can be passed directly
+// to NewProcessor.
+type Router struct {
+	routes   map[routeKey]MessageFunc
+	fallback MessageFunc
+}
+
+type routeKey struct {
+	table  string
+	action Action
+}
+
+// NewRouter creates an empty Router.
+func NewRouter() *Router {
+	return &Router{
+		routes: make(map[routeKey]MessageFunc),
+	}
+}
+
+// Handle registers fn for messages from table with the given action.
+// An empty action matches any action for the table.
+func (r *Router) Handle(table string, action Action, fn MessageFunc) *Router {
+	r.routes[routeKey{table: table, action: action}] = fn
+	return r
+}
+
+// OnInsert registers fn for inserts into table.
+func (r *Router) OnInsert(table string, fn MessageFunc) *Router {
+	return r.Handle(table, ActionInsert, fn)
+}
+
+// OnUpdate registers fn for updates to table.
+func (r *Router) OnUpdate(table string, fn MessageFunc) *Router {
+	return r.Handle(table, ActionUpdate, fn)
+}
+
+// OnDelete registers fn for deletes from table.
+func (r *Router) OnDelete(table string, fn MessageFunc) *Router {
+	return r.Handle(table, ActionDelete, fn)
+}
+
+// OnRead registers fn for rows of table emitted by a backfill.
+func (r *Router) OnRead(table string, fn MessageFunc) *Router {
+	return r.Handle(table, ActionRead, fn)
+}
+
+// Default registers fn for messages that match no other route.
+// If no default is registered, unmatched messages are skipped and
+// acknowledged along with the rest of the batch.
+func (r *Router) Default(fn MessageFunc) *Router {
+	r.fallback = fn
+	return r
+}
+
+// Process dispatches each message in order to its handler.
+// It stops at the first handler error.
+func (r *Router) Process(ctx context.Context, msgs []Message) error {
+	for _, msg := range msgs {
+		fn := r.match(msg)
+		if fn == nil {
+			continue
+		}
+		if err := fn(ctx, msg); err != nil {
+			return fmt.Errorf("handling %s on %s (ack ID %s): %w", msg.Action, msg.Metadata.TableName, msg.AckID, err)
+		}
+	}
+	return nil
+}
+
+func (r *Router) match(msg Message) MessageFunc {
+	tables := []string{msg.Metadata.TableName}
+	if msg.Metadata.TableSchema != "" {
+		tables = []string{msg.Metadata.TableSchema + "." + msg.Metadata.TableName, msg.Metadata.TableName}
+	}
+
+	for _, table := range tables {
+		if fn, ok := r.routes[routeKey{table: table, action: msg.Action}]; ok {
+			return fn
+		}
+		if fn, ok := r.routes[routeKey{table: table}]; ok {
+			return fn
+		}
+	}
+	return r.fallback
+}
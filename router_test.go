@@ -0,0 +1,99 @@
+package sequin
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouter(t *testing.T) {
+	msg := func(ackID, schema, table string, action Action) Message {
+		return Message{
+			AckID:    ackID,
+			Action:   action,
+			Metadata: Metadata{TableSchema: schema, TableName: table},
+		}
+	}
+
+	t.Run("dispatches by table and action", func(t *testing.T) {
+		var calls []string
+		record := func(name string) MessageFunc {
+			return func(_ context.Context, m Message) error {
+				calls = append(calls, name+":"+m.AckID)
+				return nil
+			}
+		}
+
+		r := NewRouter().
+			OnInsert("users", record("users-insert")).
+			OnUpdate("users", record("users-update")).
+			OnDelete("public.users", record("users-delete")).
+			OnRead("users", record("users-read")).
+			Handle("orders", "", record("orders-any"))
+
+		err := r.Process(context.Background(), []Message{
+			msg("1", "public", "users", ActionInsert),
+			msg("2", "public", "users", ActionUpdate),
+			msg("3", "public", "users", ActionDelete),
+			msg("4", "public", "orders", ActionUpdate),
+			msg("5", "public", "users", ActionRead),
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"users-insert:1",
+			"users-update:2",
+			"users-delete:3",
+			"orders-any:4",
+			"users-read:5",
+		}, calls)
+	})
+
+	t.Run("prefers schema-qualified routes", func(t *testing.T) {
+		var got string
+		r := NewRouter().
+			OnInsert("users", func(context.Context, Message) error { got = "unqualified"; return nil }).
+			OnInsert("audit.users", func(context.Context, Message) error { got = "qualified"; return nil })
+
+		require.NoError(t, r.Process(context.Background(), []Message{msg("1", "audit", "users", ActionInsert)}))
+		assert.Equal(t, "qualified", got)
+	})
+
+	t.Run("skips unmatched messages without a default", func(t *testing.T) {
+		r := NewRouter().OnInsert("users", func(context.Context, Message) error {
+			t.Fatal("unexpected call")
+			return nil
+		})
+
+		require.NoError(t, r.Process(context.Background(), []Message{msg("1", "public", "orders", ActionInsert)}))
+	})
+
+	t.Run("falls back to default", func(t *testing.T) {
+		var got []string
+		r := NewRouter().Default(func(_ context.Context, m Message) error {
+			got = append(got, m.AckID)
+			return nil
+		})
+
+		require.NoError(t, r.Process(context.Background(), []Message{msg("1", "public", "orders", ActionInsert)}))
+		assert.Equal(t, []string{"1"}, got)
+	})
+
+	t.Run("stops at first error", func(t *testing.T) {
+		var calls int
+		r := NewRouter().OnInsert("users", func(context.Context, Message) error {
+			calls++
+			return errors.New("boom")
+		})
+
+		err := r.Process(context.Background(), []Message{
+			msg("1", "public", "users", ActionInsert),
+			msg("2", "public", "users", ActionInsert),
+		})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "boom")
+		assert.Equal(t, 1, calls)
+	})
+}
@@ -3,9 +3,13 @@ package sequin
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
@@ -18,9 +22,27 @@ type SequinClient interface {
 
 // Client represents a Sequin client
 type Client struct {
-	baseURL    string
-	token      string
-	httpClient *http.Client
+	baseURL      string // includes the path prefix
+	rawBaseURL   string // ClientOptions.BaseURL
+	pathPrefix   string // ClientOptions.PathPrefix
+	tokens       TokenProvider
+	httpClient   *http.Client
+	connectivity *connectivity
+	signer       RequestSigner
+	retry        *RetryOptions // nil if retries are disabled
+
+	onRateLimited func(req *http.Request, retryAfter time.Duration)
+	onResponse    func(ResponseInfo)
+	roundTrip     RoundTripFunc // httpClient.Do wrapped in middleware
+	middleware    Interceptor   // debug tracing and ClientOptions.Interceptors
+	logger        Logger
+	userAgent     string
+
+	receiveTimeout time.Duration
+	ackTimeout     time.Duration
+	conns          *connStats
+	breaker        *breaker
+	endpoints      *endpoints // nil without FallbackBaseURLs
 }
 
 // Ensure Client implements SequinClient interface
@@ -28,10 +50,148 @@ var _ SequinClient = (*Client)(nil)
 
 // ClientOptions configures the client behavior
 type ClientOptions struct {
-	Token      string        // API authentication token
-	BaseURL    string        // API base URL, defaults to "https://api.sequinstream.com/api"
-	HTTPClient *http.Client  // Custom HTTP client, optional
-	Timeout    time.Duration // HTTP client timeout, defaults to 30s
+	Token      string        // API authentication token, required unless TokenProvider is set
+	BaseURL    string        // API base URL, defaults to "https://api.sequinstream.com"
+	HTTPClient *http.Client  // Custom HTTP client, optional; transport options below are ignored if set
+	Timeout    time.Duration // HTTP client timeout, defaults to 150s; ignored if HTTPClient is set
+
+	// ReceiveTimeout and AckTimeout bound each Receive call and each Ack or
+	// Nack call respectively, including retries, so long-poll receives and
+	// quick acknowledgements can have different limits. Zero leaves calls
+	// bounded only by their context and Timeout, which still applies to
+	// every attempt.
+	ReceiveTimeout time.Duration
+	AckTimeout     time.Duration
+
+	// OnConnectivityChange is called whenever the client's ConnectivityState
+	// changes, e.g. to flip a readiness probe or alert operators. Optional.
+	OnConnectivityChange func(from, to ConnectivityState)
+
+	// DownAfter is how long requests must keep failing to reach Sequin before
+	// the client reports Down instead of Degraded. Defaults to 30s.
+	DownAfter time.Duration
+
+	// Signer optionally signs every outbound request, e.g. with an HMACSigner,
+	// for API gateways that require signed requests.
+	Signer RequestSigner
+
+	// TokenProvider supplies tokens dynamically, e.g. OAuth2ClientCredentials,
+	// instead of the static Token. Optional.
+	TokenProvider TokenProvider
+
+	// PathPrefix is the path under BaseURL where the Sequin API is mounted.
+	// Defaults to "/api". Set it to "/" for deployments behind a proxy that
+	// rewrites paths, e.g. BaseURL "https://gateway.internal/sequin" with
+	// PathPrefix "/" sends requests to "https://gateway.internal/sequin/http_pull_consumers/...".
+	// A BaseURL that already ends in PathPrefix is accepted as is.
+	PathPrefix string
+
+	// Retry enables retrying requests that fail transiently, with
+	// exponential backoff. If nil, requests are not retried.
+	Retry *RetryOptions
+
+	// OnRateLimited is called whenever the server rejects a request with 429
+	// Too Many Requests, with the wait it asked for in Retry-After (zero if
+	// none), e.g. to log or count throttling events. Rate-limited requests
+	// are retried after that wait when Retry is set, and otherwise fail with
+	// an error wrapping ErrRateLimited and an APIError carrying RetryAfter.
+	OnRateLimited func(req *http.Request, retryAfter time.Duration)
+
+	// FallbackBaseURLs are tried in order, with the same PathPrefix, when
+	// BaseURL can't be reached, e.g. for self-hosted deployments in several
+	// regions. A request that fails with a connection error or a 502, 503
+	// or 504 response is retried on the next URL straight away, without
+	// counting against Retry. A failing URL is skipped for
+	// FailoverCooldown, after which the client returns to it when it can,
+	// preferring URLs in the order listed.
+	FallbackBaseURLs []string
+
+	// FailoverCooldown is how long a base URL that failed is skipped.
+	// Defaults to 30s.
+	FailoverCooldown time.Duration
+
+	// CircuitBreaker stops sending requests after repeated failures, so a
+	// down API isn't hammered, and fails them fast with a
+	// *CircuitOpenError instead. If nil, there is no circuit breaker.
+	CircuitBreaker *CircuitBreakerOptions
+
+	// OnResponse is called after every attempt at an API call, with the
+	// response and its latency, e.g. to record rate-limit headers, request
+	// IDs or server timing in your own observability stack. Optional.
+	OnResponse func(ResponseInfo)
+
+	// Interceptors wrap every HTTP request the client sends, e.g. to add
+	// custom headers, log, or record metrics, without replacing HTTPClient.
+	// The first interceptor is the outermost. Interceptors run once per
+	// attempt, after the request has been authorized and signed.
+	Interceptors []Interceptor
+
+	// Logger receives client events such as retries, with method, URL and
+	// attempt fields. A *slog.Logger can be used directly.
+	// If nil, the client does not log.
+	Logger Logger
+
+	// Debug traces every HTTP exchange to Logger at Debug level: method, URL,
+	// status, latency and the start of both bodies, with credentials
+	// redacted. If Logger is nil, traces are written with the log package.
+	Debug bool
+
+	// AppName identifies your application to the server, e.g.
+	// "billing-worker/1.4". It is appended to the default User-Agent,
+	// "sequin-go/<version>", so server-side logs can attribute traffic.
+	AppName string
+
+	// UserAgent replaces the User-Agent header entirely, ignoring AppName.
+	UserAgent string
+
+	// TLSConfig configures TLS for connections to Sequin, e.g. for a
+	// self-hosted deployment behind an internal CA. Optional.
+	TLSConfig *tls.Config
+
+	// CACertFile is the path of a PEM bundle of additional CA certificates
+	// to trust, on top of the system pool (or TLSConfig.RootCAs). Optional.
+	CACertFile string
+
+	// ClientCertificate is presented to servers that require mutual TLS,
+	// e.g. an mTLS-terminating proxy in front of the Sequin API. Optional.
+	ClientCertificate *tls.Certificate
+
+	// ClientCertFile and ClientKeyFile are the paths of a PEM certificate
+	// and key to present for mutual TLS, as an alternative to
+	// ClientCertificate. The files are reloaded when they change, so
+	// rotated certificates are picked up without restarting.
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// ProxyURL routes requests through this proxy, e.g.
+	// "http://egress.internal:3128", instead of the proxy configured by the
+	// HTTP_PROXY and HTTPS_PROXY environment variables. Optional.
+	ProxyURL string
+
+	// NoProxy lists hosts that bypass ProxyURL, in the format of NO_PROXY:
+	// comma-separated host names (matching subdomains too), IP addresses
+	// and CIDR ranges, optionally with a port, or "*" for every host.
+	NoProxy string
+
+	// MaxIdleConnsPerHost is how many idle connections to Sequin are kept
+	// for reuse. Go's default of 2 makes processors with a high
+	// MaxConcurrent dial a new connection for most Receive and Ack calls;
+	// set it to at least MaxConcurrent+1 for those.
+	MaxIdleConnsPerHost int
+
+	// IdleConnTimeout is how long an idle connection is kept before it is
+	// closed. Defaults to 90s.
+	IdleConnTimeout time.Duration
+
+	// DisableHTTP2 sends requests over HTTP/1.1 only, e.g. for proxies
+	// that mishandle HTTP/2. By default HTTP/2 is used when the server
+	// supports it.
+	DisableHTTP2 bool
+
+	// OnConnection is called with how each request obtained its
+	// connection, e.g. to export connection reuse metrics. Optional; see
+	// also Client.ConnectionStats.
+	OnConnection func(ConnectionInfo)
 }
 
 // NewClient creates a new Sequin client
@@ -40,12 +200,15 @@ func NewClient(opts *ClientOptions) *Client {
 		opts = &ClientOptions{}
 	}
 
-	if opts.Token == "" {
+	if opts.Token == "" && opts.TokenProvider == nil {
 		panic("token is required")
 	}
 
 	if opts.BaseURL == "" {
-		opts.BaseURL = "https://api.sequinstream.com/api"
+		opts.BaseURL = "https://api.sequinstream.com"
+	}
+	if opts.PathPrefix == "" {
+		opts.PathPrefix = "/api"
 	}
 
 	if opts.HTTPClient == nil {
@@ -53,26 +216,329 @@ func NewClient(opts *ClientOptions) *Client {
 		if timeout == 0 {
 			timeout = 150 * time.Second
 		}
+		transport, err := newTransport(opts)
+		if err != nil {
+			panic(fmt.Sprintf("configuring transport: %v", err))
+		}
 		opts.HTTPClient = &http.Client{
-			Timeout: timeout,
+			Timeout:   timeout,
+			Transport: transport,
+		}
+	}
+
+	if opts.ReceiveTimeout < 0 || opts.AckTimeout < 0 {
+		panic("timeouts must not be negative")
+	}
+
+	var retry *RetryOptions
+	if opts.Retry != nil {
+		r := *opts.Retry
+		if err := r.validate(); err != nil {
+			panic(fmt.Sprintf("invalid retry options: %v", err))
+		}
+		retry = &r
+	}
+
+	if opts.FailoverCooldown < 0 {
+		panic("FailoverCooldown must not be negative")
+	}
+	var eps *endpoints
+	if len(opts.FallbackBaseURLs) > 0 {
+		cooldown := opts.FailoverCooldown
+		if cooldown == 0 {
+			cooldown = 30 * time.Second
+		}
+		eps = newEndpoints(opts.BaseURL, opts.FallbackBaseURLs, opts.PathPrefix, cooldown)
+	}
+
+	var cb *breaker
+	if opts.CircuitBreaker != nil {
+		o := *opts.CircuitBreaker
+		if err := o.validate(); err != nil {
+			panic(fmt.Sprintf("invalid circuit breaker options: %v", err))
+		}
+		cb = &breaker{opts: o}
+	}
+
+	tokens := opts.TokenProvider
+	if tokens == nil {
+		tokens = StaticToken(opts.Token)
+	}
+
+	downAfter := opts.DownAfter
+	if downAfter == 0 {
+		downAfter = 30 * time.Second
+	}
+
+	userAgent := opts.UserAgent
+	if userAgent == "" {
+		userAgent = "sequin-go/" + Version
+		if opts.AppName != "" {
+			userAgent += " " + opts.AppName
 		}
 	}
 
+	var logger Logger = nopLogger{}
+	if opts.Logger != nil {
+		logger = opts.Logger
+	} else if opts.Debug {
+		logger = stdLogger{debug: true}
+	}
+
+	interceptors, debug := opts.Interceptors, opts.Debug
+	middleware := func(roundTrip RoundTripFunc) RoundTripFunc {
+		if debug {
+			roundTrip = debugTrace(logger)(roundTrip)
+		}
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			roundTrip = interceptors[i](roundTrip)
+		}
+		return roundTrip
+	}
+
 	return &Client{
-		baseURL:    opts.BaseURL,
-		token:      opts.Token,
+		baseURL:    joinBaseURL(opts.BaseURL, opts.PathPrefix),
+		rawBaseURL: opts.BaseURL,
+		pathPrefix: opts.PathPrefix,
+		tokens:     tokens,
 		httpClient: opts.HTTPClient,
+		connectivity: &connectivity{
+			downAfter: downAfter,
+			onChange:  opts.OnConnectivityChange,
+		},
+		signer: opts.Signer,
+		retry:  retry,
+
+		onRateLimited: opts.OnRateLimited,
+		onResponse:    opts.OnResponse,
+		roundTrip:     middleware(opts.HTTPClient.Do),
+		middleware:    middleware,
+		logger:        logger,
+		userAgent:     userAgent,
+
+		receiveTimeout: opts.ReceiveTimeout,
+		ackTimeout:     opts.AckTimeout,
+		conns:          newConnStats(opts.OnConnection),
+		breaker:        cb,
+		endpoints:      eps,
+	}
+}
+
+// ResponseInfo describes one attempt at an API call, see
+// ClientOptions.OnResponse.
+type ResponseInfo struct {
+	Request *http.Request
+	// Response is nil if the request failed without a response. Its
+	// headers and status may be inspected, but its body must not be read.
+	Response *http.Response
+	Err      error
+	Latency  time.Duration // until the response headers arrived
+	Attempt  int           // starting at 1; see ClientOptions.Retry
+}
+
+// RoundTripFunc sends an HTTP request and returns its response.
+type RoundTripFunc func(*http.Request) (*http.Response, error)
+
+// Interceptor wraps the sending of requests, see ClientOptions.Interceptors.
+// It calls next to continue the chain, and may modify the request before
+// and inspect the response after.
+type Interceptor func(next RoundTripFunc) RoundTripFunc
+
+// withTimeout bounds ctx by timeout, unless timeout is zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// joinBaseURL combines baseURL and prefix into the root of all API paths,
+// without a trailing slash.
+func joinBaseURL(baseURL, prefix string) string {
+	baseURL = strings.TrimRight(baseURL, "/")
+	prefix = "/" + strings.Trim(prefix, "/")
+	if prefix == "/" || strings.HasSuffix(baseURL, prefix) {
+		return baseURL
+	}
+	return baseURL + prefix
+}
+
+// consumerURL returns the URL of an action on an HTTP pull consumer.
+func (c *Client) consumerURL(consumerGroupID, action string) string {
+	return c.baseURL + "/http_pull_consumers/" + url.PathEscape(consumerGroupID) + "/" + action
+}
+
+// ConnectivityState reports whether the client can currently reach Sequin.
+func (c *Client) ConnectivityState() ConnectivityState {
+	return c.connectivity.current()
+}
+
+// CircuitState reports the state of the client's circuit breaker, or
+// CircuitClosed if it has none.
+func (c *Client) CircuitState() CircuitState {
+	if c.breaker == nil {
+		return CircuitClosed
+	}
+	return c.breaker.current()
+}
+
+// do sends req with the client's credentials, retrying transient failures
+// if configured, and tracks connectivity and connection reuse.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	req = c.conns.trace(req)
+	// Only API paths can fail over to other base URLs
+	path, isAPI := strings.CutPrefix(req.URL.String(), c.baseURL)
+	refreshed := false
+	failovers := 0
+	for attempt := 1; ; attempt++ {
+		endpoint := 0
+		if c.endpoints != nil && isAPI {
+			endpoint = c.endpoints.pick(time.Now())
+			if err := c.endpoints.target(req, endpoint, path); err != nil {
+				return nil, fmt.Errorf("creating request: %w", err)
+			}
+		}
+
+		token, err := c.authorize(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.breaker != nil {
+			if err := c.breaker.allow(time.Now()); err != nil {
+				return nil, err
+			}
+		}
+
+		start := time.Now()
+		resp, err := c.roundTrip(req)
+		if c.onResponse != nil {
+			c.onResponse(ResponseInfo{
+				Request:  req,
+				Response: resp,
+				Err:      err,
+				Latency:  time.Since(start),
+				Attempt:  attempt,
+			})
+		}
+		c.connectivity.record(req, resp, err)
+		if c.breaker != nil {
+			c.breaker.record(req, resp, err, time.Now())
+		}
+
+		// Move on to the next base URL straight away if this one is down
+		if c.endpoints != nil && isAPI && !reachedServer(resp, err) && req.Context().Err() == nil {
+			c.endpoints.markDown(endpoint, time.Now())
+			if failovers < len(c.endpoints.urls)-1 {
+				failovers++
+				c.logger.Warn("Failing over", "method", req.Method, "from", c.endpoints.urls[endpoint])
+				if resp != nil {
+					discard(resp)
+				}
+				if err := rewind(req); err != nil {
+					return nil, err
+				}
+				attempt--
+				continue
+			}
+		}
+
+		// Retry once with a fresh token if a cached one was rejected
+		_, overridden := tokenFromContext(req.Context())
+		if invalidator, ok := c.tokens.(TokenInvalidator); ok && !refreshed && !overridden &&
+			err == nil && resp.StatusCode == http.StatusUnauthorized {
+			refreshed = true
+			invalidator.InvalidateToken(token)
+			discard(resp)
+			if err := rewind(req); err != nil {
+				return nil, err
+			}
+			attempt--
+			continue
+		}
+
+		var wait time.Duration
+		if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+			wait = retryAfter(resp, time.Now())
+			if c.onRateLimited != nil {
+				c.onRateLimited(req, wait)
+			}
+		}
+
+		if c.retry == nil || attempt >= c.retry.MaxAttempts || !retryable(req, resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			discard(resp)
+		}
+
+		// Wait at least as long as a rate-limited response asked
+		if d := c.retry.delay(attempt); d > wait {
+			wait = d
+		}
+		c.logRetry(req, resp, err, attempt, wait)
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+
+		if err := rewind(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// rewind resets the body of req so it can be sent again.
+func rewind(req *http.Request) error {
+	if req.GetBody == nil {
+		return nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return fmt.Errorf("rewinding request body: %w", err)
+	}
+	req.Body = body
+	return nil
+}
+
+// logRetry logs that a request will be retried after wait.
+func (c *Client) logRetry(req *http.Request, resp *http.Response, err error, attempt int, wait time.Duration) {
+	args := []any{"method", req.Method, "url", req.URL.Redacted(), "attempt", attempt, "delay", wait}
+	if err != nil {
+		args = append(args, "error", err)
+	} else {
+		args = append(args, "status_code", resp.StatusCode)
+	}
+	c.logger.Warn("Retrying request", args...)
+}
+
+// authorize sets the credentials and signature of req, returning the
+// token it used.
+func (c *Client) authorize(req *http.Request) (string, error) {
+	token, ok := tokenFromContext(req.Context())
+	if !ok {
+		var err error
+		if token, err = c.tokens.Token(req.Context()); err != nil {
+			return "", fmt.Errorf("getting token: %w", err)
+		}
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", c.userAgent)
+
+	if c.signer != nil {
+		if err := c.signer.Sign(req); err != nil {
+			return "", fmt.Errorf("signing request: %w", err)
+		}
 	}
+	return token, nil
 }
 
-// ReceiveResponse represents the response from the receive endpoint
+// ReceiveResponse represents the response from the receive endpoint.
+// Receive decodes it one element of Data at a time.
 type ReceiveResponse struct {
-	Data []struct {
-		AckID string `json:"ack_id"`
-		Data  struct {
-			Record json.RawMessage `json:"record"`
-		} `json:"data"`
-	} `json:"data"`
+	Data []receivedMessage `json:"data"`
 }
 
 // ReceiveParams represents parameters for the receive request
@@ -83,54 +549,166 @@ type ReceiveParams struct {
 
 // Receive fetches messages from a consumer
 func (c *Client) Receive(ctx context.Context, consumerGroupID string, params *ReceiveParams) ([]Message, error) {
-	url := fmt.Sprintf("%s/api/http_pull_consumers/%s/receive", c.baseURL, consumerGroupID)
+	var messages []Message
+	if params != nil && params.MaxBatchSize > 0 {
+		messages = make([]Message, 0, params.MaxBatchSize)
+	} else {
+		messages = []Message{}
+	}
+
+	err := c.ReceiveEach(ctx, consumerGroupID, params, func(msg Message) error {
+		messages = append(messages, msg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// ReceiveOne fetches a single message from a consumer, or nil if none is
+// available, for scripts and jobs that handle one message at a time.
+func (c *Client) ReceiveOne(ctx context.Context, consumerGroupID string) (*Message, error) {
+	messages, err := c.Receive(ctx, consumerGroupID, &ReceiveParams{MaxBatchSize: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+	return &messages[0], nil
+}
+
+// ReceiveEach fetches messages from a consumer like Receive, but decodes
+// the response incrementally and calls fn with each message as soon as it
+// is parsed. For large batches this lowers peak memory and the latency to
+// the first message. If fn returns an error, ReceiveEach stops and returns
+// it; the messages not yet handed to fn are redelivered once their
+// visibility timeout expires.
+func (c *Client) ReceiveEach(ctx context.Context, consumerGroupID string, params *ReceiveParams, fn func(Message) error) error {
+	ctx, cancel := withTimeout(ctx, c.receiveTimeout)
+	defer cancel()
+
+	url := c.consumerURL(consumerGroupID, "receive")
 
 	var body []byte
 	var err error
 	if params != nil {
 		body, err = json.Marshal(params)
 		if err != nil {
-			return nil, fmt.Errorf("marshaling receive params: %w", err)
+			return fmt.Errorf("marshaling receive params: %w", err)
 		}
 	}
 
 	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 	if err != nil {
-		return nil, fmt.Errorf("creating request: %w", err)
+		return fmt.Errorf("creating request: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+c.token)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return nil, fmt.Errorf("making request: %w", err)
+		return fmt.Errorf("making request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	if err := checkStatus(resp, consumerGroupID); err != nil {
+		return err
 	}
 
-	var receiveResp ReceiveResponse
-	if err := json.NewDecoder(resp.Body).Decode(&receiveResp); err != nil {
-		return nil, fmt.Errorf("decoding response: %w", err)
+	return decodeMessages(resp.Body, fn)
+}
+
+// receivedMessage is an element of ReceiveResponse.Data. It is an alias so
+// that Data keeps its original unnamed element type.
+type receivedMessage = struct {
+	AckID string `json:"ack_id"`
+	Data  struct {
+		Record   json.RawMessage `json:"record"`
+		Changes  json.RawMessage `json:"changes"`
+		Action   Action          `json:"action"`
+		Metadata Metadata        `json:"metadata"`
+	} `json:"data"`
+}
+
+// decodeMessages streams the messages of a ReceiveResponse from r to fn,
+// one element of its data array at a time.
+func decodeMessages(r io.Reader, fn func(Message) error) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
 	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("decoding response: %w", err)
+		}
+		if key != "data" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return fmt.Errorf("decoding response: %w", err)
+			}
+			continue
+		}
 
-	messages := make([]Message, len(receiveResp.Data))
-	for i, msg := range receiveResp.Data {
-		messages[i] = Message{
-			AckID:  msg.AckID,
-			Record: msg.Data.Record,
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("decoding response: %w", err)
+		}
+		if tok == nil {
+			continue // "data": null
+		}
+		if tok != json.Delim('[') {
+			return fmt.Errorf("decoding response: expected [, got %v", tok)
+		}
+		for dec.More() {
+			var msg receivedMessage
+			if err := dec.Decode(&msg); err != nil {
+				return fmt.Errorf("decoding response: %w", err)
+			}
+			err := fn(Message{
+				AckID:    msg.AckID,
+				Record:   msg.Data.Record,
+				Action:   msg.Data.Action,
+				Metadata: msg.Data.Metadata,
+				Changes:  nullAsNil(msg.Data.Changes),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return err
 		}
 	}
+	return expectDelim(dec, '}')
+}
 
-	return messages, nil
+// nullAsNil returns nil for a JSON null.
+func nullAsNil(raw json.RawMessage) json.RawMessage {
+	if string(raw) == "null" {
+		return nil
+	}
+	return raw
+}
+
+// expectDelim reads the next token from dec, which must be delim.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	if tok != delim {
+		return fmt.Errorf("decoding response: expected %v, got %v", delim, tok)
+	}
+	return nil
 }
 
 // Ack acknowledges messages as processed
 func (c *Client) Ack(ctx context.Context, consumerGroupID string, ackIDs []string) error {
-	url := fmt.Sprintf("%s/api/http_pull_consumers/%s/ack", c.baseURL, consumerGroupID)
+	ctx, cancel := withTimeout(ctx, c.ackTimeout)
+	defer cancel()
+
+	url := c.consumerURL(consumerGroupID, "ack")
 
 	body, err := json.Marshal(map[string][]string{
 		"ack_ids": ackIDs,
@@ -144,17 +722,14 @@ func (c *Client) Ack(ctx context.Context, consumerGroupID string, ackIDs []strin
 		return fmt.Errorf("creating request: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+c.token)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return fmt.Errorf("making request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	if err := checkStatus(resp, consumerGroupID); err != nil {
+		return err
 	}
 
 	return nil
@@ -162,11 +737,20 @@ func (c *Client) Ack(ctx context.Context, consumerGroupID string, ackIDs []strin
 
 // Nack negative acknowledges messages, making them available for redelivery
 func (c *Client) Nack(ctx context.Context, consumerGroupID string, ackIDs []string) error {
-	url := fmt.Sprintf("%s/api/http_pull_consumers/%s/nack", c.baseURL, consumerGroupID)
+	return c.nack(ctx, consumerGroupID, nackRequest{AckIDs: ackIDs})
+}
 
-	body, err := json.Marshal(map[string][]string{
-		"ack_ids": ackIDs,
-	})
+type nackRequest struct {
+	AckIDs []string `json:"ack_ids"`
+}
+
+func (c *Client) nack(ctx context.Context, consumerGroupID string, nack nackRequest) error {
+	ctx, cancel := withTimeout(ctx, c.ackTimeout)
+	defer cancel()
+
+	url := c.consumerURL(consumerGroupID, "nack")
+
+	body, err := json.Marshal(nack)
 	if err != nil {
 		return fmt.Errorf("marshaling nack request: %w", err)
 	}
@@ -176,24 +760,110 @@ func (c *Client) Nack(ctx context.Context, consumerGroupID string, ackIDs []stri
 		return fmt.Errorf("creating request: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+c.token)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return fmt.Errorf("making request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %w", err)
+	if err := checkStatus(resp, consumerGroupID); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Pinger is implemented by clients that can check that the server is
+// reachable, such as *Client. See ProcessorOptions.FailFast.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Ping checks that the server is reachable by calling its health endpoint,
+// GET <BaseURL>/health, which answers 200 while the server is up. Use it on
+// startup to fail fast with a clear error when BaseURL is wrong or the
+// server is down. It doesn't check the token or any consumer group.
+func (c *Client) Ping(ctx context.Context) error {
+	url := strings.TrimRight(c.rawBaseURL, "/") + "/health"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("making request: %w", err)
 	}
+	defer discard(resp)
 
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("no health endpoint at %s, check BaseURL: %w", url, newAPIError(resp))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return newAPIError(resp)
+	}
 	return nil
 }
 
 // Message represents a single message with its acknowledgment ID
 type Message struct {
-	AckID  string
-	Record json.RawMessage
+	AckID    string
+	Record   json.RawMessage
+	Action   Action   // The change that produced the record
+	Metadata Metadata // Source information for the record
+
+	// Changes holds the previous values of the fields an update changed,
+	// keyed by column. Nil for other actions.
+	Changes json.RawMessage
+}
+
+// Action is the kind of change a message represents
+type Action string
+
+const (
+	ActionInsert Action = "insert"
+	ActionUpdate Action = "update"
+	ActionDelete Action = "delete"
+	ActionRead   Action = "read" // Row emitted by a table backfill
+)
+
+// IsBackfill reports whether the message came from a table backfill rather
+// than live replication. Handlers can use it to skip side effects such as
+// notifications for historical rows while still materializing them.
+func (m Message) IsBackfill() bool {
+	return m.Action == ActionRead
+}
+
+// Metadata describes where a message's record came from
+type Metadata struct {
+	TableSchema string `json:"table_schema"`
+	TableName   string `json:"table_name"`
+	CommitLSN   int64  `json:"commit_lsn"` // Identifies the source transaction
+
+	// CommitTimestamp is when the source transaction committed. Zero if the
+	// server did not report it.
+	CommitTimestamp time.Time `json:"commit_timestamp"`
+
+	// TransactionAnnotations are the key/value annotations attached to the
+	// source transaction, e.g. a correlation ID or the originating service.
+	// Applications set them inside the transaction with
+	// pg_logical_emit_message('sequin:transaction_annotations.set', '{...}').
+	// Nil if the transaction has no annotations.
+	TransactionAnnotations map[string]any `json:"transaction_annotations,omitempty"`
+
+	CommitIdx    int64  `json:"commit_idx"`    // Position of the change within its transaction
+	DatabaseName string `json:"database_name"` // Name of the source database in Sequin
+
+	// Consumer identifies the consumer group that delivered the message.
+	Consumer ConsumerInfo `json:"consumer"`
+
+	// IdempotencyKey uniquely identifies the change, so handlers can
+	// deduplicate redelivered messages.
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+// ConsumerInfo identifies a consumer group in message metadata.
+type ConsumerInfo struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
 }
@@ -3,6 +3,13 @@ package sequin
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -35,6 +42,14 @@ func TestProcessor(t *testing.T) {
 					},
 					want: errors.New("BufferSize must be > 0"),
 				},
+				{
+					name: "NackOnShutdown with SpillPath",
+					opts: ProcessorOptions{
+						NackOnShutdown: true,
+						Prefetching:    &PrefetchingOptions{BufferSize: 1, SpillPath: "buffer.jsonl"},
+					},
+					want: errors.New("NackOnShutdown can't be used with SpillPath"),
+				},
 			}
 
 			for _, tt := range tests {
@@ -82,7 +97,8 @@ func TestProcessor(t *testing.T) {
 			// Create a channel to signal when processing is complete
 			done := make(chan error, 1)
 			go func() {
-				done <- p.Run(ctx)
+				err := runUntilCaughtUp(ctx, p)
+				done <- err
 			}()
 
 			// Wait for either processing to complete or timeout
@@ -164,15 +180,8 @@ func TestProcessor(t *testing.T) {
 		defer cancel()
 
 		start := time.Now()
-		errCh := make(chan error, 1)
-		go func() {
-			errCh <- p.Run(ctx)
-		}()
-
-		time.Sleep(50 * time.Millisecond)
-		cancel()
-
-		require.NoError(t, <-errCh)
+		err = runUntilCaughtUp(ctx, p)
+		require.NoError(t, err)
 		duration := time.Since(start)
 
 		// With 50 messages, batch size 5, and 3 concurrent processors,
@@ -187,6 +196,54 @@ func TestProcessor(t *testing.T) {
 		assert.Equal(t, 50, totalProcessed)
 	})
 
+	t.Run("shared limiter", func(t *testing.T) {
+		limiter, err := NewLimiter(LimiterOptions{MaxConcurrent: 2})
+		require.NoError(t, err)
+
+		var mu sync.Mutex
+		var active, maxActive, total int
+		handler := func(ctx context.Context, msgs []Message) error {
+			mu.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			mu.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mu.Lock()
+			active--
+			total += len(msgs)
+			mu.Unlock()
+			return nil
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			client := newMockClient()
+			client.setMessages(generateTestMessages(20))
+
+			p, err := NewProcessor(client, "test-group", handler, ProcessorOptions{
+				MaxBatchSize:  2,
+				MaxConcurrent: 4,
+				Limiter:       limiter,
+			})
+			require.NoError(t, err)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := runUntilCaughtUp(context.Background(), p)
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, 60, total)
+		assert.LessOrEqual(t, maxActive, 2)
+	})
+
 	t.Run("prefetching", func(t *testing.T) {
 		t.Run("buffers messages", func(t *testing.T) {
 			client := newMockClient()
@@ -228,201 +285,2177 @@ func TestProcessor(t *testing.T) {
 		})
 	})
 
-	t.Run("error handling", func(t *testing.T) {
-		t.Run("handles processor errors", func(t *testing.T) {
-			client := newMockClient()
-			processor := newTestProcessorFunc()
-			processor.err = errors.New("processing failed")
-
-			var errorHandlerCalled bool
-			errorHandler := func(_ context.Context, msgs []Message, err error) {
-				errorHandlerCalled = true
-				assert.EqualError(t, err, "handler failed: processing failed")
+	t.Run("backfill then live", func(t *testing.T) {
+		for _, prefetch := range []*PrefetchingOptions{nil, {BufferSize: 10}} {
+			prefetch := prefetch
+			name := "direct"
+			if prefetch != nil {
+				name = "prefetching"
 			}
 
-			msgs := generateTestMessages(1)
-			client.setMessages(msgs)
+			t.Run(name, func(t *testing.T) {
+				client := newMockClient()
+				processor := newTestProcessorFunc()
+
+				client.setMessages(generateTestMessages(25))
+
+				caughtUp := make(chan int, 2)
+				p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+					MaxBatchSize: 10,
+					Prefetching:  prefetch,
+					OnCaughtUp: func(context.Context) {
+						var total int
+						for _, batch := range processor.processedMessages() {
+							total += len(batch)
+						}
+						caughtUp <- total
+					},
+				})
+				require.NoError(t, err)
 
-			p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
-				MaxBatchSize: 1,
-				ErrorHandler: errorHandler,
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				errCh := make(chan error, 1)
+				go func() {
+					errCh <- p.Run(ctx)
+				}()
+
+				select {
+				case total := <-caughtUp:
+					assert.Equal(t, 25, total, "backfill should be fully processed before OnCaughtUp")
+				case <-time.After(500 * time.Millisecond):
+					t.Fatal("OnCaughtUp was not called")
+				}
+
+				// Live changes keep flowing after the transition
+				client.setMessages(generateTestMessages(3))
+				assert.Eventually(t, func() bool {
+					return len(processor.processedMessages()) > 3
+				}, 500*time.Millisecond, 5*time.Millisecond)
+
+				cancel()
+				require.NoError(t, <-errCh)
+				assert.Empty(t, caughtUp, "OnCaughtUp should be called once")
 			})
-			require.NoError(t, err)
+		}
+	})
 
-			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
-			defer cancel()
+	t.Run("groups by transaction", func(t *testing.T) {
+		client := newMockClient()
+		processor := newTestProcessorFunc()
 
-			errCh := make(chan error, 1)
-			go func() {
-				errCh <- p.Run(ctx)
-			}()
+		msgs := generateTestMessages(6)
+		for i, lsn := range []int64{100, 100, 100, 200, 0, 0} {
+			msgs[i].Metadata.CommitLSN = lsn
+		}
+		client.setMessages(msgs)
 
-			time.Sleep(50 * time.Millisecond)
-			cancel()
+		p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+			MaxBatchSize:       10,
+			GroupByTransaction: true,
+		})
+		require.NoError(t, err)
 
-			require.NoError(t, <-errCh)
-			assert.True(t, errorHandlerCalled)
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		err = runUntilCaughtUp(ctx, p)
+		require.NoError(t, err)
 
-			// Message should not have been acknowledged
-			acked := client.acknowledgedMessages()
-			assert.Empty(t, acked)
-		})
+		processed := processor.processedMessages()
+		require.Len(t, processed, 4)
+		assert.Equal(t, msgs[0:3], processed[0])
+		assert.Equal(t, msgs[3:4], processed[1])
+		assert.Equal(t, msgs[4:5], processed[2])
+		assert.Equal(t, msgs[5:6], processed[3])
+		assert.Equal(t, 4, client.ackCount)
+	})
 
-		t.Run("handles client errors", func(t *testing.T) {
+	t.Run("holds transactions split across receives", func(t *testing.T) {
+		for name, prefetching := range map[string]*PrefetchingOptions{
+			"direct":      nil,
+			"prefetching": {BufferSize: 10},
+		} {
+			prefetching := prefetching
+			t.Run(name, func(t *testing.T) {
+				client := newMockClient()
+				processor := newTestProcessorFunc()
+
+				msgs := generateTestMessages(7)
+				for i, lsn := range []int64{100, 100, 200, 200, 200, 200, 300} {
+					msgs[i].Metadata.CommitLSN = lsn
+				}
+				client.setMessages(msgs)
+
+				p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+					MaxBatchSize:       3,
+					FetchBatchSize:     3,
+					MaxConcurrent:      1,
+					GroupByTransaction: true,
+					Prefetching:        prefetching,
+				})
+				require.NoError(t, err)
+
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				err = runUntilCaughtUp(ctx, p)
+				require.NoError(t, err)
+
+				// Each transaction reaches the handler whole, even one larger
+				// than MaxBatchSize
+				assert.ElementsMatch(t, [][]Message{msgs[0:2], msgs[2:6], msgs[6:7]}, processor.processedMessages())
+				assert.Len(t, client.acknowledgedMessages(), 7)
+			})
+		}
+
+		t.Run("splits transactions that fill MaxInFlight", func(t *testing.T) {
 			client := newMockClient()
-			client.receiveErr = errors.New("receive failed")
 			processor := newTestProcessorFunc()
 
-			var errorHandlerCalled bool
-			errorHandler := func(_ context.Context, msgs []Message, err error) {
-				errorHandlerCalled = true
-				assert.Contains(t, err.Error(), "receive failed")
+			msgs := generateTestMessages(4)
+			for i := range msgs {
+				msgs[i].Metadata.CommitLSN = 100
 			}
+			client.setMessages(msgs)
 
 			p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
-				MaxBatchSize: 1,
-				ErrorHandler: errorHandler,
+				MaxBatchSize:       2,
+				MaxInFlight:        2,
+				GroupByTransaction: true,
 			})
 			require.NoError(t, err)
 
-			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 			defer cancel()
+			err = runUntilCaughtUp(ctx, p)
+			require.NoError(t, err)
+			assert.Equal(t, [][]Message{msgs[0:2], msgs[2:4]}, processor.processedMessages())
+		})
+	})
 
-			errCh := make(chan error, 1)
-			go func() {
-				errCh <- p.Run(ctx)
-			}()
+	t.Run("prefetch byte budget", func(t *testing.T) {
+		client := newMockClient()
 
-			time.Sleep(50 * time.Millisecond)
-			cancel()
+		msgs := make([]Message, 20)
+		for i := range msgs {
+			msgs[i] = Message{
+				AckID:  fmt.Sprintf("msg-%d", i),
+				Record: make([]byte, 100),
+			}
+		}
+		client.setMessages(msgs)
 
-			require.NoError(t, <-errCh)
-			assert.True(t, errorHandlerCalled)
+		release := make(chan struct{})
+		handler := func(ctx context.Context, msgs []Message) error {
+			<-release
+			return nil
+		}
+
+		p, err := NewProcessor(client, "test-group", handler, ProcessorOptions{
+			MaxBatchSize: 1,
+			Prefetching: &PrefetchingOptions{
+				BufferSize:     100,
+				MaxBufferBytes: 250,
+			},
 		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- p.Run(ctx)
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		assert.LessOrEqual(t, len(p.lanes[0].buffer), 2, "buffer should hold at most 250 bytes of records")
+
+		cancel()
+		close(release)
+		require.NoError(t, <-errCh)
 	})
 
-	t.Run("shutdown", func(t *testing.T) {
-		t.Run("completes in-flight messages", func(t *testing.T) {
-			client := newMockClient()
-			processor := newTestProcessorFunc()
-			processor.processDelay = 50 * time.Millisecond
+	t.Run("priority lanes", func(t *testing.T) {
+		client := newGroupedMockClient("urgent", "bulk")
 
-			msgs := generateTestMessages(10)
-			client.setMessages(msgs)
+		prefixed := func(prefix string, n int) []Message {
+			msgs := generateTestMessages(n)
+			for i := range msgs {
+				msgs[i].AckID = prefix + "-" + msgs[i].AckID
+			}
+			return msgs
+		}
+		client.groups["urgent"].setMessages(prefixed("urgent", 5))
+		client.groups["bulk"].setMessages(prefixed("bulk", 5))
+
+		var mu sync.Mutex
+		var order []string
+		started := make(chan struct{})
+		release := make(chan struct{})
+		handler := func(ctx context.Context, msgs []Message) error {
+			mu.Lock()
+			first := len(order) == 0
+			order = append(order, msgs[0].AckID)
+			mu.Unlock()
+
+			if first {
+				close(started)
+				<-release
+			}
+			return nil
+		}
 
-			p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
-				MaxBatchSize:  5,
-				MaxConcurrent: 2,
-			})
-			require.NoError(t, err)
+		p, err := NewPriorityProcessor(client, []string{"urgent", "bulk"}, handler, ProcessorOptions{
+			MaxBatchSize: 1,
+			Prefetching:  &PrefetchingOptions{BufferSize: 10},
+		})
+		require.NoError(t, err)
 
-			ctx, cancel := context.WithCancel(context.Background())
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- p.Run(ctx)
+		}()
 
-			errCh := make(chan error, 1)
-			go func() {
-				errCh <- p.Run(ctx)
-			}()
+		// Let both buffers fill while the first batch is blocked
+		<-started
+		time.Sleep(20 * time.Millisecond)
+		close(release)
 
-			// Wait for processing to start
-			time.Sleep(20 * time.Millisecond)
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(order) == 10
+		}, time.Second, 5*time.Millisecond)
 
-			// Cancel context and wait for shutdown
-			cancel()
+		cancel()
+		require.NoError(t, <-errCh)
 
-			// Should complete without error
-			require.NoError(t, <-errCh)
+		// After the first batch, every urgent message is handled before bulk ones
+		var seenBulk bool
+		for _, id := range order[1:] {
+			if strings.HasPrefix(id, "bulk") {
+				seenBulk = true
+			} else {
+				assert.False(t, seenBulk, "urgent message %s handled after bulk traffic", id)
+			}
+		}
 
-			// Check that messages that were in-flight were completed
-			processed := processor.processedMessages()
-			acked := client.acknowledgedMessages()
+		assert.Len(t, client.groups["urgent"].acknowledgedMessages(), 5)
+		assert.Len(t, client.groups["bulk"].acknowledgedMessages(), 5)
+	})
 
-			assert.NotEmpty(t, processed)
-			assert.NotEmpty(t, acked)
+	t.Run("fan-in takes lanes in turn", func(t *testing.T) {
+		client := newGroupedMockClient("users", "profiles", "settings")
+		p, err := NewFanInProcessor(client, []string{"users", "profiles", "settings"}, newTestProcessorFunc().handler, ProcessorOptions{
+			Prefetching: &PrefetchingOptions{BufferSize: 10},
 		})
+		require.NoError(t, err)
 
-		t.Run("drains prefetch buffer", func(t *testing.T) {
-			client := newMockClient()
-			processor := newTestProcessorFunc()
+		// users has more buffered messages than the other lanes
+		counts := map[string]int{"users": 4, "profiles": 2, "settings": 1}
+		for _, l := range p.lanes {
+			for i := 0; i < counts[l.consumerGroup]; i++ {
+				l.buffer <- bufferedMessage{msg: Message{AckID: l.consumerGroup}}
+			}
+		}
 
-			msgs := generateTestMessages(20)
-			client.setMessages(msgs)
+		var order []string
+		for i := 0; i < 7; i++ {
+			l, b := p.takeBuffered()
+			assert.Equal(t, l.consumerGroup, b.msg.AckID)
+			order = append(order, l.consumerGroup)
+		}
+		assert.Equal(t, []string{"users", "profiles", "settings", "users", "profiles", "users", "users"}, order)
+	})
 
-			p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
-				MaxBatchSize:  5,
-				MaxConcurrent: 2,
-				Prefetching: &PrefetchingOptions{
-					BufferSize: 10,
-				},
-			})
-			require.NoError(t, err)
+	t.Run("preserves per-key ordering", func(t *testing.T) {
+		client := newGroupedMockClient("users", "profiles")
+		for group, c := range client.groups {
+			msgs := make([]Message, 12)
+			for i := range msgs {
+				msgs[i] = Message{
+					AckID:  fmt.Sprintf("%s-%d", group, i),
+					Record: []byte(fmt.Sprintf(`{"id": %d}`, i%3)),
+				}
+			}
+			c.setMessages(msgs)
+		}
 
-			ctx, cancel := context.WithCancel(context.Background())
+		type key struct{ group, id string }
+		keyOf := func(msg Message) key {
+			group, _, _ := strings.Cut(msg.AckID, "-")
+			return key{group, string(msg.Record)}
+		}
 
-			errCh := make(chan error, 1)
-			go func() {
-				errCh <- p.Run(ctx)
-			}()
+		var mu sync.Mutex
+		inFlight := make(map[key]bool)
+		handled := make(map[key][]string)
+		handler := func(ctx context.Context, msgs []Message) error {
+			k := keyOf(msgs[0])
+			mu.Lock()
+			assert.False(t, inFlight[k], "key %v handled concurrently", k)
+			inFlight[k] = true
+			mu.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mu.Lock()
+			inFlight[k] = false
+			handled[k] = append(handled[k], msgs[0].AckID)
+			mu.Unlock()
+			return nil
+		}
 
-			// Wait for buffer to fill
-			time.Sleep(50 * time.Millisecond)
+		p, err := NewFanInProcessor(client, []string{"users", "profiles"}, handler, ProcessorOptions{
+			MaxBatchSize:  1,
+			MaxConcurrent: 6,
+			Prefetching:   &PrefetchingOptions{BufferSize: 20},
+			OrderingKey:   func(msg Message) string { return string(msg.Record) },
+		})
+		require.NoError(t, err)
 
-			// Cancel context
-			cancel()
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		err = runUntilCaughtUp(ctx, p)
+		require.NoError(t, err)
 
-			require.NoError(t, <-errCh)
+		mu.Lock()
+		defer mu.Unlock()
+		require.Len(t, handled, 6)
+		for group := range client.groups {
+			for id := 0; id < 3; id++ {
+				var want []string
+				for i := id; i < 12; i += 3 {
+					want = append(want, fmt.Sprintf("%s-%d", group, i))
+				}
+				assert.Equal(t, want, handled[key{group, fmt.Sprintf(`{"id": %d}`, id)}])
+			}
+			assert.Len(t, client.groups[group].acknowledgedMessages(), 12)
+		}
+	})
 
-			// Verify messages in buffer were processed
-			processed := processor.processedMessages()
-			var totalProcessed int
-			for _, batch := range processed {
-				totalProcessed += len(batch)
+	t.Run("partitions batches by key", func(t *testing.T) {
+		client := newMockClient()
+		msgs := make([]Message, 12)
+		for i := range msgs {
+			msgs[i] = Message{
+				AckID:    fmt.Sprintf("msg-%d", i),
+				Record:   []byte(fmt.Sprintf(`{"id": %d}`, i%4)),
+				Metadata: Metadata{TableSchema: "public", TableName: "users"},
 			}
-			assert.True(t, totalProcessed >= 10, "Should process at least buffered messages")
+		}
+		client.setMessages(msgs)
+
+		var mu sync.Mutex
+		handled := make(map[string][]string)
+		p, err := NewProcessor(client, "test-group", func(ctx context.Context, batch []Message) error {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, msg := range batch {
+				assert.Equal(t, partitionOf(RecordKey(batch[0]), 3), partitionOf(RecordKey(msg), 3), "sub-batch spans partitions")
+				handled[RecordKey(msg)] = append(handled[RecordKey(msg)], msg.AckID)
+			}
+			return nil
+		}, ProcessorOptions{
+			MaxBatchSize:   12,
+			MaxConcurrent:  3,
+			PartitionByKey: true,
 		})
+		require.NoError(t, err)
+		err = runUntilCaughtUp(context.Background(), p)
+		require.NoError(t, err)
 
-		t.Run("stops receiving after shutdown", func(t *testing.T) {
-			client := newMockClient()
-			client.receiveDelay = 10 * time.Millisecond
-			processor := newTestProcessorFunc()
+		require.Len(t, handled, 4)
+		for id := 0; id < 4; id++ {
+			var want []string
+			for i := id; i < 12; i += 4 {
+				want = append(want, fmt.Sprintf("msg-%d", i))
+			}
+			assert.Equal(t, want, handled[fmt.Sprintf("public.users:%d", id)])
+		}
+		assert.Len(t, client.acknowledgedMessages(), 12)
 
-			msgs := generateTestMessages(100)
-			client.setMessages(msgs)
+		_, err = NewProcessor(client, "test-group", newTestProcessorFunc().handler, ProcessorOptions{PartitionByKey: true, GroupByTransaction: true})
+		assert.EqualError(t, err, "invalid options: PartitionByKey can't be used with GroupByTransaction")
 
-			p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
-				MaxBatchSize:  5,
-				MaxConcurrent: 2,
+		t.Run("nacks every undispatched partition on stop", func(t *testing.T) {
+			client := newMockClient()
+			client.setMessages(msgs[:8])
+
+			release := make(chan struct{})
+			p, err := NewProcessor(client, "test-group", func(ctx context.Context, batch []Message) error {
+				<-release
+				return nil
+			}, ProcessorOptions{
+				MaxBatchSize:   4,
+				MaxConcurrent:  2,
+				PartitionByKey: true,
 			})
 			require.NoError(t, err)
 
-			ctx, cancel := context.WithCancel(context.Background())
-
 			errCh := make(chan error, 1)
 			go func() {
-				errCh <- p.Run(ctx)
+				errCh <- p.Run(context.Background())
 			}()
-
-			// Let it process some messages
-			time.Sleep(30 * time.Millisecond)
-
-			// Get current receive count
-			initialReceiveCount := client.receiveCount
-
-			// Cancel and wait for shutdown
-			cancel()
+			require.Eventually(t, func() bool {
+				client.mu.Lock()
+				defer client.mu.Unlock()
+				return client.messageIdx == 8
+			}, time.Second, time.Millisecond, "the second batch waits for a slot")
+
+			stopped := make(chan error, 1)
+			go func() { stopped <- p.Stop(context.Background()) }()
+			require.Eventually(t, p.stopRequested, time.Second, time.Millisecond)
+			close(release)
+			require.NoError(t, <-stopped)
 			require.NoError(t, <-errCh)
 
-			// Wait a bit to ensure no more receives
-			time.Sleep(20 * time.Millisecond)
-
-			// Should have minimal additional receives during shutdown
-			finalReceiveCount := client.receiveCount
-			assert.Less(t, finalReceiveCount-initialReceiveCount, 3,
-				"Should not make many new receives during shutdown")
+			settled := client.acknowledgedMessages()
+			client.mu.Lock()
+			settled = append(settled, client.nackedMessages...)
+			client.mu.Unlock()
+			var want []string
+			for _, msg := range msgs[:8] {
+				want = append(want, msg.AckID)
+			}
+			assert.ElementsMatch(t, want, settled)
 		})
 	})
 
-	t.Run("stress test", func(t *testing.T) {
-		if testing.Short() {
+	t.Run("handles each partition on its own worker", func(t *testing.T) {
+		client := newMockClient()
+		msgs := make([]Message, 20)
+		for i := range msgs {
+			msgs[i] = Message{
+				AckID:  fmt.Sprintf("msg-%d", i),
+				Record: []byte(fmt.Sprintf(`{"id": %d}`, i%5)),
+			}
+		}
+		client.setMessages(msgs)
+
+		var mu sync.Mutex
+		busy := make(map[int]bool)
+		handled := make(map[string][]string)
+		p, err := NewProcessor(client, "test-group", func(ctx context.Context, batch []Message) error {
+			partition, ok := PartitionFromContext(ctx)
+			require.True(t, ok)
+			mu.Lock()
+			assert.False(t, busy[partition], "partition %d handled concurrently", partition)
+			busy[partition] = true
+			mu.Unlock()
+
+			time.Sleep(2 * time.Millisecond)
+
+			mu.Lock()
+			defer mu.Unlock()
+			busy[partition] = false
+			for _, msg := range batch {
+				assert.Equal(t, partitionOf(RecordKey(msg), 3), partition)
+				handled[RecordKey(msg)] = append(handled[RecordKey(msg)], msg.AckID)
+			}
+			return nil
+		}, ProcessorOptions{
+			MaxBatchSize:     4,
+			MaxConcurrent:    3,
+			Prefetching:      &PrefetchingOptions{BufferSize: 20},
+			StickyPartitions: true,
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		err = runUntilCaughtUp(ctx, p)
+		require.NoError(t, err)
+
+		require.Len(t, handled, 5)
+		for id := 0; id < 5; id++ {
+			var want []string
+			for i := id; i < 20; i += 5 {
+				want = append(want, fmt.Sprintf("msg-%d", i))
+			}
+			assert.Equal(t, want, handled[fmt.Sprintf(":%d", id)])
+		}
+		assert.Len(t, client.acknowledgedMessages(), 20)
+	})
+
+	t.Run("waits FlushInterval to fill batches", func(t *testing.T) {
+		client := newMockClient()
+		client.setMessages(generateTestMessages(4))
+		client.receiveDelay = 10 * time.Millisecond
+		processor := newTestProcessorFunc()
+
+		p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+			MaxBatchSize:   4,
+			FetchBatchSize: 1,
+			Prefetching:    &PrefetchingOptions{BufferSize: 10, FlushInterval: time.Second},
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		err = runUntilCaughtUp(ctx, p)
+		require.NoError(t, err)
+
+		processor.mu.Lock()
+		defer processor.mu.Unlock()
+		require.Len(t, processor.processed, 1, "messages trickling in should fill one batch")
+		assert.Len(t, processor.processed[0], 4)
+
+		_, err = NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+			Prefetching: &PrefetchingOptions{BufferSize: 10, FlushInterval: -time.Second},
+		})
+		assert.ErrorContains(t, err, "FlushInterval must be >= 0")
+	})
+
+	t.Run("caps messages in flight", func(t *testing.T) {
+		client := newMockClient()
+		client.setMessages(generateTestMessages(20))
+
+		var mu sync.Mutex
+		var inFlight, peak int
+		p, err := NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+			mu.Lock()
+			inFlight += len(msgs)
+			if inFlight > peak {
+				peak = inFlight
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			inFlight -= len(msgs)
+			mu.Unlock()
+			return nil
+		}, ProcessorOptions{
+			MaxBatchSize:   2,
+			FetchBatchSize: 10,
+			MaxConcurrent:  4,
+			MaxInFlight:    5,
+			Prefetching:    &PrefetchingOptions{BufferSize: 20},
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		err = runUntilCaughtUp(ctx, p)
+		require.NoError(t, err)
+
+		assert.Len(t, client.acknowledgedMessages(), 20)
+		assert.LessOrEqual(t, peak, 5)
+		client.mu.Lock()
+		for _, params := range client.receiveParams {
+			assert.LessOrEqual(t, params.MaxBatchSize, 5)
+		}
+		client.mu.Unlock()
+
+		// Messages dropped as the run ends give their room back
+		client = newMockClient()
+		client.setMessages(generateTestMessages(4))
+		release := make(chan struct{})
+		p, err = NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+			<-release
+			return nil
+		}, ProcessorOptions{MaxConcurrent: 1, MaxInFlight: 4})
+		require.NoError(t, err)
+
+		ctx, cancel = context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- p.Run(ctx) }()
+		require.Eventually(t, func() bool {
+			client.mu.Lock()
+			defer client.mu.Unlock()
+			return client.messageIdx == 2
+		}, time.Second, time.Millisecond, "the second batch waits for a slot")
+		cancel()
+		close(release)
+		require.NoError(t, <-done)
+		assert.True(t, p.inFlight.TryAcquire(4), "no room should stay reserved after Run returns")
+
+		_, err = NewProcessor(client, "test-group", newTestProcessorFunc().handler, ProcessorOptions{MaxInFlight: -1})
+		assert.ErrorContains(t, err, "MaxInFlight must be >= 0")
+	})
+
+	t.Run("autoscales concurrency", func(t *testing.T) {
+		client := newMockClient()
+		client.setMessages(generateTestMessages(100))
+
+		var mu sync.Mutex
+		var running, peak int
+		p, err := NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+			mu.Lock()
+			running++
+			if running > peak {
+				peak = running
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return nil
+		}, ProcessorOptions{
+			MaxBatchSize:   1,
+			FetchBatchSize: 10,
+			MaxConcurrent:  4,
+			Prefetching:    &PrefetchingOptions{BufferSize: 20},
+			Autoscale:      &AutoscaleOptions{Interval: 10 * time.Millisecond, LatencyTolerance: 10},
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = runUntilCaughtUp(ctx, p)
+		require.NoError(t, err)
+
+		assert.Len(t, client.acknowledgedMessages(), 100)
+		assert.Greater(t, peak, 1, "should scale up under backlog")
+		assert.LessOrEqual(t, peak, 4)
+
+		t.Run("decides from backlog and latency", func(t *testing.T) {
+			a := newAutoscaler(AutoscaleOptions{MinConcurrent: 1, LatencyTolerance: 1.5}, 4, stdLogger{})
+			a.limit = 2
+			backlogged := autoscaleStats{loadStats: loadStats{receives: 4, fullReceives: 4, batches: 10, latency: 100 * time.Millisecond}, peakBusy: 2}
+			assert.Equal(t, 3, a.next(backlogged))
+
+			slow := backlogged
+			slow.latency = 200 * time.Millisecond
+			assert.Equal(t, 1, a.next(slow), "should shrink when latency degrades")
+
+			var shrinks int
+			for i := 0; i < 10; i++ {
+				a.limit = 2
+				if a.next(slow) < 2 {
+					shrinks++
+				}
+			}
+			assert.Less(t, shrinks, 10, "a lasting slowdown should become the new baseline")
+
+			a.limit = 4
+			assert.Equal(t, 4, a.next(backlogged), "should not exceed MaxConcurrent")
+			idle := autoscaleStats{loadStats: loadStats{receives: 4, batches: 2, latency: 20 * time.Millisecond}, peakBusy: 1}
+			assert.Equal(t, 3, a.next(idle), "should shrink when slots sit idle")
+		})
+
+		_, err = NewProcessor(client, "test-group", newTestProcessorFunc().handler, ProcessorOptions{
+			MaxConcurrent: 2,
+			Autoscale:     &AutoscaleOptions{MinConcurrent: 3},
+		})
+		assert.ErrorContains(t, err, "MinConcurrent must be <= MaxConcurrent (2), got 3")
+	})
+
+	t.Run("auto-sizes the prefetch buffer", func(t *testing.T) {
+		client := newMockClient()
+		client.setMessages(generateTestMessages(50))
+		processor := newTestProcessorFunc()
+
+		p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+			MaxBatchSize:   5,
+			FetchBatchSize: 5,
+			Prefetching: &PrefetchingOptions{
+				BufferSize: 40,
+				AutoSize:   &BufferAutoSizeOptions{MinBufferSize: 5, Interval: 10 * time.Millisecond},
+			},
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = runUntilCaughtUp(ctx, p)
+		require.NoError(t, err)
+		assert.Len(t, client.acknowledgedMessages(), 50)
+
+		t.Run("decides from backlog and latency", func(t *testing.T) {
+			s := newBufferSizer(BufferAutoSizeOptions{MinBufferSize: 5, LatencyTolerance: 1.5}, 40, 1, stdLogger{})
+			assert.True(t, s.tryAcquire())
+			for i := 1; i < 5; i++ {
+				require.True(t, s.tryAcquire())
+			}
+			assert.False(t, s.tryAcquire(), "should start at MinBufferSize")
+
+			starving := bufferSizeStats{loadStats: loadStats{receives: 4, fullReceives: 4, batches: 10, latency: 100 * time.Millisecond}, starved: 2}
+			assert.Equal(t, 10, s.next(starving))
+
+			s.size = 30
+			assert.Equal(t, 40, s.next(starving), "should not exceed BufferSize")
+
+			slow := starving
+			slow.latency = 200 * time.Millisecond
+			assert.Equal(t, 15, s.next(slow), "should halve when latency degrades")
+		})
+
+		_, err = NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+			Prefetching: &PrefetchingOptions{BufferSize: 10, AutoSize: &BufferAutoSizeOptions{MinBufferSize: 20}},
+		})
+		assert.ErrorContains(t, err, "MinBufferSize must be <= BufferSize (10), got 20")
+	})
+
+	t.Run("backs off on empty receives", func(t *testing.T) {
+		client := newMockClient()
+		processor := newTestProcessorFunc()
+
+		p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+			Prefetching: &PrefetchingOptions{BufferSize: 10},
+			IdleBackoff: &IdleBackoffOptions{MinDelay: 20 * time.Millisecond, MaxDelay: 40 * time.Millisecond},
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(200*time.Millisecond, cancel)
+		require.NoError(t, p.Run(ctx))
+
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		assert.LessOrEqual(t, client.receiveCount, 8, "should wait 20ms, 40ms, 40ms... between empty receives")
+		assert.GreaterOrEqual(t, client.receiveCount, 3)
+
+		_, err = NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+			IdleBackoff: &IdleBackoffOptions{MinDelay: time.Second, MaxDelay: time.Millisecond},
+		})
+		assert.ErrorContains(t, err, "MaxDelay must be >= MinDelay (1s), got 1ms")
+	})
+
+	t.Run("compacts batches by key", func(t *testing.T) {
+		client := newMockClient()
+		client.setMessages([]Message{
+			{AckID: "a", Action: ActionUpdate, Record: []byte(`{"id": 1, "name": "b"}`), Changes: []byte(`{"name": "a"}`)},
+			{AckID: "b", Action: ActionInsert, Record: []byte(`{"id": 2}`)},
+			{AckID: "c", Action: ActionUpdate, Record: []byte(`{"id": 1, "name": "c", "age": 3}`), Changes: []byte(`{"name": "b", "age": 2}`)},
+			{AckID: "d", Action: ActionUpdate, Record: []byte(`{"name": "keyless"}`)},
+		})
+
+		var handled []Message
+		p, err := NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+			handled = append(handled, msgs...)
+			return nil
+		}, ProcessorOptions{
+			MaxBatchSize:   4,
+			CompactBatches: true,
+		})
+		require.NoError(t, err)
+		err = runUntilCaughtUp(context.Background(), p)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"b", "c", "d"}, ackIDsOf(handled))
+		assert.JSONEq(t, `{"name": "a", "age": 2}`, string(handled[1].Changes))
+		assert.Equal(t, []string{"a", "b", "c", "d"}, client.acknowledgedMessages())
+
+		t.Run("fails collapsed messages with the latest", func(t *testing.T) {
+			client.setMessages([]Message{
+				{AckID: "e", Record: []byte(`{"id": 1}`)},
+				{AckID: "f", Record: []byte(`{"id": 2}`)},
+				{AckID: "g", Record: []byte(`{"id": 1}`)},
+			})
+
+			var failed []Message
+			p, err := NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+				result := &BatchResult{}
+				for _, msg := range msgs {
+					if msg.AckID == "g" {
+						result.Fail(msg, errors.New("sink rejected row"))
+					}
+				}
+				return result.Err()
+			}, ProcessorOptions{
+				MaxBatchSize:   3,
+				CompactBatches: true,
+				ErrorHandler:   func(_ context.Context, msgs []Message, _ error) { failed = append(failed, msgs...) },
+			})
+			require.NoError(t, err)
+			err = runUntilCaughtUp(context.Background(), p)
+			require.NoError(t, err)
+
+			assert.Equal(t, []string{"e", "g"}, ackIDsOf(failed))
+			assert.Equal(t, []string{"a", "b", "c", "d", "f"}, client.acknowledgedMessages())
+		})
+
+		_, err = NewProcessor(client, "test-group", newTestProcessorFunc().handler, ProcessorOptions{CompactBatches: true, AckPolicy: Manual})
+		assert.ErrorContains(t, err, "CompactBatches can't be used with the manual AckPolicy")
+	})
+
+	t.Run("keys records by table and id", func(t *testing.T) {
+		assert.Equal(t, `users:"a1"`, RecordKey(Message{AckID: "1", Record: []byte(`{"id": "a1", "name": "x"}`), Metadata: Metadata{TableName: "users"}}))
+		assert.Equal(t, "ack:2", RecordKey(Message{AckID: "2", Record: []byte(`{"name": "x"}`)}))
+	})
+
+	t.Run("defers future messages", func(t *testing.T) {
+		client := newMockClient()
+		processor := newTestProcessorFunc()
+
+		msgs := generateTestMessages(4)
+		client.setMessages(msgs)
+
+		start := time.Now()
+		due := start.Add(100 * time.Millisecond)
+		var nackedWhenCaughtUp []string
+		p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+			MaxBatchSize: 10,
+			DeferUntil: func(msg Message) time.Time {
+				if msg.AckID == "msg-1" || msg.AckID == "msg-3" {
+					return due
+				}
+				return time.Time{}
+			},
+			OnCaughtUp: func(context.Context) {
+				if nackedWhenCaughtUp == nil {
+					nackedWhenCaughtUp = append([]string{}, client.nacked()...)
+				}
+			},
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- p.Run(ctx)
+		}()
+
+		// Deferred messages are held until they are due, then nacked
+		require.Eventually(t, func() bool {
+			return len(client.nacked()) == 2
+		}, time.Second, 5*time.Millisecond)
+		assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+		cancel()
+		require.NoError(t, <-errCh)
+
+		processed := processor.processedMessages()
+		require.Len(t, processed, 1)
+		assert.Equal(t, []Message{msgs[0], msgs[2]}, processed[0])
+		assert.Equal(t, []string{"msg-0", "msg-2"}, client.acknowledgedMessages())
+		assert.Empty(t, nackedWhenCaughtUp, "deferred messages should not be nacked before they are due")
+		assert.Equal(t, []string{"msg-1", "msg-3"}, client.nacked())
+	})
+
+	t.Run("run until empty", func(t *testing.T) {
+		client := newMockClient()
+		processor := newTestProcessorFunc()
+		client.setMessages(generateTestMessages(25))
+		client.receiveLimit = 4 // short batches don't end the run
+
+		var checkpoints []CatchUpResult
+		p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+			MaxBatchSize: 10,
+			Prefetching:  &PrefetchingOptions{BufferSize: 20},
+			Checkpoint: func(_ context.Context, result CatchUpResult) error {
+				checkpoints = append(checkpoints, result)
+				return nil
+			},
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		result, err := p.RunUntilEmpty(ctx)
+		require.NoError(t, err)
+		assert.True(t, result.Drained)
+		assert.Equal(t, 25, result.Processed)
+		assert.Len(t, client.acknowledgedMessages(), 25)
+		assert.False(t, result.FallingBehind(time.Minute))
+
+		require.Len(t, checkpoints, 1)
+		assert.Equal(t, result, checkpoints[0])
+	})
+
+	t.Run("warns when catch-up runs fall behind", func(t *testing.T) {
+		client := newMockClient()
+		client.setMessages(generateTestMessages(5))
+
+		logger := &recordingLogger{}
+		p, err := NewProcessor(client, "test-group", newTestProcessorFunc().handler, ProcessorOptions{
+			MaxBatchSize:    10,
+			CatchUpInterval: time.Nanosecond,
+			Logger:          logger,
+		})
+		require.NoError(t, err)
+
+		result, err := p.RunUntilEmpty(context.Background())
+		require.NoError(t, err)
+		assert.True(t, result.FallingBehind(time.Nanosecond))
+		assert.Equal(t, []string{"Catch-up run is falling behind its schedule"}, logger.warnings)
+
+		p.opts.CatchUpInterval = time.Minute
+		logger.warnings = nil
+		client.setMessages(generateTestMessages(5))
+		_, err = p.RunUntilEmpty(context.Background())
+		require.NoError(t, err)
+		assert.Empty(t, logger.warnings)
+
+		_, err = NewProcessor(client, "test-group", newTestProcessorFunc().handler, ProcessorOptions{CatchUpInterval: -time.Second})
+		assert.ErrorContains(t, err, "CatchUpInterval must be >= 0")
+	})
+
+	t.Run("keeps consuming after a short batch", func(t *testing.T) {
+		client := newMockClient()
+		processor := newTestProcessorFunc()
+		client.setMessages(generateTestMessages(5))
+
+		p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+			MaxBatchSize: 10,
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- p.Run(ctx)
+		}()
+
+		assert.Eventually(t, func() bool {
+			return len(client.acknowledgedMessages()) == 5
+		}, time.Second, 5*time.Millisecond)
+
+		client.setMessages([]Message{{AckID: "late"}})
+		assert.Eventually(t, func() bool {
+			return len(client.acknowledgedMessages()) == 6
+		}, time.Second, 5*time.Millisecond, "Run should not return after a short batch")
+
+		cancel()
+		require.NoError(t, <-errCh)
+	})
+
+	t.Run("tunes options at runtime", func(t *testing.T) {
+		t.Run("batch size", func(t *testing.T) {
+			client := newMockClient()
+			client.setMessages(generateTestMessages(20))
+
+			var p *Processor
+			var once sync.Once
+			p, err := NewProcessor(client, "test-group", func(context.Context, []Message) error {
+				once.Do(func() { require.NoError(t, p.SetMaxBatchSize(2)) })
+				return nil
+			}, ProcessorOptions{MaxBatchSize: 5})
+			require.NoError(t, err)
+
+			err = runUntilCaughtUp(context.Background(), p)
+			require.NoError(t, err)
+			// The second receive may start before the first batch is handled
+			sizes := client.receivedBatchSizes()
+			require.Greater(t, len(sizes), 2)
+			assert.Equal(t, 5, sizes[0])
+			for _, size := range sizes[2:] {
+				assert.Equal(t, 2, size)
+			}
+			assert.Len(t, client.acknowledgedMessages(), 20)
+
+			assert.EqualError(t, p.SetMaxBatchSize(0), "MaxBatchSize must be > 0, got 0")
+			assert.EqualError(t, p.SetFetchBatchSize(-1), "FetchBatchSize must be > 0, got -1")
+		})
+
+		t.Run("concurrency", func(t *testing.T) {
+			client := newMockClient()
+			client.setMessages(generateTestMessages(20))
+
+			var p *Processor
+			var once sync.Once
+			var mu sync.Mutex
+			var active, maxActive int
+			p, err := NewProcessor(client, "test-group", func(context.Context, []Message) error {
+				once.Do(func() { require.NoError(t, p.SetMaxConcurrent(4)) })
+				mu.Lock()
+				active++
+				if active > maxActive {
+					maxActive = active
+				}
+				mu.Unlock()
+
+				time.Sleep(10 * time.Millisecond)
+
+				mu.Lock()
+				active--
+				mu.Unlock()
+				return nil
+			}, ProcessorOptions{MaxConcurrent: 1})
+			require.NoError(t, err)
+
+			err = runUntilCaughtUp(context.Background(), p)
+			require.NoError(t, err)
+			assert.Len(t, client.acknowledgedMessages(), 20)
+			assert.Greater(t, maxActive, 1)
+			assert.LessOrEqual(t, maxActive, 4)
+
+			assert.EqualError(t, p.SetMaxConcurrent(0), "MaxConcurrent must be > 0, got 0")
+			assert.NoError(t, p.SetMaxConcurrent(1<<20))
+
+			p, err = NewProcessor(client, "test-group", func(context.Context, []Message) error { return nil }, ProcessorOptions{
+				MaxConcurrent: 2,
+				Autoscale:     &AutoscaleOptions{},
+			})
+			require.NoError(t, err)
+			assert.EqualError(t, p.SetMaxConcurrent(4), "MaxConcurrent can't be changed with Autoscale")
+		})
+	})
+
+	t.Run("reports stats", func(t *testing.T) {
+		client := newMockClient()
+		msgs := generateTestMessages(10)
+		client.setMessages(msgs)
+
+		p, err := NewProcessor(client, "test-group", func(_ context.Context, batch []Message) error {
+			var result BatchResult
+			if batch[0].AckID == "msg-0" {
+				result.Fail(batch[0], errors.New("boom"))
+			}
+			return result.Err()
+		}, ProcessorOptions{
+			MaxBatchSize: 5,
+			NackOnError:  true,
+			ErrorHandler: func(context.Context, []Message, error) {},
+		})
+		require.NoError(t, err)
+		assert.Zero(t, p.Stats())
+
+		start := time.Now()
+		err = runUntilCaughtUp(context.Background(), p)
+		require.NoError(t, err)
+
+		stats := p.Stats()
+		assert.Equal(t, int64(10), stats.Received)
+		assert.Equal(t, int64(2), stats.Batches)
+		assert.Equal(t, int64(9), stats.Processed)
+		assert.Equal(t, int64(1), stats.Failed)
+		assert.Equal(t, int64(9), stats.Acked)
+		assert.Equal(t, int64(1), stats.Nacked)
+		assert.Zero(t, stats.InFlight)
+		assert.Zero(t, stats.Buffered)
+		assert.False(t, stats.LastReceiveAt.Before(start))
+		assert.False(t, stats.LastAckAt.Before(start))
+		assert.EqualError(t, stats.LastError, "handler failed: 1 messages failed: boom")
+		assert.False(t, stats.LastErrorAt.Before(start))
+	})
+
+	t.Run("pauses and resumes receiving", func(t *testing.T) {
+		client := newMockClient()
+		processor := newTestProcessorFunc()
+		client.setMessages(generateTestMessages(20))
+
+		p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+			MaxBatchSize: 5,
+			Prefetching:  &PrefetchingOptions{BufferSize: 10},
+		})
+		require.NoError(t, err)
+
+		p.Pause()
+		assert.True(t, p.Paused())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- p.Run(ctx)
+		}()
+
+		time.Sleep(20 * time.Millisecond)
+		client.mu.Lock()
+		assert.Zero(t, client.receiveCount, "should not receive while paused")
+		client.mu.Unlock()
+
+		p.Resume()
+		assert.False(t, p.Paused())
+		assert.Eventually(t, func() bool {
+			return len(client.acknowledgedMessages()) == 20
+		}, time.Second, 5*time.Millisecond)
+
+		cancel()
+		require.NoError(t, <-errCh)
+	})
+
+	t.Run("spills and restores prefetch buffer", func(t *testing.T) {
+		spillPath := filepath.Join(t.TempDir(), "buffer.jsonl")
+		opts := ProcessorOptions{
+			MaxBatchSize: 1,
+			Prefetching: &PrefetchingOptions{
+				BufferSize: 5,
+				SpillPath:  spillPath,
+				SpillTTL:   time.Minute,
+			},
+		}
+
+		// First run: the handler blocks, so the buffer fills and is spilled
+		client := newMockClient()
+		client.setMessages(generateTestMessages(20))
+
+		release := make(chan struct{})
+		p, err := NewProcessor(client, "test-group", func(context.Context, []Message) error {
+			<-release
+			return nil
+		}, opts)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- p.Run(ctx)
+		}()
+
+		assert.Eventually(t, func() bool {
+			return len(p.lanes[0].buffer) == 5
+		}, time.Second, 5*time.Millisecond)
+		cancel()
+		close(release)
+		require.NoError(t, <-errCh)
+		require.FileExists(t, spillPath)
+
+		spilled, err := readSpillFile(spillPath)
+		require.NoError(t, err)
+		require.Len(t, spilled, 5)
+		var buffered []string
+		for _, s := range spilled {
+			buffered = append(buffered, s.Message.AckID)
+		}
+
+		// Second run: the spilled messages are processed before anything new
+		restarted := newMockClient()
+		processor := newTestProcessorFunc()
+		opts.Prefetching = &PrefetchingOptions{BufferSize: 5, SpillPath: spillPath, SpillTTL: time.Minute}
+		p, err = NewProcessor(restarted, "test-group", processor.handler, opts)
+		require.NoError(t, err)
+
+		ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		result, err := p.RunUntilEmpty(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 5, result.Processed)
+
+		sort.Strings(buffered)
+		assert.Equal(t, buffered, restarted.acknowledgedMessages())
+		assert.NoFileExists(t, spillPath)
+	})
+
+	t.Run("disk queue", func(t *testing.T) {
+		dir := t.TempDir()
+		client := newMockClient()
+		processor := newTestProcessorFunc()
+		processor.processDelay = time.Millisecond
+
+		msgs := generateTestMessages(200)
+		client.setMessages(msgs)
+
+		var p *Processor
+		var peakBuffered int
+		handler := func(ctx context.Context, batch []Message) error {
+			if n := p.Stats().Buffered; n > peakBuffered {
+				peakBuffered = n
+			}
+			return processor.handler(ctx, batch)
+		}
+
+		p, err := NewProcessor(client, "test-group", handler, ProcessorOptions{
+			MaxBatchSize: 5,
+			Prefetching: &PrefetchingOptions{
+				BufferSize: 5,
+				DiskQueue: &DiskQueueOptions{
+					Dir:          dir,
+					MaxBytes:     4096,
+					SegmentBytes: 512,
+				},
+			},
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		result, err := p.RunUntilEmpty(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 200, result.Processed)
+
+		// Messages come out of the queue in the order they were fetched
+		var want, got []string
+		for _, msg := range msgs {
+			want = append(want, msg.AckID)
+		}
+		for _, batch := range processor.processedMessages() {
+			for _, msg := range batch {
+				got = append(got, msg.AckID)
+			}
+		}
+		assert.Equal(t, want, got)
+		assert.Greater(t, peakBuffered, 5, "Buffered should count the disk queue")
+		assert.Zero(t, p.Stats().Buffered)
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Empty(t, entries, "queue files should be removed after the run")
+
+		t.Run("nacks queued messages on stop", func(t *testing.T) {
+			client := newMockClient()
+			client.setMessages(generateTestMessages(20))
+
+			started := make(chan struct{})
+			release := make(chan struct{})
+			var once sync.Once
+			p, err := NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+				once.Do(func() { close(started) })
+				<-release
+				return nil
+			}, ProcessorOptions{
+				MaxBatchSize:   2,
+				FetchBatchSize: 20,
+				MaxInFlight:    20,
+				Prefetching: &PrefetchingOptions{
+					BufferSize: 2,
+					DiskQueue:  &DiskQueueOptions{Dir: t.TempDir(), MaxBytes: 1 << 20},
+				},
+			})
+			require.NoError(t, err)
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- p.Run(context.Background())
+			}()
+			<-started
+			// Two messages are handled, two wait for a slot, one waits for
+			// room in memory and the rest queue up on disk
+			assert.Eventually(t, func() bool {
+				return p.Stats().Buffered == 15
+			}, time.Second, time.Millisecond)
+
+			stopped := make(chan error, 1)
+			go func() { stopped <- p.Stop(context.Background()) }()
+			assert.Eventually(t, p.stopRequested, time.Second, time.Millisecond)
+			close(release)
+			require.NoError(t, <-stopped)
+			require.NoError(t, <-errCh)
+
+			// Every message is either acked or nacked, including those that
+			// were still on disk
+			settled := client.acknowledgedMessages()
+			assert.Contains(t, settled, "msg-0")
+			client.mu.Lock()
+			settled = append(settled, client.nackedMessages...)
+			client.mu.Unlock()
+			var want []string
+			for i := 0; i < 20; i++ {
+				want = append(want, fmt.Sprintf("msg-%d", i))
+			}
+			assert.ElementsMatch(t, want, settled)
+			assert.Zero(t, p.Stats().Buffered)
+			assert.True(t, p.inFlight.TryAcquire(20), "no room should stay reserved after Run returns")
+		})
+	})
+
+	t.Run("error handling", func(t *testing.T) {
+		t.Run("handles processor errors", func(t *testing.T) {
+			client := newMockClient()
+			processor := newTestProcessorFunc()
+			processor.err = errors.New("processing failed")
+
+			var errorHandlerCalled bool
+			errorHandler := func(_ context.Context, msgs []Message, err error) {
+				errorHandlerCalled = true
+				assert.EqualError(t, err, "handler failed: processing failed")
+			}
+
+			msgs := generateTestMessages(1)
+			client.setMessages(msgs)
+
+			p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+				MaxBatchSize: 1,
+				ErrorHandler: errorHandler,
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- p.Run(ctx)
+			}()
+
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+
+			require.NoError(t, <-errCh)
+			assert.True(t, errorHandlerCalled)
+
+			// Message should not have been acknowledged
+			acked := client.acknowledgedMessages()
+			assert.Empty(t, acked)
+		})
+
+		t.Run("reports ack failures separately", func(t *testing.T) {
+			client := newMockClient()
+			client.ackErr = errors.New("ack failed")
+			processor := newTestProcessorFunc()
+
+			msgs := generateTestMessages(2)
+			client.setMessages(msgs)
+
+			var ackFailures [][]string
+			p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+				MaxBatchSize: 5,
+				ErrorHandler: func(_ context.Context, _ []Message, err error) {
+					t.Errorf("unexpected ErrorHandler call: %v", err)
+				},
+				AckErrorHandler: func(_ context.Context, ackIDs []string, err error) {
+					ackFailures = append(ackFailures, ackIDs)
+					assert.ErrorIs(t, err, client.ackErr)
+				},
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			err = runUntilCaughtUp(ctx, p)
+			require.NoError(t, err)
+
+			assert.Len(t, processor.processedMessages(), 1)
+			assert.Equal(t, [][]string{{"msg-0", "msg-1"}}, ackFailures)
+		})
+
+		t.Run("salvages batches with rejected ack IDs", func(t *testing.T) {
+			client := newMockClient()
+			client.setMessages(generateTestMessages(8))
+			var acks int
+			client.ackErrFor = func(ackIDs []string) error {
+				acks++
+				for _, id := range ackIDs {
+					switch id {
+					case "msg-1":
+						return &APIError{StatusCode: http.StatusBadRequest, Summary: "invalid ack id"}
+					case "msg-6":
+						if len(ackIDs) <= 4 {
+							return &APIError{StatusCode: http.StatusInternalServerError}
+						}
+					}
+				}
+				return nil
+			}
+
+			var ackFailures [][]string
+			p, err := NewProcessor(client, "test-group", newTestProcessorFunc().handler, ProcessorOptions{
+				MaxBatchSize: 8,
+				AckErrorHandler: func(_ context.Context, ackIDs []string, err error) {
+					ackFailures = append(ackFailures, ackIDs)
+					assert.ErrorContains(t, err, "acknowledging 5 of 8 messages")
+				},
+				Logger: nopLogger{},
+			})
+			require.NoError(t, err)
+			err = runUntilCaughtUp(context.Background(), p)
+			require.NoError(t, err)
+
+			// The batch is halved until the rejected ID is isolated; the
+			// transient failure of a half is returned as it is.
+			assert.Equal(t, []string{"msg-0", "msg-2", "msg-3"}, client.acknowledgedMessages())
+			assert.Equal(t, [][]string{{"msg-1", "msg-4", "msg-5", "msg-6", "msg-7"}}, ackFailures)
+			assert.Equal(t, 7, acks)
+		})
+
+		t.Run("handles client errors", func(t *testing.T) {
+			client := newMockClient()
+			client.receiveErr = errors.New("receive failed")
+			processor := newTestProcessorFunc()
+
+			var errorHandlerCalled bool
+			errorHandler := func(_ context.Context, msgs []Message, err error) {
+				errorHandlerCalled = true
+				assert.Contains(t, err.Error(), "receive failed")
+			}
+
+			p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+				MaxBatchSize: 1,
+				ErrorHandler: errorHandler,
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- p.Run(ctx)
+			}()
+
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+
+			require.NoError(t, <-errCh)
+			assert.True(t, errorHandlerCalled)
+		})
+	})
+
+	t.Run("coalesces acks", func(t *testing.T) {
+		client := newMockClient()
+		client.setMessages(generateTestMessages(10))
+		p, err := NewProcessor(client, "test-group", newTestProcessorFunc().handler, ProcessorOptions{
+			MaxBatchSize:  2,
+			AckCoalescing: &AckCoalescingOptions{FlushInterval: time.Hour},
+		})
+		require.NoError(t, err)
+		err = runUntilCaughtUp(context.Background(), p)
+		require.NoError(t, err)
+
+		assert.Len(t, client.acknowledgedMessages(), 10)
+		assert.Equal(t, 1, client.ackCount, "acks should be flushed together when Run returns")
+
+		client = newMockClient()
+		client.setMessages(generateTestMessages(10))
+		p, err = NewProcessor(client, "test-group", newTestProcessorFunc().handler, ProcessorOptions{
+			MaxBatchSize:  2,
+			AckCoalescing: &AckCoalescingOptions{FlushInterval: time.Hour, MaxBatch: 4},
+		})
+		require.NoError(t, err)
+		err = runUntilCaughtUp(context.Background(), p)
+		require.NoError(t, err)
+
+		assert.Len(t, client.acknowledgedMessages(), 10)
+		assert.GreaterOrEqual(t, client.ackCount, 3)
+
+		// Acks made once Run has returned are sent directly
+		client = newMockClient()
+		client.setMessages(generateTestMessages(2))
+		var acker Acker
+		var held []Message
+		p, err = NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+			acker = AckerFromContext(ctx)
+			held = msgs
+			return nil
+		}, ProcessorOptions{
+			MaxBatchSize:  2,
+			AckPolicy:     Manual,
+			AckCoalescing: &AckCoalescingOptions{FlushInterval: time.Hour},
+		})
+		require.NoError(t, err)
+		err = runUntilCaughtUp(context.Background(), p)
+		require.NoError(t, err)
+		assert.Empty(t, client.acknowledgedMessages())
+
+		require.NoError(t, acker.Ack(context.Background(), held...))
+		assert.Equal(t, []string{"msg-0", "msg-1"}, client.acknowledgedMessages())
+
+		_, err = NewProcessor(client, "test-group", newTestProcessorFunc().handler, ProcessorOptions{
+			AckCoalescing: &AckCoalescingOptions{MaxBatch: -1},
+		})
+		assert.ErrorContains(t, err, "MaxBatch must be >= 0")
+	})
+
+	t.Run("nacks failed batches with a delay", func(t *testing.T) {
+		client := newMockClient()
+		client.setMessages(generateTestMessages(2))
+
+		var mu sync.Mutex
+		var errs []error
+		var failedAt time.Time
+		p, err := NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+			mu.Lock()
+			defer mu.Unlock()
+			failedAt = time.Now()
+			return errors.New("downstream unavailable")
+		}, ProcessorOptions{
+			MaxBatchSize: 2,
+			NackDelay:    50 * time.Millisecond,
+			ErrorHandler: func(_ context.Context, _ []Message, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, err)
+			},
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- p.Run(ctx)
+		}()
+		require.Eventually(t, func() bool {
+			return len(client.nacked()) == 2
+		}, time.Second, 5*time.Millisecond)
+		mu.Lock()
+		assert.GreaterOrEqual(t, time.Since(failedAt), 50*time.Millisecond)
+		mu.Unlock()
+		cancel()
+		require.NoError(t, <-errCh)
+
+		assert.Equal(t, []string{"msg-0", "msg-1"}, client.nacked())
+		assert.Empty(t, client.acknowledgedMessages())
+		require.Len(t, errs, 1)
+		assert.EqualError(t, errs[0], "handler failed: downstream unavailable")
+
+		// Messages still held when Run returns are left to the visibility timeout
+		client = newMockClient()
+		client.setMessages(generateTestMessages(2))
+		p, err = NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+			return errors.New("downstream unavailable")
+		}, ProcessorOptions{
+			MaxBatchSize: 2,
+			NackDelay:    time.Hour,
+			ErrorHandler: func(context.Context, []Message, error) {},
+		})
+		require.NoError(t, err)
+		err = runUntilCaughtUp(context.Background(), p)
+		require.NoError(t, err)
+		assert.Empty(t, client.nacked())
+
+		_, err = NewProcessor(client, "test-group", newTestProcessorFunc().handler, ProcessorOptions{NackDelay: -time.Second})
+		assert.ErrorContains(t, err, "NackDelay must be >= 0")
+	})
+
+	t.Run("backs off the nack delay of messages that keep failing", func(t *testing.T) {
+		client := newMockClient()
+		msgs := generateTestMessages(2)
+		for i := range msgs {
+			msgs[i].Metadata.IdempotencyKey = msgs[i].AckID
+		}
+
+		p, err := NewProcessor(client, "test-group", func(ctx context.Context, batch []Message) error {
+			result := &BatchResult{}
+			for _, msg := range batch {
+				if msg.AckID == "msg-0" {
+					result.Fail(msg, errors.New("poison"))
+				}
+			}
+			return result.Err()
+		}, ProcessorOptions{
+			MaxBatchSize: 2,
+			NackDelay:    time.Hour,
+			MaxNackDelay: 3 * time.Hour,
+			Logger:       nopLogger{},
+		})
+		require.NoError(t, err)
+
+		// The failing message is redelivered on every run
+		for i := 0; i < 4; i++ {
+			client.setMessages(msgs)
+			err = runUntilCaughtUp(context.Background(), p)
+			require.NoError(t, err)
+		}
+		assert.Equal(t, map[string]int{"msg-0": 4}, p.nackBackoff.failures)
+		assert.Equal(t, 3*time.Hour, p.nackBackoff.delay(msgs[0]))
+		assert.Equal(t, time.Hour, p.nackBackoff.delay(msgs[1]))
+
+		_, err = NewProcessor(client, "test-group", newTestProcessorFunc().handler, ProcessorOptions{MaxNackDelay: time.Second})
+		assert.ErrorContains(t, err, "MaxNackDelay must be >= NackDelay (0s), got 1s")
+	})
+
+	t.Run("nacks failed batches on error", func(t *testing.T) {
+		client := newMockClient()
+		client.setMessages(generateTestMessages(2))
+
+		p, err := NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+			return errors.New("downstream unavailable")
+		}, ProcessorOptions{
+			MaxBatchSize: 2,
+			NackOnError:  true,
+			ErrorHandler: func(context.Context, []Message, error) {},
+		})
+		require.NoError(t, err)
+		err = runUntilCaughtUp(context.Background(), p)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"msg-0", "msg-1"}, client.nacked())
+		assert.Empty(t, client.acknowledgedMessages())
+	})
+
+	t.Run("ack policy", func(t *testing.T) {
+		t.Run("always acks failed batches", func(t *testing.T) {
+			client := newMockClient()
+			client.setMessages(generateTestMessages(2))
+
+			var errs []error
+			p, err := NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+				return errors.New("bad record")
+			}, ProcessorOptions{
+				MaxBatchSize: 2,
+				AckPolicy:    AlwaysAck,
+				ErrorHandler: func(_ context.Context, _ []Message, err error) { errs = append(errs, err) },
+			})
+			require.NoError(t, err)
+			err = runUntilCaughtUp(context.Background(), p)
+			require.NoError(t, err)
+
+			assert.Equal(t, []string{"msg-0", "msg-1"}, client.acknowledgedMessages())
+			require.Len(t, errs, 1)
+			assert.EqualError(t, errs[0], "handler failed: bad record")
+		})
+
+		t.Run("lets the handler ack manually", func(t *testing.T) {
+			client := newMockClient()
+			client.setMessages(generateTestMessages(3))
+
+			p, err := NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+				acker := AckerFromContext(ctx)
+				require.NotNil(t, acker)
+				if err := acker.Ack(ctx, msgs[0], msgs[2]); err != nil {
+					return err
+				}
+				return acker.Nack(ctx, msgs[1])
+			}, ProcessorOptions{
+				MaxBatchSize: 3,
+				AckPolicy:    Manual,
+			})
+			require.NoError(t, err)
+			err = runUntilCaughtUp(context.Background(), p)
+			require.NoError(t, err)
+
+			assert.Equal(t, []string{"msg-0", "msg-2"}, client.acknowledgedMessages())
+			assert.Equal(t, []string{"msg-1"}, client.nacked())
+		})
+
+		t.Run("has no acker by default", func(t *testing.T) {
+			client := newMockClient()
+			client.setMessages(generateTestMessages(1))
+
+			var acker Acker
+			p, err := NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+				acker = AckerFromContext(ctx)
+				return nil
+			}, ProcessorOptions{})
+			require.NoError(t, err)
+			err = runUntilCaughtUp(context.Background(), p)
+			require.NoError(t, err)
+
+			assert.Nil(t, acker)
+			assert.Equal(t, []string{"msg-0"}, client.acknowledgedMessages())
+		})
+
+		t.Run("validates", func(t *testing.T) {
+			handler := newTestProcessorFunc().handler
+			_, err := NewProcessor(newMockClient(), "test-group", handler, ProcessorOptions{AckPolicy: Manual, NackOnError: true})
+			assert.ErrorContains(t, err, "can't be used with the manual AckPolicy")
+			_, err = NewProcessor(newMockClient(), "test-group", handler, ProcessorOptions{AckPolicy: AlwaysAck, DryRun: true})
+			assert.ErrorContains(t, err, "can't be used with the always-ack AckPolicy")
+			_, err = NewProcessor(newMockClient(), "test-group", handler, ProcessorOptions{AckPolicy: 7})
+			assert.ErrorContains(t, err, "unknown AckPolicy 7")
+		})
+	})
+
+	t.Run("retries failed batches", func(t *testing.T) {
+		client := newMockClient()
+		client.setMessages(generateTestMessages(2))
+
+		var attempts int
+		var errorCount int
+		p, err := NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+			attempts++
+			if attempts < 3 {
+				return errors.New("database failing over")
+			}
+			return nil
+		}, ProcessorOptions{
+			MaxBatchSize: 2,
+			Retry:        &HandlerRetryOptions{MaxAttempts: 3, Backoff: time.Millisecond},
+			ErrorHandler: func(context.Context, []Message, error) { errorCount++ },
+		})
+		require.NoError(t, err)
+		err = runUntilCaughtUp(context.Background(), p)
+		require.NoError(t, err)
+
+		assert.Equal(t, 3, attempts)
+		assert.Equal(t, 0, errorCount)
+		assert.Equal(t, []string{"msg-0", "msg-1"}, client.acknowledgedMessages())
+
+		_, err = NewProcessor(client, "test-group", newTestProcessorFunc().handler, ProcessorOptions{
+			Retry: &HandlerRetryOptions{Backoff: -time.Second},
+		})
+		assert.ErrorContains(t, err, "Backoff must be >= 0")
+	})
+
+	t.Run("retries only the failed messages", func(t *testing.T) {
+		client := newMockClient()
+		client.setMessages(generateTestMessages(3))
+
+		var handled [][]string
+		var reported []Message
+		p, err := NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+			handled = append(handled, ackIDsOf(msgs))
+			var result BatchResult
+			for _, msg := range msgs {
+				if msg.AckID != "msg-0" {
+					result.Fail(msg, errors.New("bad record"))
+				}
+			}
+			if len(handled) > 1 {
+				return errors.New("still failing")
+			}
+			return result.Err()
+		}, ProcessorOptions{
+			MaxBatchSize: 3,
+			Retry:        &HandlerRetryOptions{MaxAttempts: 2, Backoff: time.Millisecond},
+			ErrorHandler: func(_ context.Context, msgs []Message, err error) { reported = append(reported, msgs...) },
+		})
+		require.NoError(t, err)
+		err = runUntilCaughtUp(context.Background(), p)
+		require.NoError(t, err)
+
+		assert.Equal(t, [][]string{{"msg-0", "msg-1", "msg-2"}, {"msg-1", "msg-2"}}, handled)
+		assert.Equal(t, []string{"msg-0"}, client.acknowledgedMessages())
+		assert.Equal(t, []string{"msg-1", "msg-2"}, ackIDsOf(reported))
+	})
+
+	t.Run("dead-letters messages that exhaust retries", func(t *testing.T) {
+		client := newMockClient()
+		client.setMessages(generateTestMessages(3))
+
+		var attempts int
+		var deadLettered []string
+		var errorCount int
+		p, err := NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+			attempts++
+			var result BatchResult
+			result.Fail(msgs[len(msgs)-1], errors.New("bad record"))
+			return result.Err()
+		}, ProcessorOptions{
+			MaxBatchSize: 3,
+			Retry:        &HandlerRetryOptions{MaxAttempts: 2, Backoff: time.Millisecond},
+			DeadLetter: func(ctx context.Context, msgs []Message, err error) error {
+				deadLettered = append(deadLettered, ackIDsOf(msgs)...)
+				assert.ErrorContains(t, err, "bad record")
+				return nil
+			},
+			ErrorHandler: func(context.Context, []Message, error) { errorCount++ },
+		})
+		require.NoError(t, err)
+		err = runUntilCaughtUp(context.Background(), p)
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, attempts)
+		assert.Equal(t, []string{"msg-2"}, deadLettered)
+		assert.Equal(t, 0, errorCount)
+		assert.ElementsMatch(t, []string{"msg-0", "msg-1", "msg-2"}, client.acknowledgedMessages())
+	})
+
+	t.Run("leaves messages that fail to dead-letter", func(t *testing.T) {
+		client := newMockClient()
+		client.setMessages(generateTestMessages(2))
+
+		var errs []error
+		p, err := NewProcessor(client, "test-group", func(context.Context, []Message) error {
+			return errors.New("bad record")
+		}, ProcessorOptions{
+			MaxBatchSize: 2,
+			DeadLetter: func(context.Context, []Message, error) error {
+				return errors.New("dead-letter table unavailable")
+			},
+			ErrorHandler: func(_ context.Context, _ []Message, err error) { errs = append(errs, err) },
+		})
+		require.NoError(t, err)
+		err = runUntilCaughtUp(context.Background(), p)
+		require.NoError(t, err)
+
+		assert.Empty(t, client.acknowledgedMessages())
+		require.Len(t, errs, 1)
+		assert.EqualError(t, errs[0], "handler failed: bad record; dead-lettering messages: dead-letter table unavailable")
+	})
+
+	t.Run("acks the successes of a partly failed batch", func(t *testing.T) {
+		client := newMockClient()
+		client.setMessages(generateTestMessages(3))
+
+		var reported []Message
+		p, err := NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+			var result BatchResult
+			result.Fail(msgs[1], errors.New("bad record"))
+			return fmt.Errorf("indexing: %w", result.Err())
+		}, ProcessorOptions{
+			MaxBatchSize: 3,
+			NackOnError:  true,
+			ErrorHandler: func(_ context.Context, msgs []Message, err error) { reported = append(reported, msgs...) },
+		})
+		require.NoError(t, err)
+		err = runUntilCaughtUp(context.Background(), p)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"msg-0", "msg-2"}, client.acknowledgedMessages())
+		assert.Equal(t, []string{"msg-1"}, client.nacked())
+		require.Len(t, reported, 1)
+		assert.Equal(t, "msg-1", reported[0].AckID)
+
+		var none BatchResult
+		assert.NoError(t, none.Err())
+	})
+
+	t.Run("per-message handler", func(t *testing.T) {
+		t.Run("settles each message", func(t *testing.T) {
+			client := newMockClient()
+			client.setMessages(generateTestMessages(4))
+
+			var handled []string
+			var reported []Message
+			var errs []error
+			p, err := NewMessageProcessor(client, "test-group", func(ctx context.Context, msg Message) error {
+				handled = append(handled, msg.AckID)
+				if msg.AckID == "msg-1" || msg.AckID == "msg-3" {
+					return errors.New("bad record")
+				}
+				return nil
+			}, ProcessorOptions{
+				MaxBatchSize: 4,
+				NackOnError:  true,
+				ErrorHandler: func(_ context.Context, msgs []Message, err error) {
+					reported = append(reported, msgs...)
+					errs = append(errs, err)
+				},
+			})
+			require.NoError(t, err)
+			err = runUntilCaughtUp(context.Background(), p)
+			require.NoError(t, err)
+
+			assert.Equal(t, []string{"msg-0", "msg-1", "msg-2", "msg-3"}, handled)
+			assert.Equal(t, []string{"msg-0", "msg-2"}, client.acknowledgedMessages())
+			assert.Equal(t, []string{"msg-1", "msg-3"}, client.nacked())
+			require.Len(t, errs, 1)
+			assert.ErrorContains(t, errs[0], "handler failed: 2 messages failed")
+			assert.ErrorContains(t, errs[0], "message msg-1: bad record")
+			require.Len(t, reported, 2)
+			assert.Equal(t, "msg-1", reported[0].AckID)
+			assert.Equal(t, "msg-3", reported[1].AckID)
+		})
+
+		t.Run("acks batches that succeed", func(t *testing.T) {
+			client := newMockClient()
+			client.setMessages(generateTestMessages(3))
+
+			p, err := NewMessageProcessor(client, "test-group", func(context.Context, Message) error { return nil }, ProcessorOptions{MaxBatchSize: 3})
+			require.NoError(t, err)
+			err = runUntilCaughtUp(context.Background(), p)
+			require.NoError(t, err)
+
+			assert.Equal(t, []string{"msg-0", "msg-1", "msg-2"}, client.acknowledgedMessages())
+			assert.Empty(t, client.nacked())
+		})
+
+		t.Run("rejects manual acks", func(t *testing.T) {
+			_, err := NewMessageProcessor(newMockClient(), "test-group", func(context.Context, Message) error { return nil }, ProcessorOptions{AckPolicy: Manual})
+			assert.EqualError(t, err, "per-message processing does not support the manual AckPolicy")
+		})
+	})
+
+	t.Run("fails fast on startup", func(t *testing.T) {
+		for _, prefetch := range []*PrefetchingOptions{nil, {BufferSize: 10}} {
+			client := newMockClient()
+			client.receiveErr = fmt.Errorf("%w: invalid token", ErrUnauthorized)
+			processor := newTestProcessorFunc()
+
+			var errorCount int
+			p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+				Prefetching:  prefetch,
+				FailFast:     true,
+				ErrorHandler: func(context.Context, []Message, error) { errorCount++ },
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			require.ErrorIs(t, p.Run(ctx), ErrUnauthorized)
+			assert.Equal(t, 0, errorCount)
+		}
+
+		pinged := pingingMockClient{newMockClient(), errors.New("connection refused")}
+		p, err := NewProcessor(pinged, "test-group", newTestProcessorFunc().handler, ProcessorOptions{FailFast: true})
+		require.NoError(t, err)
+		assert.EqualError(t, p.Run(context.Background()), "pinging Sequin: connection refused")
+		assert.Equal(t, 0, pinged.receiveCount)
+	})
+
+	t.Run("consumer group deleted", func(t *testing.T) {
+		t.Run("stops with ErrConsumerGroupNotFound", func(t *testing.T) {
+			client := newMockClient()
+			client.receiveErr = fmt.Errorf("%w: test-group", ErrConsumerGroupNotFound)
+			processor := newTestProcessorFunc()
+
+			var errorCount int
+			p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+				ErrorHandler: func(context.Context, []Message, error) { errorCount++ },
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			err = p.Run(ctx)
+			require.ErrorIs(t, err, ErrConsumerGroupNotFound)
+			assert.Equal(t, notFoundThreshold, errorCount)
+		})
+
+		t.Run("recovers when the hook recreates the group", func(t *testing.T) {
+			client := newMockClient()
+			client.receiveErr = ErrConsumerGroupNotFound
+			client.setMessages(generateTestMessages(3))
+			processor := newTestProcessorFunc()
+
+			var recreated []string
+			p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+				ErrorHandler: func(context.Context, []Message, error) {},
+				OnConsumerGroupNotFound: func(_ context.Context, group string) error {
+					recreated = append(recreated, group)
+					client.mu.Lock()
+					client.receiveErr = nil
+					client.mu.Unlock()
+					return nil
+				},
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			err = runUntilCaughtUp(ctx, p)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"test-group"}, recreated)
+			assert.Len(t, client.acknowledgedMessages(), 3)
+		})
+
+		t.Run("counts ack failures", func(t *testing.T) {
+			client := newMockClient()
+			client.receiveDelay = 50 * time.Millisecond
+			client.ackErr = fmt.Errorf("%w: test-group", ErrConsumerGroupNotFound)
+			client.setMessages(generateTestMessages(3))
+			processor := newTestProcessorFunc()
+
+			var ackErrors int
+			p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+				MaxBatchSize:    1,
+				Prefetching:     &PrefetchingOptions{BufferSize: 3},
+				FetchBatchSize:  3,
+				AckErrorHandler: func(context.Context, []string, error) { ackErrors++ },
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			err = p.Run(ctx)
+			require.ErrorIs(t, err, ErrConsumerGroupNotFound)
+			assert.NoError(t, ctx.Err(), "Run stopped on its own")
+			assert.Equal(t, notFoundThreshold, ackErrors)
+		})
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		t.Run("completes in-flight messages", func(t *testing.T) {
+			client := newMockClient()
+			processor := newTestProcessorFunc()
+			processor.processDelay = 50 * time.Millisecond
+
+			msgs := generateTestMessages(10)
+			client.setMessages(msgs)
+
+			p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+				MaxBatchSize:  5,
+				MaxConcurrent: 2,
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- p.Run(ctx)
+			}()
+
+			// Wait for processing to start
+			time.Sleep(20 * time.Millisecond)
+
+			// Cancel context and wait for shutdown
+			cancel()
+
+			// Should complete without error
+			require.NoError(t, <-errCh)
+
+			// Check that messages that were in-flight were completed
+			processed := processor.processedMessages()
+			acked := client.acknowledgedMessages()
+
+			assert.NotEmpty(t, processed)
+			assert.NotEmpty(t, acked)
+		})
+
+		t.Run("drains prefetch buffer", func(t *testing.T) {
+			client := newMockClient()
+			processor := newTestProcessorFunc()
+
+			msgs := generateTestMessages(20)
+			client.setMessages(msgs)
+
+			p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+				MaxBatchSize:  5,
+				MaxConcurrent: 2,
+				Prefetching: &PrefetchingOptions{
+					BufferSize: 10,
+				},
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- p.Run(ctx)
+			}()
+
+			// Wait for buffer to fill
+			time.Sleep(50 * time.Millisecond)
+
+			// Cancel context
+			cancel()
+
+			require.NoError(t, <-errCh)
+
+			// Verify messages in buffer were processed
+			processed := processor.processedMessages()
+			var totalProcessed int
+			for _, batch := range processed {
+				totalProcessed += len(batch)
+			}
+			assert.True(t, totalProcessed >= 10, "Should process at least buffered messages")
+		})
+
+		t.Run("stops receiving after shutdown", func(t *testing.T) {
+			client := newMockClient()
+			client.receiveDelay = 10 * time.Millisecond
+			processor := newTestProcessorFunc()
+
+			msgs := generateTestMessages(100)
+			client.setMessages(msgs)
+
+			p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+				MaxBatchSize:  5,
+				MaxConcurrent: 2,
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- p.Run(ctx)
+			}()
+
+			// Let it process some messages
+			time.Sleep(30 * time.Millisecond)
+
+			// Get current receive count
+			initialReceiveCount := client.receiveCount
+
+			// Cancel and wait for shutdown
+			cancel()
+			require.NoError(t, <-errCh)
+
+			// Wait a bit to ensure no more receives
+			time.Sleep(20 * time.Millisecond)
+
+			// Should have minimal additional receives during shutdown
+			finalReceiveCount := client.receiveCount
+			assert.Less(t, finalReceiveCount-initialReceiveCount, 3,
+				"Should not make many new receives during shutdown")
+		})
+
+		t.Run("stop finishes in-flight batches and nacks the buffer", func(t *testing.T) {
+			client := newMockClient()
+			client.setMessages(generateTestMessages(10))
+
+			started := make(chan struct{})
+			release := make(chan struct{})
+			var once sync.Once
+			p, err := NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+				once.Do(func() { close(started) })
+				<-release
+				return nil
+			}, ProcessorOptions{
+				MaxBatchSize: 2,
+				Prefetching:  &PrefetchingOptions{BufferSize: 10},
+			})
+			require.NoError(t, err)
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- p.Run(context.Background())
+			}()
+			<-started
+			assert.Eventually(t, func() bool {
+				return len(p.buffered) == 6
+			}, time.Second, time.Millisecond)
+
+			stopCh := make(chan error, 1)
+			go func() {
+				stopCh <- p.Stop(context.Background())
+			}()
+			time.Sleep(20 * time.Millisecond)
+			close(release)
+
+			require.NoError(t, <-stopCh)
+			require.NoError(t, <-errCh)
+			assert.Equal(t, []string{"msg-0", "msg-1"}, client.acknowledgedMessages())
+			client.mu.Lock()
+			assert.Len(t, client.nackedMessages, 8)
+			client.mu.Unlock()
+
+			assert.NoError(t, p.Stop(context.Background()), "stopping a processor that isn't running")
+		})
+
+		t.Run("nacks unhandled messages with NackOnShutdown", func(t *testing.T) {
+			client := newMockClient()
+			client.setMessages(generateTestMessages(10))
+
+			started := make(chan struct{})
+			release := make(chan struct{})
+			var once sync.Once
+			p, err := NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+				once.Do(func() { close(started) })
+				<-release
+				return nil
+			}, ProcessorOptions{
+				MaxBatchSize:   2,
+				NackOnShutdown: true,
+				Prefetching:    &PrefetchingOptions{BufferSize: 10},
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- p.Run(ctx)
+			}()
+			<-started
+			assert.Eventually(t, func() bool {
+				return len(p.buffered) == 6
+			}, time.Second, time.Millisecond)
+
+			cancel()
+			close(release)
+			require.NoError(t, <-errCh)
+
+			assert.Equal(t, []string{"msg-0", "msg-1"}, client.acknowledgedMessages())
+			client.mu.Lock()
+			assert.ElementsMatch(t, []string{"msg-2", "msg-3", "msg-4", "msg-5", "msg-6", "msg-7", "msg-8", "msg-9"}, client.nackedMessages)
+			client.mu.Unlock()
+		})
+
+		t.Run("stop cancels handlers after the grace period", func(t *testing.T) {
+			client := newMockClient()
+			client.setMessages(generateTestMessages(1))
+
+			started := make(chan struct{})
+			handlerErr := make(chan error, 1)
+			p, err := NewProcessor(client, "test-group", func(ctx context.Context, msgs []Message) error {
+				close(started)
+				<-ctx.Done()
+				handlerErr <- ctx.Err()
+				return ctx.Err()
+			}, ProcessorOptions{})
+			require.NoError(t, err)
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- p.Run(context.Background())
+			}()
+			<-started
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			require.ErrorIs(t, p.Stop(ctx), context.DeadlineExceeded)
+			assert.ErrorIs(t, <-handlerErr, context.Canceled)
+			require.NoError(t, <-errCh)
+			assert.Empty(t, client.acknowledgedMessages())
+		})
+	})
+
+	t.Run("stress test", func(t *testing.T) {
+		if testing.Short() {
 			t.Skip("Skipping stress test in short mode")
 		}
 
@@ -465,4 +2498,175 @@ func TestProcessor(t *testing.T) {
 		acked := client.acknowledgedMessages()
 		assert.Equal(t, len(acked), totalProcessed, "All processed messages should be acknowledged")
 	})
+
+	t.Run("reports end-to-end latency", func(t *testing.T) {
+		client := newMockClient()
+		msgs := generateTestMessages(3)
+		msgs[0].Metadata.CommitTimestamp = time.Now().Add(-time.Minute)
+		msgs[1].Metadata.CommitTimestamp = time.Now().Add(-time.Second)
+		client.setMessages(msgs)
+		processor := newTestProcessorFunc()
+
+		var mu sync.Mutex
+		latencies := make(map[string]time.Duration)
+		p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+			MaxBatchSize: 3,
+			OnMessageLatency: func(_ context.Context, msg Message, latency time.Duration) {
+				mu.Lock()
+				defer mu.Unlock()
+				latencies[msg.AckID] = latency
+			},
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err = runUntilCaughtUp(ctx, p)
+		require.NoError(t, err)
+
+		mu.Lock()
+		defer mu.Unlock()
+		require.Len(t, latencies, 2, "messages without a commit timestamp are skipped")
+		assert.GreaterOrEqual(t, latencies[msgs[0].AckID], time.Minute)
+		assert.GreaterOrEqual(t, latencies[msgs[1].AckID], time.Second)
+		assert.Less(t, latencies[msgs[1].AckID], time.Minute)
+	})
+
+	t.Run("dry run nacks instead of acking", func(t *testing.T) {
+		client := newMockClient()
+		client.setMessages(generateTestMessages(4))
+		processor := newTestProcessorFunc()
+
+		p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+			MaxBatchSize: 2,
+			DryRun:       true,
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err = runUntilCaughtUp(ctx, p)
+		require.NoError(t, err)
+
+		assert.Len(t, processor.processedMessages(), 2)
+		assert.Empty(t, client.acknowledgedMessages())
+		assert.ElementsMatch(t, []string{"msg-0", "msg-1", "msg-2", "msg-3"}, client.nacked())
+	})
+
+	t.Run("shadow handler never affects acks", func(t *testing.T) {
+		client := newMockClient()
+		client.setMessages(generateTestMessages(4))
+		processor := newTestProcessorFunc()
+
+		var mu sync.Mutex
+		var shadowed, shadowErrors int
+		p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+			MaxBatchSize: 2,
+			Shadow: func(_ context.Context, msgs []Message) error {
+				mu.Lock()
+				shadowed += len(msgs)
+				first := shadowed == len(msgs)
+				mu.Unlock()
+				if first {
+					panic("shadow bug")
+				}
+				return errors.New("shadow mismatch")
+			},
+			ShadowErrorHandler: func(context.Context, []Message, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				shadowErrors++
+			},
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err = runUntilCaughtUp(ctx, p)
+		require.NoError(t, err)
+
+		assert.Len(t, client.acknowledgedMessages(), 4)
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, 4, shadowed)
+		assert.Equal(t, 2, shadowErrors)
+	})
+
+	t.Run("waits out rate limiting", func(t *testing.T) {
+		client := newMockClient()
+		client.receiveErr = fmt.Errorf("%w: %w", ErrRateLimited, &APIError{
+			StatusCode: http.StatusTooManyRequests,
+			RetryAfter: 100 * time.Millisecond,
+		})
+		processor := newTestProcessorFunc()
+
+		p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+			ErrorHandler: func(context.Context, []Message, error) {},
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, p.Run(ctx), context.DeadlineExceeded)
+
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		assert.LessOrEqual(t, client.receiveCount, 3)
+	})
+	t.Run("waits out an open circuit breaker", func(t *testing.T) {
+		client := newMockClient()
+		client.receiveErr = fmt.Errorf("making request: %w", &CircuitOpenError{RetryAfter: 100 * time.Millisecond})
+		processor := newTestProcessorFunc()
+
+		var mu sync.Mutex
+		var errs []error
+		p, err := NewProcessor(client, "test-group", processor.handler, ProcessorOptions{
+			ErrorHandler: func(_ context.Context, _ []Message, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, err)
+			},
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, p.Run(ctx), context.DeadlineExceeded)
+
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		assert.LessOrEqual(t, client.receiveCount, 3)
+		mu.Lock()
+		defer mu.Unlock()
+		require.NotEmpty(t, errs)
+		assert.ErrorIs(t, errs[0], ErrCircuitOpen)
+	})
+}
+
+// pingingMockClient is a mockClient that implements Pinger.
+type pingingMockClient struct {
+	*mockClient
+	pingErr error
+}
+
+func (m pingingMockClient) Ping(context.Context) error {
+	return m.pingErr
+}
+
+// runUntilCaughtUp runs p until it has caught up with its consumer groups,
+// then stops it by cancelling its context.
+func runUntilCaughtUp(ctx context.Context, p *Processor) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	onCaughtUp := p.opts.OnCaughtUp
+	p.opts.OnCaughtUp = func(ctx context.Context) {
+		if onCaughtUp != nil {
+			onCaughtUp(ctx)
+		}
+		cancel()
+	}
+	defer func() { p.opts.OnCaughtUp = onCaughtUp }()
+
+	return p.Run(ctx)
 }
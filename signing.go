@@ -0,0 +1,79 @@
+package sequin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RequestSigner signs outbound requests, for deployments that front Sequin
+// with an API gateway requiring signed requests in addition to the bearer
+// token. Sign is called after all other headers have been set.
+type RequestSigner interface {
+	Sign(req *http.Request) error
+}
+
+// RequestSignerFunc adapts a function to a RequestSigner.
+type RequestSignerFunc func(req *http.Request) error
+
+// Sign calls f(req).
+func (f RequestSignerFunc) Sign(req *http.Request) error {
+	return f(req)
+}
+
+// HMACSigner signs requests with HMAC-SHA256.
+//
+// The signature covers the method, path and query, a Unix timestamp and the
+// SHA-256 of the body, each on its own line:
+//
+//	POST
+//	/api/http_pull_consumers/orders/receive
+//	1700000000
+//	<hex sha256 of body>
+//
+// The hex-encoded signature is sent in X-Sequin-Signature, alongside
+// X-Sequin-Timestamp and, if set, X-Sequin-Key-Id.
+type HMACSigner struct {
+	KeyID  string
+	Secret []byte
+
+	// now is overridable for tests
+	now func() time.Time
+}
+
+// Sign implements RequestSigner.
+func (s *HMACSigner) Sign(req *http.Request) error {
+	bodyHash := sha256.New()
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return fmt.Errorf("reading body: %w", err)
+		}
+		_, err = io.Copy(bodyHash, body)
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("reading body: %w", err)
+		}
+	}
+
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	timestamp := strconv.FormatInt(now().Unix(), 10)
+
+	mac := hmac.New(sha256.New, s.Secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", req.Method, req.URL.RequestURI(), timestamp, hex.EncodeToString(bodyHash.Sum(nil)))
+
+	req.Header.Set("X-Sequin-Timestamp", timestamp)
+	req.Header.Set("X-Sequin-Signature", hex.EncodeToString(mac.Sum(nil)))
+	if s.KeyID != "" {
+		req.Header.Set("X-Sequin-Key-Id", s.KeyID)
+	}
+	return nil
+}
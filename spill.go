@@ -0,0 +1,184 @@
+package sequin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// spilledMessage is the on-disk form of a buffered message.
+type spilledMessage struct {
+	ConsumerGroup string    `json:"consumer_group"`
+	ReceivedAt    time.Time `json:"received_at"`
+	Message       Message   `json:"message"`
+}
+
+// spill saves messages left in the prefetch buffers to SpillPath.
+// It must only be called once fetching and processing have stopped.
+func (p *Processor) spill(ctx context.Context) {
+	spilled := p.drainBuffers(ctx)
+	if len(spilled) == 0 {
+		return
+	}
+	if err := writeSpillFile(p.opts.Prefetching.SpillPath, spilled); err != nil {
+		msgs := make([]Message, len(spilled))
+		for i, s := range spilled {
+			msgs[i] = s.Message
+		}
+		p.reportError(ctx, "", msgs, fmt.Errorf("spilling prefetch buffer: %w", err))
+	}
+}
+
+// drainBuffers removes the messages left in the prefetch buffers,
+// including their disk queues. It must only be called once fetching and
+// processing have stopped.
+func (p *Processor) drainBuffers(ctx context.Context) []spilledMessage {
+	var drained []spilledMessage
+	for _, l := range p.lanes {
+	Drain:
+		for {
+			select {
+			case b := <-l.buffer:
+				select {
+				case <-p.buffered:
+				default:
+				}
+				p.releaseBuffered(b.msg)
+				p.unreserve(1)
+				drained = append(drained, spilledMessage{
+					ConsumerGroup: l.consumerGroup,
+					ReceivedAt:    b.receivedAt,
+					Message:       b.msg,
+				})
+			default:
+				break Drain
+			}
+		}
+
+		if l.disk == nil {
+			continue
+		}
+		queued, err := l.disk.drain()
+		if err != nil {
+			p.reportError(ctx, l.consumerGroup, nil, fmt.Errorf("draining disk queue: %w", err))
+		}
+		for _, b := range queued {
+			p.unreserve(1)
+			drained = append(drained, spilledMessage{
+				ConsumerGroup: l.consumerGroup,
+				ReceivedAt:    b.receivedAt,
+				Message:       b.msg,
+			})
+		}
+	}
+	return drained
+}
+
+func writeSpillFile(path string, spilled []spilledMessage) error {
+	// Write to a temporary file first so a crash never leaves a partial spill
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, s := range spilled {
+		if err := enc.Encode(s); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// restore loads messages spilled by a previous run into the prefetch
+// buffers and removes the spill file.
+func (p *Processor) restore(ctx context.Context) {
+	path := p.opts.Prefetching.SpillPath
+	spilled, err := readSpillFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			p.reportError(ctx, "", nil, fmt.Errorf("restoring prefetch buffer: %w", err))
+		}
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		p.reportError(ctx, "", nil, fmt.Errorf("removing spill file: %w", err))
+	}
+
+	lanes := make(map[string]int, len(p.lanes))
+	for i, l := range p.lanes {
+		lanes[l.consumerGroup] = i
+	}
+
+	cutoff := time.Now().Add(-p.opts.Prefetching.SpillTTL)
+	restored := make([][]bufferedMessage, len(p.lanes))
+	for _, s := range spilled {
+		i, ok := lanes[s.ConsumerGroup]
+		if !ok || s.ReceivedAt.Before(cutoff) {
+			continue
+		}
+		if len(restored[i]) == cap(p.lanes[i].buffer) {
+			// The buffer is smaller than in the previous run; leave the rest
+			// for redelivery
+			continue
+		}
+		if p.inFlight != nil && !p.inFlight.TryAcquire(1) {
+			continue
+		}
+		if !p.sizer.tryAcquire() {
+			p.unreserve(1)
+			continue
+		}
+		if p.bufferBytes != nil && !p.bufferBytes.TryAcquire(p.bufferWeight(s.Message)) {
+			p.sizer.release()
+			p.unreserve(1)
+			continue
+		}
+		restored[i] = append(restored[i], bufferedMessage{msg: s.Message, receivedAt: s.ReceivedAt})
+	}
+
+	// Transactions end where the restored messages of a lane say they do,
+	// since some of them may have been left for redelivery
+	for i, msgs := range restored {
+		for j, b := range msgs {
+			b.txEnd = j == len(msgs)-1 || !sameTransaction(b.msg, msgs[j+1].msg)
+			p.lanes[i].buffer <- b
+			p.backlog.add(i, 1)
+			p.buffered <- struct{}{}
+		}
+	}
+}
+
+func readSpillFile(path string) ([]spilledMessage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var spilled []spilledMessage
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var s spilledMessage
+		if err := dec.Decode(&s); err != nil {
+			return nil, err
+		}
+		spilled = append(spilled, s)
+	}
+	return spilled, nil
+}
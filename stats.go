@@ -0,0 +1,130 @@
+package sequin
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProcessorStats is a snapshot of a processor's activity since it was
+// created, across runs.
+type ProcessorStats struct {
+	Received  int64 // messages received from Sequin
+	Processed int64 // messages whose handler succeeded
+	Failed    int64 // messages whose handler failed
+	Acked     int64 // messages acknowledged
+	Nacked    int64 // messages nacked
+	Batches   int64 // handler calls, not counting retries
+
+	InFlight int // messages in batches being handled now
+	Buffered int // messages waiting in the prefetch buffer, its disk queue included
+
+	ReceiveLatency time.Duration // how long the latest receive took, long polling included
+	AckLatency     time.Duration // how long the latest ack request took
+
+	LastReceiveAt time.Time // when the latest receive returned messages
+	LastAckAt     time.Time // when messages were last acknowledged
+	LastError     error     // the latest error reported to the ErrorHandler or AckErrorHandler
+	LastErrorAt   time.Time
+}
+
+// Stats returns a snapshot of the processor's activity, e.g. to export as
+// metrics or serve from a health endpoint. It is safe to call at any time.
+func (p *Processor) Stats() ProcessorStats {
+	s := &p.stats
+	stats := ProcessorStats{
+		Received:  s.received.Load(),
+		Processed: s.processed.Load(),
+		Failed:    s.failed.Load(),
+		Acked:     s.acked.Load(),
+		Nacked:    s.nacked.Load(),
+		Batches:   s.batches.Load(),
+		InFlight:  int(s.inFlight.Load()),
+		Buffered:  len(p.buffered) + int(s.onDisk.Load()),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats.ReceiveLatency = s.receiveLatency
+	stats.AckLatency = s.ackLatency
+	stats.LastReceiveAt = s.lastReceiveAt
+	stats.LastAckAt = s.lastAckAt
+	stats.LastError = s.lastError
+	stats.LastErrorAt = s.lastErrorAt
+	return stats
+}
+
+// processorStats collects ProcessorStats.
+type processorStats struct {
+	received, processed, failed, acked, nacked, batches atomic.Int64
+	inFlight                                            atomic.Int64
+	onDisk                                              atomic.Int64 // messages in the disk queues
+
+	mu             sync.Mutex
+	receiveLatency time.Duration
+	ackLatency     time.Duration
+	lastReceiveAt  time.Time
+	lastAckAt      time.Time
+	lastError      error
+	lastErrorAt    time.Time
+}
+
+// receive records a receive that started at start and returned n messages.
+func (s *processorStats) receive(start time.Time, n int) {
+	now := time.Now()
+	s.received.Add(int64(n))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.receiveLatency = now.Sub(start)
+	if n > 0 {
+		s.lastReceiveAt = now
+	}
+}
+
+// ack records an ack request for n messages that started at start and
+// succeeded if ok.
+func (s *processorStats) ack(start time.Time, n int, ok bool) {
+	now := time.Now()
+	if ok {
+		s.acked.Add(int64(n))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ackLatency = now.Sub(start)
+	if ok {
+		s.lastAckAt = now
+	}
+}
+
+// handled records the outcome of handling msgs, which failed if err is not
+// nil, only partly if err is a *BatchResult.
+func (s *processorStats) handled(msgs []Message, err error) {
+	failed := 0
+	if err != nil {
+		failed = len(msgs)
+		var result *BatchResult
+		if errors.As(err, &result) {
+			failed = len(result.Failed)
+		}
+	}
+	s.processed.Add(int64(len(msgs) - failed))
+	s.failed.Add(int64(failed))
+}
+
+// nack records that n messages were nacked if err is nil.
+func (s *processorStats) nack(n int, err error) {
+	if err == nil {
+		s.nacked.Add(int64(n))
+	}
+}
+
+// recordError records an error reported to the ErrorHandler or AckErrorHandler.
+func (s *processorStats) recordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = err
+	s.lastErrorAt = time.Now()
+}
@@ -0,0 +1,127 @@
+package sequin
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// runStop lets Stop end the current run of a Processor.
+type runStop struct {
+	stop    context.CancelFunc // stops receiving and dispatching
+	halt    context.CancelFunc // cancels the contexts of running handlers
+	done    chan struct{}      // closed once the run has returned
+	stopped bool               // set by Stop
+}
+
+// Stop gracefully stops a running processor. It stops receiving messages,
+// nacks the messages still waiting in the prefetch buffer so they are
+// redelivered right away (unless SpillPath saves them for the next run), and
+// waits for the batches in flight to be handled and settled and for Run to
+// return.
+//
+// ctx bounds the grace period: if it ends first, the contexts passed to the
+// running handlers are cancelled and Stop returns ctx's error without waiting
+// any longer. Run still returns once those handlers do. Stop returns nil if
+// the processor isn't running.
+func (p *Processor) Stop(ctx context.Context) error {
+	p.mu.Lock()
+	s := p.running
+	if s != nil {
+		s.stopped = true
+	}
+	p.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+
+	s.stop()
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		s.halt()
+		return ctx.Err()
+	}
+}
+
+// startRun registers a run that Stop can end by calling stop. It returns
+// the context that running handlers are cancelled with, and a function to
+// call once the run returns.
+func (p *Processor) startRun(stop context.CancelFunc) (halted context.Context, finish func()) {
+	halted, halt := context.WithCancel(context.Background())
+	s := &runStop{stop: stop, halt: halt, done: make(chan struct{})}
+
+	p.mu.Lock()
+	p.running = s
+	p.mu.Unlock()
+
+	return halted, func() {
+		p.mu.Lock()
+		p.running = nil
+		p.mu.Unlock()
+		halt()
+		close(s.done)
+	}
+}
+
+// stopRequested reports whether Stop was called during the current run.
+func (p *Processor) stopRequested() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running != nil && p.running.stopped
+}
+
+// nackOnExit reports whether messages that won't be handled should be
+// nacked as the current run ends.
+func (p *Processor) nackOnExit() bool {
+	return p.opts.NackOnShutdown || p.stopRequested()
+}
+
+// nackBuffered nacks the messages left in the prefetch buffers as the run
+// ends. It must only be called once fetching and processing have stopped.
+func (p *Processor) nackBuffered(ctx context.Context) {
+	byGroup := make(map[string][]Message)
+	for _, b := range p.drainBuffers(ctx) {
+		byGroup[b.ConsumerGroup] = append(byGroup[b.ConsumerGroup], b.Message)
+	}
+	for _, l := range p.lanes {
+		if msgs := byGroup[l.consumerGroup]; len(msgs) > 0 {
+			p.abandon(ctx, l.consumerGroup, msgs)
+		}
+	}
+}
+
+// abandon nacks msgs, which won't be handled because the run is ending,
+// after Stop or with NackOnShutdown, so that they are redelivered right away.
+// Otherwise they are left for redelivery after the visibility timeout.
+func (p *Processor) abandon(ctx context.Context, consumerGroup string, msgs []Message) {
+	if !p.nackOnExit() {
+		return
+	}
+	ctx = detach(ctx)
+	err := p.client.Nack(ctx, consumerGroup, ackIDsOf(msgs))
+	p.stats.nack(len(msgs), err)
+	p.notFound.observe(consumerGroup, err)
+	if err != nil {
+		p.reportError(ctx, consumerGroup, msgs, fmt.Errorf("nacking unhandled messages: %w", err))
+	}
+}
+
+// drop abandons msgs, which were received but won't reach a handler, and
+// releases their room under MaxInFlight.
+func (p *Processor) drop(ctx context.Context, consumerGroup string, msgs []Message) {
+	p.unreserve(len(msgs))
+	p.abandon(ctx, consumerGroup, msgs)
+}
+
+// haltContext keeps the values of its parent but is cancelled only when
+// halted is, at the end of a Stop's grace period.
+type haltContext struct {
+	context.Context
+	halted context.Context
+}
+
+func (c haltContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (c haltContext) Done() <-chan struct{}       { return c.halted.Done() }
+func (c haltContext) Err() error                  { return c.halted.Err() }
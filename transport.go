@@ -0,0 +1,270 @@
+package sequin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// newTransport builds the transport of the default HTTP client from the
+// transport options in opts. It returns nil, meaning http.DefaultTransport,
+// if none are set.
+func newTransport(opts *ClientOptions) (http.RoundTripper, error) {
+	if opts.TLSConfig == nil && opts.CACertFile == "" && opts.ClientCertificate == nil &&
+		opts.ClientCertFile == "" && opts.ClientKeyFile == "" && opts.ProxyURL == "" &&
+		opts.MaxIdleConnsPerHost == 0 && opts.IdleConnTimeout == 0 && !opts.DisableHTTP2 {
+		return nil, nil
+	}
+
+	if opts.MaxIdleConnsPerHost < 0 || opts.IdleConnTimeout < 0 {
+		return nil, errors.New("MaxIdleConnsPerHost and IdleConnTimeout must not be negative")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+		if transport.MaxIdleConns < opts.MaxIdleConnsPerHost {
+			transport.MaxIdleConns = opts.MaxIdleConnsPerHost
+		}
+	}
+	if opts.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = opts.IdleConnTimeout
+	}
+	if opts.DisableHTTP2 {
+		// A non-nil, empty TLSNextProto turns off HTTP/2
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	if opts.ProxyURL != "" {
+		proxy, err := url.Parse(opts.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("parsing ProxyURL: %w", err)
+		}
+		transport.Proxy = proxyFunc(proxy, opts.NoProxy)
+	}
+	if opts.TLSConfig != nil {
+		transport.TLSClientConfig = opts.TLSConfig.Clone()
+	}
+
+	if opts.CACertFile != "" {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		pool, err := caPool(transport.TLSClientConfig.RootCAs, opts.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	if opts.ClientCertificate != nil || opts.ClientCertFile != "" || opts.ClientKeyFile != "" {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		if err := setClientCertificate(transport.TLSClientConfig, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	return transport, nil
+}
+
+func setClientCertificate(config *tls.Config, opts *ClientOptions) error {
+	if opts.ClientCertificate != nil {
+		if opts.ClientCertFile != "" || opts.ClientKeyFile != "" {
+			return errors.New("ClientCertificate and ClientCertFile/ClientKeyFile are mutually exclusive")
+		}
+		config.Certificates = []tls.Certificate{*opts.ClientCertificate}
+		return nil
+	}
+
+	if opts.ClientCertFile == "" || opts.ClientKeyFile == "" {
+		return errors.New("ClientCertFile and ClientKeyFile must be set together")
+	}
+	r := &certReloader{certFile: opts.ClientCertFile, keyFile: opts.ClientKeyFile}
+	if _, err := r.certificate(); err != nil {
+		return err
+	}
+	config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return r.certificate()
+	}
+	return nil
+}
+
+// certReloader loads a client certificate from files, reloading it when
+// either file changes.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time // of certFile and keyFile when cert was loaded
+}
+
+// certificate returns the current certificate. If the files changed but
+// can't be loaded, e.g. mid-rotation, the previous certificate is kept.
+func (r *certReloader) certificate() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTimes, err := r.stat()
+	if err == nil && r.cert != nil && modTimes == r.modTimes {
+		return r.cert, nil
+	}
+	if err == nil {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err == nil {
+			r.cert, r.modTimes = &cert, modTimes
+			return r.cert, nil
+		}
+	}
+
+	if r.cert != nil {
+		return r.cert, nil
+	}
+	return nil, fmt.Errorf("loading client certificate: %w", err)
+}
+
+func (r *certReloader) stat() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// caPool returns base, or the system pool if base is nil, extended with the
+// certificates in the PEM file at path.
+func caPool(base *x509.CertPool, path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA certificates: %w", err)
+	}
+
+	pool := base
+	if pool == nil {
+		if pool, err = x509.SystemCertPool(); err != nil {
+			pool = x509.NewCertPool()
+		}
+	} else {
+		pool = pool.Clone()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no CA certificates found in " + path)
+	}
+	return pool, nil
+}
+
+// proxyFunc returns a Transport.Proxy function that sends requests through
+// proxy, except for hosts matching noProxy.
+func proxyFunc(proxy *url.URL, noProxy string) func(*http.Request) (*url.URL, error) {
+	var bypass []string
+	for _, entry := range strings.Split(noProxy, ",") {
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+			bypass = append(bypass, entry)
+		}
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		host, port := req.URL.Hostname(), req.URL.Port()
+		for _, entry := range bypass {
+			if bypassesProxy(entry, strings.ToLower(host), port) {
+				return nil, nil
+			}
+		}
+		return proxy, nil
+	}
+}
+
+// bypassesProxy reports whether a NO_PROXY entry matches host and port.
+func bypassesProxy(entry, host, port string) bool {
+	if entry == "*" {
+		return true
+	}
+	if _, cidr, err := net.ParseCIDR(entry); err == nil {
+		ip := net.ParseIP(host)
+		return ip != nil && cidr.Contains(ip)
+	}
+
+	if h, p, err := net.SplitHostPort(entry); err == nil {
+		if p != port {
+			return false
+		}
+		entry = h
+	}
+	entry = strings.TrimPrefix(entry, ".")
+	if ip := net.ParseIP(entry); ip != nil {
+		return ip.Equal(net.ParseIP(host))
+	}
+	return host == entry || strings.HasSuffix(host, "."+entry)
+}
+
+// ConnectionInfo describes how a request obtained its connection.
+type ConnectionInfo struct {
+	// Reused is whether the connection had been used by earlier requests,
+	// rather than dialed for this one.
+	Reused bool
+	// IdleTime is how long a reused connection sat idle beforehand.
+	IdleTime time.Duration
+}
+
+// ConnectionStats counts how the client's requests obtained connections,
+// including retries.
+type ConnectionStats struct {
+	Dials  int64 // requests that dialed a new connection
+	Reused int64 // requests sent on an existing connection
+}
+
+// ConnectionStats reports connection reuse since the client was created.
+// Many Dials relative to Reused suggest raising MaxIdleConnsPerHost.
+func (c *Client) ConnectionStats() ConnectionStats {
+	return ConnectionStats{
+		Dials:  c.conns.dials.Load(),
+		Reused: c.conns.reused.Load(),
+	}
+}
+
+// connStats collects ConnectionStats through an httptrace.ClientTrace.
+type connStats struct {
+	dials, reused atomic.Int64
+	clientTrace   *httptrace.ClientTrace
+	onConnection  func(ConnectionInfo)
+}
+
+func newConnStats(onConnection func(ConnectionInfo)) *connStats {
+	s := &connStats{onConnection: onConnection}
+	s.clientTrace = &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				s.reused.Add(1)
+			} else {
+				s.dials.Add(1)
+			}
+			if onConnection != nil {
+				onConnection(ConnectionInfo{Reused: info.Reused, IdleTime: info.IdleTime})
+			}
+		},
+	}
+	return s
+}
+
+// trace returns req set up to report its connections.
+func (s *connStats) trace(req *http.Request) *http.Request {
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), s.clientTrace))
+}
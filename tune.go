@@ -0,0 +1,104 @@
+package sequin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+)
+
+// liveOptions are the options that can be changed while the processor runs.
+type liveOptions struct {
+	maxBatchSize   atomic.Int64
+	fetchBatchSize atomic.Int64
+	maxConcurrent  atomic.Int64
+}
+
+func (p *Processor) maxBatchSize() int   { return int(p.live.maxBatchSize.Load()) }
+func (p *Processor) fetchBatchSize() int { return int(p.live.fetchBatchSize.Load()) }
+func (p *Processor) maxConcurrent() int  { return int(p.live.maxConcurrent.Load()) }
+
+// SetMaxBatchSize changes ProcessorOptions.MaxBatchSize, which applies from
+// the next batch on. n must be > 0.
+func (p *Processor) SetMaxBatchSize(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("MaxBatchSize must be > 0, got %d", n)
+	}
+	p.live.maxBatchSize.Store(int64(n))
+	return nil
+}
+
+// SetFetchBatchSize changes ProcessorOptions.FetchBatchSize, which applies
+// from the next receive on. n must be > 0.
+func (p *Processor) SetFetchBatchSize(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("FetchBatchSize must be > 0, got %d", n)
+	}
+	p.live.fetchBatchSize.Store(int64(n))
+	return nil
+}
+
+// SetMaxConcurrent changes ProcessorOptions.MaxConcurrent. A higher limit
+// lets more batches start right away; a lower one holds new batches back
+// until enough of the running ones finish. n must be > 0.
+// It can't be used with StickyPartitions, whose workers are fixed, or with
+// Autoscale, which adjusts concurrency itself.
+func (p *Processor) SetMaxConcurrent(n int) error {
+	if p.opts.StickyPartitions {
+		return errors.New("MaxConcurrent can't be changed with StickyPartitions")
+	}
+	if p.opts.Autoscale != nil {
+		return errors.New("MaxConcurrent can't be changed with Autoscale")
+	}
+	if n <= 0 {
+		return fmt.Errorf("MaxConcurrent must be > 0, got %d", n)
+	}
+	p.live.maxConcurrent.Store(int64(n))
+
+	p.mu.Lock()
+	slots := p.slots
+	p.mu.Unlock()
+	if slots != nil {
+		go slots.resize(p.maxConcurrent)
+	}
+	return nil
+}
+
+// batchSlots are the concurrency slots of a processing loop, which
+// SetMaxConcurrent can resize while batches run. The semaphore has no
+// upper bound; the slots above the current size are held.
+type batchSlots struct {
+	sem *resizableSemaphore
+	ctx context.Context // ends with the processing loop
+}
+
+// startSlots creates the concurrency slots of a processing loop running
+// under ctx, and registers them for SetMaxConcurrent until the returned
+// stop function is called.
+func (p *Processor) startSlots(ctx context.Context) (slots *batchSlots, stop func()) {
+	slots = &batchSlots{sem: newResizableSemaphore(math.MaxInt, p.maxConcurrent()), ctx: ctx}
+
+	p.mu.Lock()
+	p.slots = slots
+	p.mu.Unlock()
+
+	// Pick up a change made before the slots were registered
+	slots.resize(p.maxConcurrent)
+
+	return slots, func() {
+		p.mu.Lock()
+		p.slots = nil
+		p.mu.Unlock()
+	}
+}
+
+// resize resizes the slots until they match what size returns, waiting
+// for running batches to finish when shrinking.
+func (s *batchSlots) resize(size func() int) {
+	for n := size(); ; n = size() {
+		if from, err := s.sem.resize(s.ctx, n); err != nil || from == n {
+			return
+		}
+	}
+}
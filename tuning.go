@@ -0,0 +1,91 @@
+package sequin
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TuningOptions describes a fleet of identical processor replicas sharing a
+// consumer group, for RecommendConsumerGroupSettings.
+type TuningOptions struct {
+	// Replicas is the number of processes consuming the consumer group. Must be > 0.
+	Replicas int
+
+	// Processor is the ProcessorOptions each replica passes to NewProcessor.
+	Processor ProcessorOptions
+
+	// HandlerLatency is the worst-case time the handler takes for one batch,
+	// including the ack. Must be > 0.
+	HandlerLatency time.Duration
+}
+
+// ConsumerGroupSettings are server-side consumer group settings recommended
+// by RecommendConsumerGroupSettings.
+type ConsumerGroupSettings struct {
+	// MaxAckPending is the number of unacknowledged messages the consumer
+	// group must allow (max_ack_pending) so that no replica is starved while
+	// others hold messages in their buffers.
+	MaxAckPending int
+
+	// AckWait is the visibility timeout (ack_wait_ms) that leaves time for a
+	// message to wait behind a full buffer and be processed before it is
+	// redelivered.
+	AckWait time.Duration
+}
+
+// ackWaitHeadroom is the safety factor applied to the estimated time a
+// message spends between receive and ack.
+const ackWaitHeadroom = 2
+
+// RecommendConsumerGroupSettings computes consumer group settings that let
+// every replica keep its workers and prefetch buffer full.
+//
+// A common misconfiguration is a max_ack_pending sized for one process:
+// the first replica to fetch then holds every available message in its
+// buffer, and the others sit idle. Conversely, an ack_wait_ms shorter than
+// the time messages spend buffered causes redeliveries of messages that are
+// still waiting to be processed.
+//
+// The estimate assumes the handler is the bottleneck and ignores whether a
+// shared Limiter slows batches down further. Disk queues are not supported,
+// since the number of messages they hold depends on record sizes.
+func RecommendConsumerGroupSettings(opts TuningOptions) (ConsumerGroupSettings, error) {
+	if opts.Replicas <= 0 {
+		return ConsumerGroupSettings{}, fmt.Errorf("Replicas must be > 0, got %d", opts.Replicas)
+	}
+	if opts.HandlerLatency <= 0 {
+		return ConsumerGroupSettings{}, fmt.Errorf("HandlerLatency must be > 0, got %v", opts.HandlerLatency)
+	}
+
+	// Apply defaults to a copy, leaving the caller's options untouched
+	popts := opts.Processor
+	if popts.Prefetching != nil {
+		prefetching := *popts.Prefetching
+		if prefetching.DiskQueue != nil {
+			return ConsumerGroupSettings{}, errors.New("cannot estimate messages held by a disk queue")
+		}
+		popts.Prefetching = &prefetching
+	}
+	if err := popts.validate(); err != nil {
+		return ConsumerGroupSettings{}, fmt.Errorf("invalid processor options: %w", err)
+	}
+
+	// Messages a single replica holds unacknowledged at worst: the batches
+	// being processed, plus either one received batch waiting for a worker
+	// or the prefetch buffer and the fetch waiting to enter it.
+	processing := popts.MaxConcurrent * popts.MaxBatchSize
+	inFlight := processing + popts.MaxBatchSize
+	if popts.Prefetching != nil {
+		inFlight = processing + popts.Prefetching.BufferSize + popts.FetchBatchSize
+	}
+
+	// The last message received waits for everything ahead of it to be
+	// processed, processing messages at a time.
+	rounds := (inFlight + processing - 1) / processing
+
+	return ConsumerGroupSettings{
+		MaxAckPending: opts.Replicas * inFlight,
+		AckWait:       time.Duration(rounds) * opts.HandlerLatency * ackWaitHeadroom,
+	}, nil
+}
@@ -0,0 +1,56 @@
+package sequin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecommendConsumerGroupSettings(t *testing.T) {
+	t.Run("direct processing", func(t *testing.T) {
+		settings, err := RecommendConsumerGroupSettings(TuningOptions{
+			Replicas:       3,
+			Processor:      ProcessorOptions{MaxBatchSize: 10, MaxConcurrent: 4},
+			HandlerLatency: time.Second,
+		})
+		require.NoError(t, err)
+		// 4 batches processing plus 1 waiting, per replica
+		assert.Equal(t, 3*50, settings.MaxAckPending)
+		assert.Equal(t, 4*time.Second, settings.AckWait)
+	})
+
+	t.Run("prefetching", func(t *testing.T) {
+		opts := ProcessorOptions{
+			MaxBatchSize:   10,
+			FetchBatchSize: 100,
+			MaxConcurrent:  2,
+			Prefetching:    &PrefetchingOptions{BufferSize: 1000},
+		}
+		settings, err := RecommendConsumerGroupSettings(TuningOptions{
+			Replicas:       2,
+			Processor:      opts,
+			HandlerLatency: 500 * time.Millisecond,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 2*1120, settings.MaxAckPending)
+		assert.Equal(t, 56*time.Second, settings.AckWait)
+		assert.Zero(t, opts.Prefetching.SpillTTL, "caller's options are not modified")
+	})
+
+	t.Run("rejects invalid options", func(t *testing.T) {
+		_, err := RecommendConsumerGroupSettings(TuningOptions{HandlerLatency: time.Second})
+		assert.Error(t, err)
+
+		_, err = RecommendConsumerGroupSettings(TuningOptions{Replicas: 1})
+		assert.Error(t, err)
+
+		_, err = RecommendConsumerGroupSettings(TuningOptions{
+			Replicas:       1,
+			Processor:      ProcessorOptions{Prefetching: &PrefetchingOptions{BufferSize: 10, DiskQueue: &DiskQueueOptions{Dir: "q", MaxBytes: 1}}},
+			HandlerLatency: time.Second,
+		})
+		assert.Error(t, err)
+	})
+}
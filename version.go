@@ -0,0 +1,4 @@
+package sequin
+
+// Version is the version of this SDK, reported in the User-Agent header.
+const Version = "0.1.0"